@@ -0,0 +1,237 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// Role 用户的管理角色
+type Role string
+
+const (
+	// RoleUser 普通用户，未设置角色时的默认值
+	RoleUser Role = "user"
+	// RoleOperator 运营，可以授权 smart、设置额度与查看统计
+	RoleOperator Role = "operator"
+	// RoleAdmin 管理员，拥有全部管理权限
+	RoleAdmin Role = "admin"
+)
+
+// level 角色等级，未知角色按普通用户处理
+func (role Role) level() int {
+	switch role {
+	case RoleAdmin:
+		return 2
+	case RoleOperator:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Covers role 是否拥有 required 的全部权限
+func (role Role) Covers(required Role) bool {
+	return role.level() >= required.level()
+}
+
+// ParseRole 解析角色名称
+func ParseRole(name string) (Role, bool) {
+	switch role := Role(name); role {
+	case RoleUser, RoleOperator, RoleAdmin:
+		return role, true
+	default:
+		return "", false
+	}
+}
+
+// AdminCache 角色与额度存储
+type AdminCache interface {
+	// UserRole 用户角色，未设置时返回 RoleUser
+	UserRole(userUID sc.UserUID) (Role, error)
+
+	// UserRoleStore 设置用户角色
+	UserRoleStore(userUID sc.UserUID, role Role) error
+
+	// UserQuota 用户每天可提问的次数，0 为不限制
+	UserQuota(userUID sc.UserUID) (int64, error)
+
+	// UserQuotaStore 设置用户每天可提问的次数，0 为不限制
+	UserQuotaStore(userUID sc.UserUID, quota int64) error
+
+	// UserUsage 用户当天已提问的次数，与 SessionStore 的计数相同
+	UserUsage(userUID sc.UserUID, day time.Time) (int64, error)
+
+	// UserUsageIncr 不经过会话的提问计入当天的提问次数，如定时提问
+	UserUsageIncr(userUID sc.UserUID) (int64, error)
+
+	// UserSmartsRemove 收回用户拥有与提问使用的 smart
+	UserSmartsRemove(userUID sc.UserUID, smartIDs ...string) error
+
+	// UserSuspended 用户是否被管理员暂停
+	UserSuspended(userUID sc.UserUID) (bool, error)
+
+	// UserSuspendStore 暂停或恢复用户，暂停记录与 sc.User 分开保存，通讯录同步不会覆盖
+	UserSuspendStore(userUID sc.UserUID, suspended bool) error
+}
+
+// SuspendedStatus 通讯录同步得到的状态为正常但用户被管理员暂停时返回 UserStatusDown
+func SuspendedStatus(cache sc.Cache, userUID sc.UserUID, status sc.UserStatus) (sc.UserStatus, error) {
+	adminCache, ok := cache.(AdminCache)
+	if !ok || status != sc.UserStatusActive {
+		return status, nil
+	}
+	suspended, err := adminCache.UserSuspended(userUID)
+	if err != nil || !suspended {
+		return status, err
+	}
+	return sc.UserStatusDown, nil
+}
+
+// UserAccess 检查用户能否向 smartID 提问：状态、smart 授权与每日提问次数，smartID 为空时不检查授权
+// 不允许时返回拒绝原因与说明，允许时 reason 为空；user.Status 需要已经过 SuspendedStatus 处理
+func UserAccess(cache sc.Cache, user *sc.User, smartID string) (reason string, message string, err error) {
+	// 已停用或锁定的用户
+	if user.Status != sc.UserStatusActive {
+		return "inactive", fmt.Sprintf("user [%s] status [%d] inactive", user.UID, user.Status), nil
+	}
+
+	// smart 权限检查，包括部门与标签策略授予的 smart
+	if smartID != "" {
+		allowed, err := SmartAllowed(cache, user.UID, smartID)
+		if err != nil {
+			return "", "", err
+		}
+		if !allowed {
+			return "forbidden", fmt.Sprintf("user [%s] access denied [%s]", user.UID, smartID), nil
+		}
+	}
+
+	// 每日提问次数检查
+	if adminCache, ok := cache.(AdminCache); ok {
+		quota, err := adminCache.UserQuota(user.UID)
+		if err != nil {
+			return "", "", err
+		}
+		if quota > 0 {
+			used, err := adminCache.UserUsage(user.UID, time.Now())
+			if err != nil {
+				return "", "", err
+			}
+			if used >= quota {
+				return "quota", fmt.Sprintf("user [%s] quota [%d] exceeded", user.UID, quota), nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// UserRole 角色保存在 user:role 中而不是 sc.User.Roles：sc.Role 只是没有定义取值的整数，
+// 且通讯录同步与成员变更事件会重建 sc.User，角色需要与用户信息分开保存
+func (r Redis) UserRole(userUID sc.UserUID) (Role, error) {
+	// key -> user:role:[userUID] => Role
+	result, err := r.client.Get(r.ctx, fmt.Sprintf("user:role:%s", userUID)).Result()
+	if err == redis.Nil {
+		return RoleUser, nil
+	}
+	if err != nil {
+		return RoleUser, err
+	}
+	return Role(result), nil
+}
+
+func (r Redis) UserRoleStore(userUID sc.UserUID, role Role) error {
+	// key -> user:role:[userUID] => Role
+	before, err := r.UserRole(userUID)
+	if err != nil {
+		return err
+	}
+	if err = r.client.Set(r.ctx, fmt.Sprintf("user:role:%s", userUID), string(role), 0).Err(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityRole, string(userUID), "store", before, role)
+}
+
+func (r Redis) UserQuota(userUID sc.UserUID) (int64, error) {
+	// key -> user:quota:[userUID] => int
+	quota, err := r.client.Get(r.ctx, fmt.Sprintf("user:quota:%s", userUID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return quota, err
+}
+
+func (r Redis) UserQuotaStore(userUID sc.UserUID, quota int64) error {
+	// key -> user:quota:[userUID] => int
+	before, err := r.UserQuota(userUID)
+	if err != nil {
+		return err
+	}
+	if quota <= 0 {
+		quota = 0
+		err = r.client.Del(r.ctx, fmt.Sprintf("user:quota:%s", userUID)).Err()
+	} else {
+		err = r.client.Set(r.ctx, fmt.Sprintf("user:quota:%s", userUID), quota, 0).Err()
+	}
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntityQuota, string(userUID), "store", before, quota)
+}
+
+func (r Redis) UserUsage(userUID sc.UserUID, day time.Time) (int64, error) {
+	// key -> used:[time]:[UserUID] => int
+	used, err := r.client.Get(r.ctx, fmt.Sprintf("used:%s:%s", day.Format("20060102"), userUID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (r Redis) UserUsageIncr(userUID sc.UserUID) (int64, error) {
+	// key -> used:[time]:[UserUID] => int
+	return r.client.Incr(r.ctx, fmt.Sprintf("used:%s:%s", today(), userUID)).Result()
+}
+
+func (r Redis) UserSmartsRemove(userUID sc.UserUID, smartIDs ...string) error {
+	//key -> user:smart:[UserUID] > [...SmartID]
+	//key -> user:question:[UserUID] > [...SmartID]
+	before, err := r.UserSmartUIDs(userUID)
+	if err != nil {
+		return err
+	}
+	pipe := r.client.TxPipeline()
+	pipe.SRem(r.ctx, fmt.Sprintf("user:smart:%s", userUID), smartIDs)
+	pipe.SRem(r.ctx, fmt.Sprintf("user:question:%s", userUID), smartIDs)
+	if _, err = pipe.Exec(r.ctx); err != nil {
+		return err
+	}
+	after, err := r.UserSmartUIDs(userUID)
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntitySmarts, string(userUID), "revoke", sortedSet(before), sortedSet(after))
+}
+
+func (r Redis) UserSuspended(userUID sc.UserUID) (bool, error) {
+	// key -> user:suspended => set(UserUID)
+	return r.client.SIsMember(r.ctx, "user:suspended", string(userUID)).Result()
+}
+
+func (r Redis) UserSuspendStore(userUID sc.UserUID, suspended bool) error {
+	// key -> user:suspended => set(UserUID)
+	before, err := r.UserSuspended(userUID)
+	if err != nil {
+		return err
+	}
+	if suspended {
+		err = r.client.SAdd(r.ctx, "user:suspended", string(userUID)).Err()
+	} else {
+		err = r.client.SRem(r.ctx, "user:suspended", string(userUID)).Err()
+	}
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntitySuspend, string(userUID), "store", before, suspended)
+}
@@ -0,0 +1,184 @@
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Provider 配置ID的类型，配置项：token、baseURL、model、maxTokens、systemPrompt
+const Provider = "anthropic"
+
+// DefaultBaseURL Anthropic 接口地址
+const DefaultBaseURL = "https://api.anthropic.com"
+
+// DefaultModel 未配置 model 时使用的模型
+const DefaultModel = "claude-3-5-haiku-latest"
+
+// DefaultMaxTokens 答复的最大 token 数，Messages 接口必须指定
+const DefaultMaxTokens = 4096
+
+// apiVersion Messages 接口的版本
+const apiVersion = "2023-06-01"
+
+// defaultTimeout 未使用 ctx 提问时的超时时间
+const defaultTimeout = 2 * time.Minute
+
+func init() {
+	sw.RegisterProvider(Provider, func(configure sc.Configure) (smart.Smart, error) {
+		token := sw.ConfigureString(configure, "token", "")
+		if token == "" {
+			return nil, errors.New("anthropic token required")
+		}
+		claude := NewClaude(sw.ConfigureString(configure, "baseURL", DefaultBaseURL), token,
+			sw.ConfigureString(configure, "model", DefaultModel))
+		switch maxTokens := configure["maxTokens"].(type) {
+		case int:
+			claude.maxTokens = maxTokens
+		case int64:
+			claude.maxTokens = int(maxTokens)
+		case float64: // 管理接口以 JSON 保存的配置
+			claude.maxTokens = int(maxTokens)
+		}
+		claude.SetSystemPrompt(sw.ConfigureString(configure, "systemPrompt", ""))
+		return claude, nil
+	})
+}
+
+// Claude 使用 Anthropic Messages 接口
+// https://docs.anthropic.com/en/api/messages
+type Claude struct {
+	smart.Smart
+
+	client    *http.Client
+	baseURL   string
+	token     string
+	model     string
+	maxTokens int
+	// systemPrompt smart 的系统提示，与用户的自定义说明合并后作为 system 参数
+	systemPrompt string
+}
+
+func NewClaude(baseURL string, token string, model string) *Claude {
+	return &Claude{
+		client:    &http.Client{Timeout: defaultTimeout},
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		token:     token,
+		model:     model,
+		maxTokens: DefaultMaxTokens,
+	}
+}
+
+// SetSystemPrompt 设置 smart 的系统提示
+func (claude *Claude) SetSystemPrompt(prompt string) {
+	claude.systemPrompt = strings.TrimSpace(prompt)
+}
+
+func (claude *Claude) Platform() string {
+	return "Claude"
+}
+
+func (claude *Claude) Ask(q sc.Question) (sc.Answer, error) {
+	return claude.AskContext(context.Background(), q)
+}
+
+type message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type messagesRequest struct {
+	Model     string    `json:"model"`
+	MaxTokens int       `json:"max_tokens"`
+	System    string    `json:"system,omitempty"`
+	Messages  []message `json:"messages"`
+}
+
+type messagesResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// AskContext 提问，system 消息通过 system 参数传递，ctx 超时或取消时中止请求
+func (claude *Claude) AskContext(ctx context.Context, q sc.Question) (sc.Answer, error) {
+	messages := sw.ChatMessages(claude.systemPrompt, q)
+	req := messagesRequest{Model: claude.model, MaxTokens: claude.maxTokens, Messages: make([]message, 0, len(messages))}
+	for i := range messages {
+		if messages[i].Role == sw.MessageRoleSystem {
+			req.System = messages[i].Content
+			continue
+		}
+		req.Messages = append(req.Messages, message{Role: string(messages[i].Role), Content: messages[i].Content})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, claude.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", claude.token)
+	httpReq.Header.Set("anthropic-version", apiVersion)
+	httpResp, err := claude.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var resp messagesResponse
+	if err = json.Unmarshal(respBody, &resp); err != nil {
+		return nil, errors.New(fmt.Sprintf("anthropic status %d, %s", httpResp.StatusCode, err.Error()))
+	}
+	if httpResp.StatusCode != http.StatusOK || resp.Error != nil {
+		detail := ""
+		if resp.Error != nil {
+			detail = resp.Error.Message
+		}
+		return nil, errors.New(fmt.Sprintf("anthropic status %d, %s", httpResp.StatusCode, detail))
+	}
+
+	monitor.SmartTokens.WithLabelValues(claude.Platform(), resp.Model, "prompt").Add(float64(resp.Usage.InputTokens))
+	monitor.SmartTokens.WithLabelValues(claude.Platform(), resp.Model, "completion").Add(float64(resp.Usage.OutputTokens))
+	var text strings.Builder
+	for i := range resp.Content {
+		if resp.Content[i].Type == "text" {
+			text.WriteString(resp.Content[i].Text)
+		}
+	}
+	if text.Len() == 0 {
+		return nil, errors.New("anthropic empty content")
+	}
+	return text.String(), nil
+}
+
+func (claude *Claude) Balance() (float32, error) {
+	return 0, nil
+}
@@ -0,0 +1,93 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAskContext(t *testing.T) {
+	var req messagesRequest
+	var apiKey, version string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		apiKey, version = r.Header.Get("x-api-key"), r.Header.Get("anthropic-version")
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request %s", err.Error())
+		}
+		_, _ = w.Write([]byte(`{"model":"claude","content":[{"type":"text","text":"你"},{"type":"text","text":"好"}],` +
+			`"usage":{"input_tokens":3,"output_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	claude := NewClaude(server.URL+"/", "sk-ant", "claude")
+	claude.SetSystemPrompt("你是助手")
+	answer, err := claude.AskContext(context.Background(), sw.Conversation{
+		History:  []sw.Message{{Role: sw.MessageRoleUser, Content: "hi"}, {Role: sw.MessageRoleAssistant, Content: "hello"}},
+		Question: "hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "你好" {
+		t.Errorf("answer = %v, want 你好", answer)
+	}
+	if apiKey != "sk-ant" || version != apiVersion {
+		t.Errorf("x-api-key = %q, anthropic-version = %q", apiKey, version)
+	}
+	if req.Model != "claude" || req.MaxTokens != DefaultMaxTokens || req.System != "你是助手" {
+		t.Errorf("model = %s, max_tokens = %d, system = %q", req.Model, req.MaxTokens, req.System)
+	}
+	if len(req.Messages) != 3 || req.Messages[0].Role != "user" || req.Messages[1].Role != "assistant" ||
+		req.Messages[2].Role != "user" || req.Messages[2].Content != "hello" {
+		t.Errorf("messages = %+v", req.Messages)
+	}
+}
+
+func TestAskContextError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"error field", http.StatusUnauthorized, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`,
+			"invalid x-api-key"},
+		{"not json", http.StatusBadGateway, `bad gateway`, "anthropic status 502"},
+		{"empty content", http.StatusOK, `{"model":"claude","content":[]}`, "empty content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := NewClaude(server.URL, "sk-ant", "claude").AskContext(context.Background(), "hello")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvider(t *testing.T) {
+	if _, err := sw.NewSmart("anthropic:test", sc.Configure{}); err == nil {
+		t.Error("missing token expected error")
+	}
+	s, err := sw.NewSmart("anthropic:test", sc.Configure{"token": "sk-ant", "maxTokens": 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claude := s.(*Claude); claude.model != DefaultModel || claude.maxTokens != 1024 {
+		t.Errorf("model = %s, max tokens = %d", claude.model, claude.maxTokens)
+	}
+}
@@ -0,0 +1,194 @@
+package smart_wecom
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ActorSystem 未通过 WithActor 指定操作人时的操作人，如程序启动时的导入与通讯录同步
+const ActorSystem = "system"
+
+// 操作记录的对象类型
+const (
+	AuditEntityUser         = "user"
+	AuditEntityBinding      = "binding"
+	AuditEntitySmarts       = "smarts"
+	AuditEntityAnswer       = "answer"
+	AuditEntityConfigure    = "configure"
+	AuditEntityRole         = "role"
+	AuditEntityQuota        = "quota"
+	AuditEntitySuspend      = "suspend"
+	AuditEntityProfile      = "profile"
+	AuditEntityPolicy       = "policy"
+	AuditEntityGroup        = "group"
+	AuditEntityCommand      = "command"
+	AuditEntityInstructions = "instructions"
+	AuditEntityTool         = "tool"
+	AuditEntityBroadcast    = "broadcast"
+)
+
+// AuditEntry 一次修改操作的记录，只追加不修改
+type AuditEntry struct {
+	Time time.Time
+	// Actor 操作人，如 wecom:zhangsan、console 或 system
+	Actor string
+	// Action 操作名称，如 store、delete、grant
+	Action string
+	// Entity 对象类型，如 user、configure
+	Entity string
+	// Target 对象ID，如 UserUID 或配置ID
+	Target string
+	// Before 修改前的数据，JSON 格式，密钥已脱敏
+	Before string
+	// After 修改后的数据，JSON 格式，密钥已脱敏
+	After string
+	// Detail 操作说明
+	Detail string
+}
+
+// AuditQuery 操作记录查询条件，Entity 与 Target 为空时不过滤
+type AuditQuery struct {
+	Start  time.Time
+	End    time.Time
+	Entity string
+	Target string
+}
+
+// AuditCache 操作记录存储
+type AuditCache interface {
+	// AuditAppend 追加一条操作记录
+	AuditAppend(entry *AuditEntry) error
+
+	// AuditEntries 符合查询条件的操作记录，按时间顺序
+	AuditEntries(query AuditQuery) ([]AuditEntry, error)
+}
+
+type actorKey struct{}
+
+// WithActor 返回带有操作人的 ctx，绑定该 ctx 的 cache 修改数据时记录操作人
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext ctx 中的操作人，未指定时返回 ActorSystem
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return ActorSystem
+}
+
+func (r Redis) AuditAppend(entry *AuditEntry) error {
+	// key -> audit:time => zset(AuditEntry, Time)
+	entryPack, err := msgpack.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return r.client.ZAdd(r.ctx, "audit:time", redis.Z{
+		Score:  float64(entry.Time.UnixNano()),
+		Member: entryPack,
+	}).Err()
+}
+
+func (r Redis) AuditEntries(query AuditQuery) ([]AuditEntry, error) {
+	// key -> audit:time => zset(AuditEntry, Time)
+	result, err := r.client.ZRangeByScore(r.ctx, "audit:time", &redis.ZRangeBy{
+		Min: strconv.FormatInt(query.Start.UnixNano(), 10),
+		Max: strconv.FormatInt(query.End.UnixNano(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0, len(result))
+	for i := range result {
+		var entry AuditEntry
+		if err = msgpack.Unmarshal([]byte(result[i]), &entry); err != nil {
+			return nil, err
+		}
+		if (query.Entity != "" && entry.Entity != query.Entity) ||
+			(query.Target != "" && entry.Target != query.Target) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// audit 记录 r 上的一次修改，before 与 after 相同时不记录
+func (r Redis) audit(entity string, target string, action string, before any, after any) error {
+	beforeJSON, afterJSON := auditJSON(before, nil), auditJSON(after, before)
+	if beforeJSON == afterJSON {
+		return nil
+	}
+	return r.AuditAppend(&AuditEntry{
+		Time:   time.Now(),
+		Actor:  ActorFromContext(r.ctx),
+		Action: action,
+		Entity: entity,
+		Target: target,
+		Before: beforeJSON,
+		After:  afterJSON,
+	})
+}
+
+// auditJSON 操作记录中的数据，配置中的密钥脱敏，与 previous 中的值不同时标记为 changed
+// 不记录密钥的摘要，避免操作记录被用来离线验证猜测的密钥
+func auditJSON(v any, previous any) string {
+	if configure, ok := v.(sc.Configure); ok {
+		before, _ := previous.(sc.Configure)
+		redacted := RedactConfigure(configure)
+		for name, value := range redacted {
+			if value != RedactedValue || previous == nil {
+				continue
+			}
+			if old, ok := before[name]; !ok || fmt.Sprint(old) != fmt.Sprint(configure[name]) {
+				redacted[name] = fmt.Sprintf("%s(changed)", RedactedValue)
+			}
+		}
+		v = redacted
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// sortedSet 排序后的集合成员，避免 SMembers 顺序不同导致记录无变化的修改
+func sortedSet(members []string) []string {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// WriteAuditCSV 以 csv 格式导出操作记录
+func WriteAuditCSV(w io.Writer, entries []AuditEntry) error {
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"time", "actor", "action", "entity", "target", "before", "after", "detail"})
+	for i := range entries {
+		_ = writer.Write([]string{
+			entries[i].Time.Format(time.RFC3339),
+			entries[i].Actor,
+			entries[i].Action,
+			entries[i].Entity,
+			entries[i].Target,
+			entries[i].Before,
+			entries[i].After,
+			entries[i].Detail,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
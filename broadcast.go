@@ -0,0 +1,236 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BroadcastAll 发送给应用可见范围内的所有成员
+const BroadcastAll = "@all"
+
+// BroadcastStatus 群发状态
+type BroadcastStatus string
+
+const (
+	BroadcastStatusSending BroadcastStatus = "sending"
+	BroadcastStatusDone    BroadcastStatus = "done"
+	BroadcastStatusFailed  BroadcastStatus = "failed"
+)
+
+// DeliveryStatus 单个接收人的发送结果
+type DeliveryStatus string
+
+const (
+	DeliveryStatusSent    DeliveryStatus = "sent"
+	DeliveryStatusFailed  DeliveryStatus = "failed"
+	DeliveryStatusSkipped DeliveryStatus = "skipped"
+)
+
+// BroadcastTarget 群发的接收范围，部门包含子部门，标签包含通过部门加入的成员
+type BroadcastTarget struct {
+	// UserIDs 企微用户ID，BroadcastAll 为所有成员
+	UserIDs []string `json:"userIDs,omitempty"`
+	DeptIDs []int64  `json:"deptIDs,omitempty"`
+	TagIDs  []int64  `json:"tagIDs,omitempty"`
+}
+
+// Empty 未指定任何接收人
+func (target *BroadcastTarget) Empty() bool {
+	return len(target.UserIDs) == 0 && len(target.DeptIDs) == 0 && len(target.TagIDs) == 0
+}
+
+// Broadcast 主动发送的消息
+type Broadcast struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor"`
+
+	Target BroadcastTarget `json:"target"`
+	// Content markdown 内容，Template 为 true 时可使用模板变量，如 {{.User.Name}}、{{.Date}}，每个接收人单独渲染
+	Content string `json:"content"`
+	// Template Content 是否为模板，不是模板时原样发送，内容中的 {{ 不会被解析
+	Template bool `json:"template,omitempty"`
+	// SmartID 不为空时渲染后的内容作为提问，由 smart 为每个接收人生成消息
+	SmartID string `json:"smartID,omitempty"`
+
+	Status     BroadcastStatus `json:"status"`
+	Recipients int             `json:"recipients"`
+	Sent       int             `json:"sent"`
+	Failed     int             `json:"failed"`
+	// Error 群发失败的原因，如超出每日发送额度
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// Personalized 是否需要为每个接收人单独生成内容，否则合并发送
+func (broadcast *Broadcast) Personalized() bool {
+	return broadcast.SmartID != "" || broadcast.Template
+}
+
+// PromptTemplate 群发内容作为模板
+func (broadcast *Broadcast) PromptTemplate() *PromptTemplate {
+	return &PromptTemplate{Name: fmt.Sprintf("broadcast-%s", broadcast.ID), Version: 1, Text: broadcast.Content}
+}
+
+// Validate 检查接收范围与内容
+func (broadcast *Broadcast) Validate() error {
+	if broadcast.Target.Empty() {
+		return errors.New("target required")
+	}
+	if strings.TrimSpace(broadcast.Content) == "" {
+		return errors.New("content required")
+	}
+	if broadcast.Template {
+		// 使用示例用户检查模板，发送时使用每个接收人的用户信息
+		if _, err := broadcast.PromptTemplate().Render(NewTemplateData(&sc.User{Name: "示例"}, broadcast.SmartID, "")); err != nil {
+			return errors.New(fmt.Sprintf("invalid content template, %s", err.Error()))
+		}
+	}
+	return nil
+}
+
+// BroadcastDelivery 单个接收人的发送结果
+type BroadcastDelivery struct {
+	UserID string         `json:"userID"`
+	Time   time.Time      `json:"time"`
+	Status DeliveryStatus `json:"status"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// BroadcastCache 群发与发送结果存储
+type BroadcastCache interface {
+	// BroadcastStore 保存群发，相同 ID 覆盖
+	BroadcastStore(broadcast *Broadcast) error
+
+	// Broadcast 群发详情
+	Broadcast(id string) (*Broadcast, error)
+
+	// Broadcasts 时间在 [start, end] 内的群发
+	Broadcasts(start time.Time, end time.Time) ([]Broadcast, error)
+
+	// BroadcastDeliveryStore 保存接收人的发送结果
+	BroadcastDeliveryStore(id string, deliveries ...*BroadcastDelivery) error
+
+	// BroadcastDeliveries 群发的所有发送结果
+	BroadcastDeliveries(id string) ([]BroadcastDelivery, error)
+
+	// BroadcastReserve 预占今天的 n 人次发送额度，超出 limit 时返回 false，limit 为 0 时不限制
+	BroadcastReserve(n int, limit int) (bool, error)
+
+	// BroadcastRelease 归还今天预占但未发送成功的 n 人次额度
+	BroadcastRelease(n int) error
+}
+
+func (r Redis) BroadcastStore(broadcast *Broadcast) error {
+	// key -> broadcast:job => hash(ID, Broadcast)
+	// key -> broadcast:time => zset(ID, Time)
+	broadcastPack, err := msgpack.Marshal(broadcast)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.ctx, "broadcast:job", broadcast.ID, broadcastPack)
+		pipe.ZAdd(r.ctx, "broadcast:time", redis.Z{Score: float64(broadcast.Time.UnixNano()), Member: broadcast.ID})
+		return nil
+	})
+	return err
+}
+
+func (r Redis) Broadcast(id string) (*Broadcast, error) {
+	broadcastPack, err := r.client.HGet(r.ctx, "broadcast:job", id).Result()
+	if err == redis.Nil {
+		return nil, errors.New(fmt.Sprintf("broadcast [%s] not found", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var broadcast Broadcast
+	if err = msgpack.Unmarshal([]byte(broadcastPack), &broadcast); err != nil {
+		return nil, err
+	}
+	return &broadcast, nil
+}
+
+func (r Redis) Broadcasts(start time.Time, end time.Time) ([]Broadcast, error) {
+	ids, err := r.client.ZRangeByScore(r.ctx, "broadcast:time", &redis.ZRangeBy{
+		Min: strconv.FormatInt(start.UnixNano(), 10),
+		Max: strconv.FormatInt(end.UnixNano(), 10),
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	result, err := r.client.HMGet(r.ctx, "broadcast:job", ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	broadcasts := make([]Broadcast, 0, len(result))
+	for i := range result {
+		broadcastPack, ok := result[i].(string)
+		if !ok {
+			continue
+		}
+		var broadcast Broadcast
+		if err = msgpack.Unmarshal([]byte(broadcastPack), &broadcast); err != nil {
+			return nil, err
+		}
+		broadcasts = append(broadcasts, broadcast)
+	}
+	return broadcasts, nil
+}
+
+func (r Redis) BroadcastDeliveryStore(id string, deliveries ...*BroadcastDelivery) error {
+	// key -> broadcast:delivery:[ID] => hash(UserID, BroadcastDelivery)
+	if len(deliveries) == 0 {
+		return nil
+	}
+	values := make([]any, 0, 2*len(deliveries))
+	for i := range deliveries {
+		deliveryPack, err := msgpack.Marshal(deliveries[i])
+		if err != nil {
+			return err
+		}
+		values = append(values, deliveries[i].UserID, deliveryPack)
+	}
+	return r.client.HSet(r.ctx, fmt.Sprintf("broadcast:delivery:%s", id), values...).Err()
+}
+
+func (r Redis) BroadcastDeliveries(id string) ([]BroadcastDelivery, error) {
+	result, err := r.client.HGetAll(r.ctx, fmt.Sprintf("broadcast:delivery:%s", id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]BroadcastDelivery, 0, len(result))
+	for userID := range result {
+		var delivery BroadcastDelivery
+		if err = msgpack.Unmarshal([]byte(result[userID]), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (r Redis) BroadcastReserve(n int, limit int) (bool, error) {
+	// key -> broadcast:sent:[yyyymmdd] => int
+	key := fmt.Sprintf("broadcast:sent:%s", today())
+	sent, err := r.client.IncrBy(r.ctx, key, int64(n)).Result()
+	if err != nil {
+		return false, err
+	}
+	r.client.Expire(r.ctx, key, 48*time.Hour)
+	if limit > 0 && sent > int64(limit) {
+		return false, r.client.DecrBy(r.ctx, key, int64(n)).Err()
+	}
+	return true, nil
+}
+
+func (r Redis) BroadcastRelease(n int) error {
+	// key -> broadcast:sent:[yyyymmdd] => int
+	return r.client.DecrBy(r.ctx, fmt.Sprintf("broadcast:sent:%s", today()), int64(n)).Err()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-wecom/tracing"
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
 	"github.com/vmihailenco/msgpack/v5"
@@ -15,20 +16,36 @@ func today() string {
 	return time.Now().Format("20060102")
 }
 
-var ctx = context.Background()
-
 type Redis struct {
 	sc.Cache
 
 	client *redis.Client
+	ctx    context.Context
 }
 
 func NewRedis(Addr string, Password string, db int) sc.Cache {
-	return &Redis{client: redis.NewClient(&redis.Options{
+	client := redis.NewClient(&redis.Options{
 		Addr:     Addr,
 		Password: Password, // no password set
 		DB:       db,       // use default DB
-	})}
+
+		ContextTimeoutEnabled: true, // 绑定的 ctx 超时或取消时中止命令
+	})
+	client.AddHook(tracing.RedisHook{})
+
+	return &Redis{client: client, ctx: context.Background()}
+}
+
+// WithContext 返回绑定 ctx 的副本，共用同一个连接池
+// 副本上的所有操作都受 ctx 的超时与取消控制
+func (r Redis) WithContext(ctx context.Context) sc.Cache {
+	r.ctx = ctx
+	return &r
+}
+
+// Ping 检查 Redis 连通性，受 ctx 的超时与取消控制
+func (r Redis) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
 }
 
 func (r Redis) Error(id sc.SessionID) (sc.SessionError, error) {
@@ -46,19 +63,33 @@ func (r Redis) SessionStore(session *sc.Session) (err error) {
 	// key -> used:[time]:[UserUID] => int
 	// key -> session:[time]:[UserUID]:[SessionID] => Session
 
-	r.client.Incr(ctx, fmt.Sprintf("used:%s:%s", today(), session.User.UID)) // 当天调用数+1
+	r.client.Incr(r.ctx, fmt.Sprintf("used:%s:%s", today(), session.User.UID)) // 当天调用数+1
 
-	if sessionPack, err := msgpack.Marshal(session); err == nil {
+	// 会话记录只保存提问的文本，渠道消息的内容在未导出字段中，直接序列化会丢失
+	record := *session
+	record.Question = recordQuestion(session.Question)
+	if sessionPack, err := msgpack.Marshal(&record); err == nil {
 		// 保存session记录
-		r.client.Set(ctx, fmt.Sprintf("session:%s:%s:%s", today(), session.User.UID, session.ID),
+		r.client.Set(r.ctx, fmt.Sprintf("session:%s:%s:%s", today(), session.User.UID, session.ID),
 			sessionPack, -1)
 	}
 	return err
 }
 
+// recordQuestion 会话记录中保存的提问文本
+func recordQuestion(question sc.Question) sc.Question {
+	if message, ok := question.(interface{ Content() string }); ok {
+		return message.Content()
+	}
+	if text := QuestionText(question); text != "" {
+		return text
+	}
+	return question
+}
+
 func (r Redis) Session(sessionID sc.SessionID) (session *sc.Session, err error) {
 	// key -> session:record:[time]:[UserUID]:[SessionID] => Session
-	if result, _, err := r.client.Scan(ctx, 0,
+	if result, _, err := r.client.Scan(r.ctx, 0,
 		fmt.Sprintf("session:record:*:%s", sessionID), 1).Result(); err == nil || result != nil {
 		if err = msgpack.Unmarshal([]byte(result[0]), &session); err == nil {
 			return session, nil
@@ -70,13 +101,13 @@ func (r Redis) Session(sessionID sc.SessionID) (session *sc.Session, err error)
 
 func (r Redis) SessionStatusRecord(sessionID sc.SessionID, status sc.SessionStatus) error {
 	// key -> session:status:[SessionID] -> SessionStatus
-	_, err := r.client.Set(ctx, fmt.Sprintf("session:status:*:%s", sessionID), status, 0).Result()
+	_, err := r.client.Set(r.ctx, fmt.Sprintf("session:status:*:%s", sessionID), status, 0).Result()
 	return err
 }
 
 func (r Redis) SessionStatus(sessionID sc.SessionID) (status sc.SessionStatus, err error) {
 	// key -> session:status:[SessionID] -> SessionStatus
-	if result, err := r.client.Get(ctx, fmt.Sprintf("session:status:*:%s", sessionID)).Result(); err == nil {
+	if result, err := r.client.Get(r.ctx, fmt.Sprintf("session:status:*:%s", sessionID)).Result(); err == nil {
 		if len(result) > 0 {
 			if atoi, err := strconv.Atoi(result); err == nil {
 				return sc.SessionStatus(atoi), nil
@@ -92,7 +123,7 @@ func (r Redis) SessionHistory(userUID sc.UserUID, start time.Time, end time.Time
 	// key -> session:record:[time]:[UserUID]:[SessionID] => Session
 
 	// TODO 暂时返回全部记录
-	if result, _, err := r.client.Scan(ctx, 0,
+	if result, _, err := r.client.Scan(r.ctx, 0,
 		fmt.Sprintf("session:record:*:%s*", userUID), 1).Result(); err == nil || result != nil {
 		for i := range result {
 			session := sc.Session{}
@@ -106,7 +137,7 @@ func (r Redis) SessionHistory(userUID sc.UserUID, start time.Time, end time.Time
 
 func (r Redis) User(userUID sc.UserUID) (user *sc.User, err error) {
 	// key -> user:info:[userUID] => User
-	if result, err := r.client.Get(ctx, fmt.Sprintf("user:info:%s", userUID)).Result(); err == nil {
+	if result, err := r.client.Get(r.ctx, fmt.Sprintf("user:info:%s", userUID)).Result(); err == nil {
 		if len(result) != 0 {
 			if err = msgpack.Unmarshal([]byte(result), &user); err == nil {
 				return user, nil
@@ -119,7 +150,7 @@ func (r Redis) User(userUID sc.UserUID) (user *sc.User, err error) {
 
 func (r Redis) UserID2UID(userID string) (userUID sc.UserUID, err error) {
 	// key -> user:uid:[userID] => userUID
-	result, err := r.client.Get(ctx,
+	result, err := r.client.Get(r.ctx,
 		fmt.Sprintf("user:uid:%s", userID)).Result()
 	if len(result) == 0 {
 		return userUID, errors.New(fmt.Sprintf("userID[%s] not found", userID))
@@ -140,42 +171,70 @@ func (r Redis) UserUIDBind(userID string, userUID sc.UserUID) (err error) {
 		return errors.New(fmt.Sprintf("userUID[%s] not found", userUID))
 	}
 
-	if _, err = r.client.Set(ctx, fmt.Sprintf("user:uid:%s", userID), string(userUID), 0).Result(); err != nil {
+	// key -> uid:bindings:[UserUID] => set(userID)
+	before, _ := r.client.Get(r.ctx, fmt.Sprintf("user:uid:%s", userID)).Result()
+	_, err = r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(r.ctx, fmt.Sprintf("user:uid:%s", userID), string(userUID), 0)
+		if before != "" && before != string(userUID) {
+			pipe.SRem(r.ctx, fmt.Sprintf("uid:bindings:%s", before), userID)
+		}
+		pipe.SAdd(r.ctx, fmt.Sprintf("uid:bindings:%s", userUID), userID)
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	return err
+	return r.audit(AuditEntityBinding, userID, "bind", before, string(userUID))
 }
 
 func (r Redis) UserStore(user *sc.User) (err error) {
 	// key -> user:info:[userUID] => User
-	if userPack, err := msgpack.Marshal(user); err == nil {
-		_, err = r.client.Set(ctx, fmt.Sprintf("user:info:%s", user.UID), userPack, 0).Result()
+	before, err := r.User(user.UID)
+	if err != nil {
+		return err
 	}
-	return err
+	userPack, err := msgpack.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if _, err = r.client.Set(r.ctx, fmt.Sprintf("user:info:%s", user.UID), userPack, 0).Result(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityUser, string(user.UID), "store", before, user)
 }
 
 func (r Redis) UserSmartsStore(userUID sc.UserUID, smartIDs ...string) error {
 	//key -> user:smart:[UserUID] > [...SmartID]
-	_, err := r.client.SAdd(ctx, fmt.Sprintf("user:smart:%s", userUID), smartIDs).Result()
-	return err
+	before, err := r.UserSmartUIDs(userUID)
+	if err != nil {
+		return err
+	}
+	if _, err = r.client.SAdd(r.ctx, fmt.Sprintf("user:smart:%s", userUID), smartIDs).Result(); err != nil {
+		return err
+	}
+	after, err := r.UserSmartUIDs(userUID)
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntitySmarts, string(userUID), "grant", sortedSet(before), sortedSet(after))
 }
 
 func (r Redis) UserSmartUIDs(userUID sc.UserUID) ([]string, error) {
 	//key -> user:smart:[UserUID] > [...SmartID]
-	return r.client.SMembers(ctx, fmt.Sprintf("user:smart:%s", userUID)).Result()
+	return r.client.SMembers(r.ctx, fmt.Sprintf("user:smart:%s", userUID)).Result()
 }
 
 func (r Redis) UserAnswer(userUID sc.UserUID) ([]string, error) {
-	return r.client.SMembers(ctx, fmt.Sprintf("user:question:%s", userUID)).Result()
+	return r.client.SMembers(r.ctx, fmt.Sprintf("user:question:%s", userUID)).Result()
 }
 
 func (r Redis) UserAnswerStore(userUID sc.UserUID, smartIDs ...string) (err error) {
 	//key -> user:question:[UserUID] > [...SmartID]
 
-	// 检查用户是否拥有 smart 权限
+	// 检查用户是否拥有 smart 权限，包括部门与标签策略授予的 smart
 	for i := range smartIDs {
-		exist, err := r.client.SIsMember(ctx, fmt.Sprintf("user:smart:%s", userUID), smartIDs[i]).Result()
+		exist, err := SmartAllowed(r, userUID, smartIDs[i])
 		if err != nil {
 			return err
 		}
@@ -185,9 +244,18 @@ func (r Redis) UserAnswerStore(userUID sc.UserUID, smartIDs ...string) (err erro
 		}
 	}
 
-	_, err = r.client.SAdd(ctx, fmt.Sprintf("user:question:%s", userUID), smartIDs).Result()
-
-	return err
+	before, err := r.UserAnswer(userUID)
+	if err != nil {
+		return err
+	}
+	if _, err = r.client.SAdd(r.ctx, fmt.Sprintf("user:question:%s", userUID), smartIDs).Result(); err != nil {
+		return err
+	}
+	after, err := r.UserAnswer(userUID)
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntityAnswer, string(userUID), "store", sortedSet(before), sortedSet(after))
 }
 
 func (r Redis) UserBalance(id sc.UserUID) (float32, error) {
@@ -197,15 +265,23 @@ func (r Redis) UserBalance(id sc.UserUID) (float32, error) {
 
 func (r Redis) ConfigureStore(id string, configure sc.Configure) (err error) {
 	//key -> configure:[configureID]
-	if configurePack, err := msgpack.Marshal(configure); err == nil {
-		_, err = r.client.Set(ctx, fmt.Sprintf("configure:%s", id), configurePack, 0).Result()
+	before, err := r.Configure(id)
+	if err != nil && err != redis.Nil {
+		return err
 	}
-	return err
+	configurePack, err := msgpack.Marshal(configure)
+	if err != nil {
+		return err
+	}
+	if _, err = r.client.Set(r.ctx, fmt.Sprintf("configure:%s", id), configurePack, 0).Result(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityConfigure, id, "store", before, configure)
 }
 
 func (r Redis) Configure(id string) (configure sc.Configure, err error) {
 	//key -> configure:[configureID]
-	if result, err := r.client.Get(ctx, fmt.Sprintf("configure:%s", id)).Result(); err == nil {
+	if result, err := r.client.Get(r.ctx, fmt.Sprintf("configure:%s", id)).Result(); err == nil {
 		if len(result) > 0 {
 			if err = msgpack.Unmarshal([]byte(result), &configure); err == nil {
 				return configure, nil
@@ -0,0 +1,59 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"time"
+)
+
+// CardTTL 模板卡片按钮的有效期，过期后点击不再响应
+const CardTTL = 24 * time.Hour
+
+// Card 模板卡片对应的原始提问与答复，按钮点击时据此重新提问
+type Card struct {
+	TaskID    string
+	SessionID sc.SessionID
+	// UserID 企微用户ID
+	UserID string
+	// ChatID 群聊ID，单聊时为空
+	ChatID   string
+	SmartID  string
+	Question string
+	Answer   string
+}
+
+// CardCache 模板卡片存储
+type CardCache interface {
+	// Card 模板卡片，不存在或已过期时返回 nil
+	Card(taskID string) (*Card, error)
+
+	// CardStore 保存模板卡片，ttl 后过期
+	CardStore(card *Card, ttl time.Duration) error
+}
+
+func (r Redis) Card(taskID string) (card *Card, err error) {
+	// key -> card:[taskID] => Card
+	result, err := r.client.Get(r.ctx, fmt.Sprintf("card:%s", taskID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	card = &Card{}
+	if err = msgpack.Unmarshal([]byte(result), card); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+func (r Redis) CardStore(card *Card, ttl time.Duration) error {
+	// key -> card:[taskID] => Card
+	cardPack, err := msgpack.Marshal(card)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.ctx, fmt.Sprintf("card:%s", card.TaskID), cardPack, ttl).Err()
+}
@@ -4,42 +4,86 @@ import (
 	"context"
 	sc "github.com/openai-smart/smart-chat"
 	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/pkg/errors"
 	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"strings"
 )
 
 type ChatGPT struct {
 	smart.Smart
 
 	client *openai.Client
+	// platform 平台名称，兼容 OpenAI 接口的服务使用各自的名称
+	platform string
+	model    string
+	// systemPrompt smart 的系统提示，与用户的自定义说明合并后作为 system 消息
+	systemPrompt string
+
+	// 调用工具时直接请求接口
+	httpClient *http.Client
+	baseURL    string
+	authToken  string
+	// tools 允许调用的工具，为空时不调用工具
+	tools *sw.ToolSet
 }
 
 func NewChatGPT(authToken string) smart.Smart {
+	return NewOpenAICompatible("ChatGPT", openai.DefaultConfig("").BaseURL, authToken, openai.GPT3Dot5Turbo)
+}
+
+// NewOpenAICompatible 兼容 OpenAI chat completions 接口的服务，如通义千问、llama.cpp server、vLLM
+// baseURL 为接口前缀，如 http://localhost:8080/v1，不需要鉴权的服务 authToken 可以为空
+func NewOpenAICompatible(platform string, baseURL string, authToken string, model string) *ChatGPT {
+	config := openai.DefaultConfig(authToken)
+	config.BaseURL = strings.TrimSuffix(baseURL, "/")
 	return &ChatGPT{
-		client: openai.NewClient(authToken),
+		client:     openai.NewClientWithConfig(config),
+		platform:   platform,
+		model:      model,
+		httpClient: config.HTTPClient,
+		baseURL:    config.BaseURL,
+		authToken:  authToken,
 	}
 }
 
+// SetSystemPrompt 设置 smart 的系统提示
+func (chatgpt *ChatGPT) SetSystemPrompt(prompt string) {
+	chatgpt.systemPrompt = strings.TrimSpace(prompt)
+}
+
 func (chatgpt *ChatGPT) Platform() string {
-	return "ChatGPT"
+	return chatgpt.platform
 }
 
 func (chatgpt *ChatGPT) Ask(q sc.Question) (sc.Answer, error) {
+	return chatgpt.AskContext(context.Background(), q)
+}
+
+// AskContext 提问，ctx 超时或取消时中止请求，设置了工具时由 smart 决定是否调用工具
+func (chatgpt *ChatGPT) AskContext(ctx context.Context, q sc.Question) (sc.Answer, error) {
+	if chatgpt.tools != nil {
+		return chatgpt.askWithTools(ctx, sw.ChatMessages(chatgpt.systemPrompt, q))
+	}
 	resp, err := chatgpt.client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
-			Model: openai.GPT3Dot5Turbo,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: q.(string),
-				},
-			},
+			Model:    chatgpt.model,
+			Messages: chatgpt.messages(q),
 		},
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("empty choices")
+	}
+
+	monitor.SmartTokens.WithLabelValues(chatgpt.Platform(), resp.Model, "prompt").Add(float64(resp.Usage.PromptTokens))
+	monitor.SmartTokens.WithLabelValues(chatgpt.Platform(), resp.Model, "completion").Add(float64(resp.Usage.CompletionTokens))
 
 	answer := resp.Choices[0].Message.Content
 
@@ -49,3 +93,16 @@ func (chatgpt *ChatGPT) Ask(q sc.Question) (sc.Answer, error) {
 func (chatgpt *ChatGPT) Balance() (float32, error) {
 	return 0, nil
 }
+
+// messages 将提问转换为 OpenAI 对话消息
+func (chatgpt *ChatGPT) messages(q sc.Question) []openai.ChatCompletionMessage {
+	messages := sw.ChatMessages(chatgpt.systemPrompt, q)
+	msgs := make([]openai.ChatCompletionMessage, 0, len(messages))
+	for i := range messages {
+		msgs = append(msgs, openai.ChatCompletionMessage{
+			Role:    string(messages[i].Role),
+			Content: messages[i].Content,
+		})
+	}
+	return msgs
+}
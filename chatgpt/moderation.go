@@ -0,0 +1,48 @@
+package cahtgpt
+
+import (
+	"context"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/sashabaranov/go-openai"
+	"sort"
+)
+
+// Moderator 使用 OpenAI moderation 接口审核内容
+type Moderator struct {
+	client *openai.Client
+}
+
+func NewModerator(authToken string) *Moderator {
+	return &Moderator{client: openai.NewClient(authToken)}
+}
+
+func (moderator *Moderator) Moderate(ctx context.Context, text string) (*sw.ModerationResult, error) {
+	resp, err := moderator.client.Moderations(ctx, openai.ModerationRequest{Input: text})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &sw.ModerationResult{Source: "openai"}
+	for i := range resp.Results {
+		if !resp.Results[i].Flagged {
+			continue
+		}
+		result.Flagged = true
+		categories := resp.Results[i].Categories
+		for name, flagged := range map[string]bool{
+			"hate":             categories.Hate,
+			"hate/threatening": categories.HateThreatening,
+			"self-harm":        categories.SelfHarm,
+			"sexual":           categories.Sexual,
+			"sexual/minors":    categories.SexualMinors,
+			"violence":         categories.Violence,
+			"violence/graphic": categories.ViolenceGraphic,
+		} {
+			if flagged {
+				result.Categories = append(result.Categories, name)
+			}
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package cahtgpt
+
+import (
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"github.com/sashabaranov/go-openai"
+)
+
+// 配置ID的类型
+const (
+	ProviderChatGPT          = "chatgpt"
+	ProviderOpenAICompatible = "openai-compatible"
+	ProviderQwen             = "qwen"
+	ProviderErnie            = "ernie"
+)
+
+// QwenBaseURL 通义千问兼容 OpenAI 的接口地址
+const QwenBaseURL = "https://dashscope.aliyuncs.com/compatible-mode/v1"
+
+// ErnieBaseURL 文心一言（千帆 ModelBuilder v2）兼容 OpenAI 的接口地址，token 为千帆的 API Key
+const ErnieBaseURL = "https://qianfan.baidubce.com/v2"
+
+// 配置项：token、baseURL、model、systemPrompt，openai-compatible 需要 baseURL 与 model
+func init() {
+	sw.RegisterProvider(ProviderChatGPT, func(configure sc.Configure) (smart.Smart, error) {
+		token := sw.ConfigureString(configure, "token", "")
+		if token == "" {
+			return nil, errors.New("chatgpt token required")
+		}
+		chatGPT := NewOpenAICompatible("ChatGPT",
+			sw.ConfigureString(configure, "baseURL", openai.DefaultConfig("").BaseURL),
+			token, sw.ConfigureString(configure, "model", openai.GPT3Dot5Turbo))
+		chatGPT.SetSystemPrompt(sw.ConfigureString(configure, "systemPrompt", ""))
+		return chatGPT, nil
+	})
+
+	sw.RegisterProvider(ProviderQwen, func(configure sc.Configure) (smart.Smart, error) {
+		token := sw.ConfigureString(configure, "token", "")
+		if token == "" {
+			return nil, errors.New("qwen token required")
+		}
+		qwen := NewOpenAICompatible("Qwen", sw.ConfigureString(configure, "baseURL", QwenBaseURL),
+			token, sw.ConfigureString(configure, "model", "qwen-turbo"))
+		qwen.SetSystemPrompt(sw.ConfigureString(configure, "systemPrompt", ""))
+		return qwen, nil
+	})
+
+	sw.RegisterProvider(ProviderErnie, func(configure sc.Configure) (smart.Smart, error) {
+		token := sw.ConfigureString(configure, "token", "")
+		if token == "" {
+			return nil, errors.New("ernie token required")
+		}
+		ernie := NewOpenAICompatible("ERNIE", sw.ConfigureString(configure, "baseURL", ErnieBaseURL),
+			token, sw.ConfigureString(configure, "model", "ernie-4.0-turbo-8k"))
+		ernie.SetSystemPrompt(sw.ConfigureString(configure, "systemPrompt", ""))
+		return ernie, nil
+	})
+
+	sw.RegisterProvider(ProviderOpenAICompatible, func(configure sc.Configure) (smart.Smart, error) {
+		baseURL, model := sw.ConfigureString(configure, "baseURL", ""), sw.ConfigureString(configure, "model", "")
+		if baseURL == "" || model == "" {
+			return nil, errors.New("openai-compatible baseURL and model required")
+		}
+		compatible := NewOpenAICompatible(sw.ConfigureString(configure, "platform", "OpenAICompatible"),
+			baseURL, sw.ConfigureString(configure, "token", ""), model)
+		compatible.SetSystemPrompt(sw.ConfigureString(configure, "systemPrompt", ""))
+		return compatible, nil
+	})
+}
@@ -0,0 +1,102 @@
+package cahtgpt
+
+import (
+	"context"
+	"encoding/json"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// compatibleServer 模拟兼容 OpenAI 的 /chat/completions 接口，记录收到的请求
+func compatibleServer(t *testing.T, body string, auth *string, req *map[string]any) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		*auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("decode request %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestOpenAICompatible(t *testing.T) {
+	var auth string
+	var req map[string]any
+	server := compatibleServer(t, `{"model":"qwen-turbo","choices":[{"index":0,"message":{"role":"assistant","content":"你好"}}],`+
+		`"usage":{"prompt_tokens":3,"completion_tokens":2}}`, &auth, &req)
+	defer server.Close()
+
+	qwen := NewOpenAICompatible("Qwen", server.URL+"/v1/", "sk-test", "qwen-turbo")
+	qwen.SetSystemPrompt("你是助手")
+	answer, err := qwen.AskContext(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "你好" {
+		t.Errorf("answer = %v, want 你好", answer)
+	}
+	if auth != "Bearer sk-test" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if req["model"] != "qwen-turbo" {
+		t.Errorf("model = %v", req["model"])
+	}
+	messages, _ := req["messages"].([]any)
+	if len(messages) != 2 {
+		t.Fatalf("messages = %v", req["messages"])
+	}
+	system, _ := messages[0].(map[string]any)
+	user, _ := messages[1].(map[string]any)
+	if system["role"] != "system" || system["content"] != "你是助手" || user["role"] != "user" || user["content"] != "hello" {
+		t.Errorf("messages = %v", messages)
+	}
+}
+
+func TestOpenAICompatibleEmptyChoices(t *testing.T) {
+	var auth string
+	var req map[string]any
+	server := compatibleServer(t, `{"model":"llama","choices":[]}`, &auth, &req)
+	defer server.Close()
+
+	_, err := NewOpenAICompatible("OpenAICompatible", server.URL+"/v1", "", "llama").
+		AskContext(context.Background(), "hello")
+	if err == nil || !strings.Contains(err.Error(), "empty choices") {
+		t.Errorf("err = %v, want empty choices", err)
+	}
+	if strings.TrimSpace(strings.TrimPrefix(auth, "Bearer")) != "" {
+		t.Errorf("Authorization = %q, want empty token", auth)
+	}
+}
+
+func TestErnieProvider(t *testing.T) {
+	var auth string
+	var req map[string]any
+	server := compatibleServer(t, `{"model":"ernie-4.0-turbo-8k","choices":[{"index":0,"message":{"role":"assistant","content":"你好"}}]}`,
+		&auth, &req)
+	defer server.Close()
+
+	if _, err := sw.NewSmart("ernie:test", sc.Configure{}); err == nil {
+		t.Error("missing token expected error")
+	}
+	ernie, err := sw.NewSmart("ernie:test", sc.Configure{"token": "bce-v3/test", "baseURL": server.URL + "/v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ernie.Platform() != "ERNIE" {
+		t.Errorf("platform = %s", ernie.Platform())
+	}
+	answer, err := ernie.(*ChatGPT).AskContext(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "你好" || auth != "Bearer bce-v3/test" || req["model"] != "ernie-4.0-turbo-8k" {
+		t.Errorf("answer = %v, Authorization = %q, model = %v", answer, auth, req["model"])
+	}
+}
@@ -0,0 +1,156 @@
+package cahtgpt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+// maxToolRounds 一次提问最多调用工具的轮数，最后一轮不再提供工具，要求直接答复，仍要求调用工具时返回错误
+const maxToolRounds = 5
+
+// go-openai v1.5.7 不支持 function calling，调用工具时直接请求 chat completions 接口
+
+type toolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type toolDefinition struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type toolMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type toolRequest struct {
+	Model    string           `json:"model"`
+	Messages []toolMessage    `json:"messages"`
+	Tools    []toolDefinition `json:"tools,omitempty"`
+}
+
+type toolResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      toolMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// SetTools 设置允许调用的工具，为 nil 时不调用工具
+func (chatgpt *ChatGPT) SetTools(tools *sw.ToolSet) {
+	chatgpt.tools = tools
+}
+
+// askWithTools 提问并执行 smart 要求的工具调用，将结果返回给 smart，直到 smart 给出答复
+func (chatgpt *ChatGPT) askWithTools(ctx context.Context, messages []sw.Message) (string, error) {
+	tools := chatgpt.tools.Tools(ctx)
+	definitions := make([]toolDefinition, 0, len(tools))
+	for i := range tools {
+		definitions = append(definitions, toolDefinition{Type: "function", Function: toolFunction{
+			Name:        tools[i].Name,
+			Description: tools[i].Description,
+			Parameters:  tools[i].Parameters,
+		}})
+	}
+
+	msgs := make([]toolMessage, 0, len(messages))
+	for i := range messages {
+		msgs = append(msgs, toolMessage{Role: string(messages[i].Role), Content: messages[i].Content})
+	}
+
+	for round := 1; ; round++ {
+		req := toolRequest{Model: chatgpt.model, Messages: msgs}
+		if round < maxToolRounds {
+			req.Tools = definitions
+		}
+		message, err := chatgpt.completion(ctx, &req)
+		if err != nil {
+			return "", err
+		}
+		if len(message.ToolCalls) == 0 {
+			return message.Content, nil
+		}
+		if round >= maxToolRounds {
+			return "", errors.New(fmt.Sprintf("tool calls exceed %d rounds", maxToolRounds))
+		}
+
+		msgs = append(msgs, *message)
+		for i := range message.ToolCalls {
+			call := message.ToolCalls[i]
+			msgs = append(msgs, toolMessage{
+				Role:       "tool",
+				Content:    chatgpt.tools.Call(ctx, call.Function.Name, call.Function.Arguments),
+				ToolCallID: call.ID,
+			})
+		}
+	}
+}
+
+// completion 请求一次 chat completions 接口
+func (chatgpt *ChatGPT) completion(ctx context.Context, req *toolRequest) (*toolMessage, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, chatgpt.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if chatgpt.authToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+chatgpt.authToken)
+	}
+	httpResp, err := chatgpt.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp toolResponse
+	if err = json.Unmarshal(respBody, &resp); err != nil {
+		return nil, errors.New(fmt.Sprintf("status %d, %s", httpResp.StatusCode, err.Error()))
+	}
+	if resp.Error != nil {
+		return nil, errors.New(fmt.Sprintf("status %d, %s", httpResp.StatusCode, resp.Error.Message))
+	}
+	if httpResp.StatusCode != http.StatusOK || len(resp.Choices) == 0 {
+		return nil, errors.New(fmt.Sprintf("status %d, empty choices", httpResp.StatusCode))
+	}
+
+	monitor.SmartTokens.WithLabelValues(chatgpt.Platform(), resp.Model, "prompt").Add(float64(resp.Usage.PromptTokens))
+	monitor.SmartTokens.WithLabelValues(chatgpt.Platform(), resp.Model, "completion").Add(float64(resp.Usage.CompletionTokens))
+	return &resp.Choices[0].Message, nil
+}
@@ -0,0 +1,83 @@
+package cahtgpt
+
+import (
+	"context"
+	"encoding/json"
+	sw "github.com/openai-smart/smart-wecom"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// toolServer 前 calls 次要求调用 echo 工具，之后答复 answer
+func toolServer(t *testing.T, calls int, answer string, requests *[]toolRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req toolRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request %s", err.Error())
+		}
+		*requests = append(*requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		if len(*requests) <= calls {
+			_, _ = w.Write([]byte(`{"model":"gpt","choices":[{"message":{"role":"assistant","content":"",` +
+				`"tool_calls":[{"id":"call","type":"function","function":{"name":"echo","arguments":"{}"}}]}}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"model":"gpt","choices":[{"message":{"role":"assistant","content":"` + answer + `"}}]}`))
+	}))
+}
+
+func echoTools(t *testing.T) *sw.ToolSet {
+	registry := sw.NewToolRegistry(nil)
+	if err := registry.Register(&sw.Tool{Name: "echo", Description: "echo",
+		Handler: func(context.Context, json.RawMessage) (string, error) { return "pong", nil }}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Allow("gpt", "echo"); err != nil {
+		t.Fatal(err)
+	}
+	return registry.ToolSet("gpt")
+}
+
+func TestAskWithTools(t *testing.T) {
+	var requests []toolRequest
+	server := toolServer(t, 2, "done", &requests)
+	defer server.Close()
+
+	chatGPT := NewOpenAICompatible("ChatGPT", server.URL, "sk-test", "gpt")
+	chatGPT.SetTools(echoTools(t))
+	answer, err := chatGPT.AskContext(context.Background(), "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "done" {
+		t.Errorf("answer = %v, want done", answer)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("requests = %d, want 3", len(requests))
+	}
+	last := requests[2].Messages[len(requests[2].Messages)-1]
+	if last.Role != "tool" || last.Content != "pong" || last.ToolCallID != "call" {
+		t.Errorf("tool message = %+v", last)
+	}
+}
+
+func TestAskWithToolsMaxRounds(t *testing.T) {
+	var requests []toolRequest
+	server := toolServer(t, maxToolRounds+1, "done", &requests)
+	defer server.Close()
+
+	chatGPT := NewOpenAICompatible("ChatGPT", server.URL, "sk-test", "gpt")
+	chatGPT.SetTools(echoTools(t))
+	_, err := chatGPT.AskContext(context.Background(), "ping")
+	if err == nil || !strings.Contains(err.Error(), "rounds") {
+		t.Errorf("err = %v, want rounds exceeded", err)
+	}
+	if len(requests) != maxToolRounds {
+		t.Fatalf("requests = %d, want %d", len(requests), maxToolRounds)
+	}
+	if len(requests[maxToolRounds-1].Tools) != 0 {
+		t.Error("last round should not offer tools")
+	}
+}
@@ -1,83 +1,303 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	sc "github.com/openai-smart/smart-chat"
 	"github.com/openai-smart/smart-chat/chat"
 	"github.com/openai-smart/smart-chat/smart"
 	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/anthropic"
 	cahtgpt "github.com/openai-smart/smart-wecom/chatgpt"
+	"github.com/openai-smart/smart-wecom/console"
+	"github.com/openai-smart/smart-wecom/ollama"
 	"github.com/openai-smart/smart-wecom/tencent"
 	"github.com/openai-smart/smart-wecom/tencent/filter"
+	"github.com/openai-smart/smart-wecom/tracing"
 	"github.com/openai-smart/smart-wecom/utils"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/xen0n/go-workwx"
+	"net/http"
+	"os"
+	"time"
 )
 
 type Cli struct {
 	cache    sc.Cache
 	wecomApp *tencent.WecomApp
 	chat     chat.Chat
+	smarts   map[string]smart.Smart
+	filters  []chat.Filter
+	redactor *sw.Redactor
+
+	moderation *filter.ModerationFilter
+
+	// aggregation 开启汇总模式时不为空
+	aggregation *aggregation
+	// router 开启意图路由时不为空
+	router *sw.Router
+	// tools smart 可以调用的工具
+	tools *sw.ToolRegistry
+	// scheduler 开启定时任务时不为空
+	scheduler *tencent.Scheduler
+	// broadcaster 开启主动发送时不为空
+	broadcaster *tencent.Broadcaster
+}
+
+// aggregation 汇总模式的配置
+type aggregation struct {
+	timeout time.Duration
+	judge   string
 }
 
 func (c *Cli) SetRedis(addr string, passwd string) {
 	c.cache = sw.NewRedis(addr, passwd, 0)
 }
 
-func (c *Cli) addUser(user *sc.User) error {
-
-	u, err := c.cache.User(user.UID)
+// EnableTracing 初始化链路追踪，exporter 取值 otlp、console、none
+// 返回的函数需要在退出前调用以导出剩余的 span
+func (c *Cli) EnableTracing(exporter string) func() {
+	shutdown, err := tracing.Setup(exporter)
 	if err != nil {
-		return err
+		log.Fatal().Msg(fmt.Sprintf("[x] enable tracing failed, %s", err.Error()))
+	}
+	return func() {
+		if err := shutdown(context.Background()); err != nil {
+			log.Error().Msg(fmt.Sprintf("[x] shutdown tracing failed, %s", err.Error()))
+		}
 	}
+}
 
-	if u != nil {
-		return errors.New(fmt.Sprintf("user[%s] exists", user.UID))
+// EnableMonitor 开启健康检查与 Prometheus 指标接口，需在 NewChat 之后调用
+func (c *Cli) EnableMonitor() {
+	if wecomChat, ok := c.chat.(*tencent.WecomAppChat); ok {
+		wecomChat.EnableMonitor()
 	}
+}
 
-	return c.cache.UserStore(user)
+// EnableConsole 在独立的地址上开启管理接口与管理页面，token 为接口的访问令牌
+func (c *Cli) EnableConsole(addr string, token string) {
+	if token == "" {
+		log.Fatal().Msg("[x] console token required")
+		return
+	}
+	server := console.NewServer(c.cache, token)
+	if c.broadcaster != nil {
+		server.SetBroadcaster(c.broadcaster)
+	}
+	go func() {
+		if err := server.ListenAndServe(addr); err != nil {
+			log.Error().Msg(fmt.Sprintf("[x] console stopped, %s", err.Error()))
+		}
+	}()
+	log.Info().Msg(fmt.Sprintf("[*] console listening on %s", addr))
 }
 
-// ConfigureWecomUsers 从部门导入企微用户，此APP而可见部门所有成员
-// smarts 为用户配置聊天的smart
+// ConfigureWecomUsers 从应用可见的所有部门导入企微用户，已导入的用户会按通讯录更新，不会停用用户
+// smarts 为新导入的用户配置聊天的smart
 func (c *Cli) ConfigureWecomUsers(smarts ...string) {
-	users, err := c.wecomApp.ExportDepts()
+	if err := c.syncWecomUsers(tencent.NewOrgSync(c.wecomApp, c.cache, smarts...), false); err != nil {
+		log.Error().Msg(fmt.Sprintf("[x] import users failed, %s", err.Error()))
+	}
+}
+
+// SyncWecomUsers 同步企微通讯录：新增用户、更新名称部门与职务、停用已离开的用户
+// 通讯录为空或停用人数超过已绑定用户的 20% 时拒绝执行
+// dryRun 为 true 时只打印变更不执行，smarts 为新增用户使用的 smart
+func (c *Cli) SyncWecomUsers(dryRun bool, smarts ...string) error {
+	orgSync := tencent.NewOrgSync(c.wecomApp, c.cache, smarts...)
+	orgSync.EnableDeactivate(tencent.DefaultMaxDeactivateRatio)
+	return c.syncWecomUsers(orgSync, dryRun)
+}
+
+func (c *Cli) syncWecomUsers(orgSync *tencent.OrgSync, dryRun bool) error {
+	changes, err := orgSync.Plan()
 	if err != nil {
-		log.Fatal().Msg(err.Error())
-		return
+		return err
 	}
 
-	for i := range users {
-		user := &sc.User{
-			UID:    sc.UserUID(utils.MD5(users[i].UserID)), // 全平台使用手机号MD5值作为唯一字段
-			Name:   users[i].Name,
-			Status: sc.UserStatusActive,
-		}
-		if err := c.addUser(user); err != nil {
-			log.Fatal().Msg(fmt.Sprintf("[x] import user[%s] failed, %s", users[i].Name, err.Error()))
-			continue
+	if dryRun {
+		for i := range changes {
+			fmt.Println(changes[i].String())
 		}
+		return nil
+	}
+	for i := range changes {
+		log.Info().Msg(fmt.Sprintf("[*] sync user %s", changes[i].String()))
+	}
+	log.Info().Msg(fmt.Sprintf("[*] sync users, %d changes", len(changes)))
+	if err = orgSync.Apply(changes); err != nil {
+		return err
+	}
+	log.Info().Msg("[*] sync users success")
+	return nil
+}
 
-		if err := c.cache.UserUIDBind(fmt.Sprintf("%s:%s", c.chat.Platform(), users[i].UserID), user.UID); err != nil {
-			log.Fatal().Msg(fmt.Sprintf("[x] bind user[%s] uid failed, %s", users[i].Name, err.Error()))
-		}
-		log.Info().Msg(fmt.Sprintf("[*] import user[%s] success", users[i].Name))
+// wecomSyncLockTTL 定时同步通讯录时锁的有效期，同步完成后释放
+const wecomSyncLockTTL = 30 * time.Minute
 
-		// 保存用户拥有的smart
-		err := c.cache.UserSmartsStore(user.UID, smarts...)
-		if err != nil {
-			log.Fatal().Msg(fmt.Sprintf("[x] user[%s] smart[%s] store failed, %s", users[i].Name, smarts, err.Error()))
+// ScheduleWecomSync 每隔 interval 同步一次企微通讯录，需在 NewChat 之后调用
+// 多个实例同时运行时只有获取到锁的实例执行同步
+func (c *Cli) ScheduleWecomSync(interval time.Duration, smarts ...string) {
+	syncCache, ok := c.cache.(sw.ProfileSyncCache)
+	if !ok {
+		log.Fatal().Msg("[x] cache does not support profile sync lock")
+		return
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			locked, err := syncCache.ProfileSyncLock(owner, wecomSyncLockTTL)
+			if err != nil {
+				log.Error().Msg(fmt.Sprintf("[x] sync users lock failed, %s", err.Error()))
+				continue
+			}
+			if !locked {
+				log.Debug().Msg("[*] sync users skipped, locked by another instance")
+				continue
+			}
+			if err = c.SyncWecomUsers(false, smarts...); err != nil {
+				log.Error().Msg(fmt.Sprintf("[x] sync users failed, %s", err.Error()))
+			}
+			if err = syncCache.ProfileSyncUnlock(owner); err != nil {
+				log.Warn().Msg(fmt.Sprintf("[x] sync users unlock failed, %s", err.Error()))
+			}
 		}
+	}()
+}
 
-		// 设置提问时使用哪个smart
-		err = c.cache.UserAnswerStore(user.UID, smarts...)
-		if err != nil {
-			log.Fatal().Msg(fmt.Sprintf("[x] user[%s] answer store failed, %s", users[i].Name, err.Error()))
-		}
-		log.Info().Msg(fmt.Sprintf("[*] import user[%s] answer store success", users[i].Name))
+// AddDeptPolicy 按企微部门授权 smart，includeChildren 为 true 时包含子部门，授权的 smart 与用户自己的 smart 一起答复
+// 部门层级与成员所属部门由 SyncWecomUsers 同步
+func (c *Cli) AddDeptPolicy(deptID int64, includeChildren bool, smarts ...string) {
+	c.addPolicy(sw.NewDeptPolicy(deptID, includeChildren, smarts...))
+}
+
+// AddTagPolicy 按企微标签授权 smart，授权的 smart 与用户自己的 smart 一起答复，成员所属标签由 SyncWecomUsers 同步
+func (c *Cli) AddTagPolicy(tagID int64, smarts ...string) {
+	c.addPolicy(sw.NewTagPolicy(tagID, smarts...))
+}
+
+func (c *Cli) addPolicy(policy *sw.Policy) {
+	policyCache, ok := c.cache.(sw.PolicyCache)
+	if !ok {
+		log.Fatal().Msg("[x] cache does not support policy")
+		return
+	}
+	if err := policyCache.PolicyStore(policy); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] add policy[%s] failed, %s", policy.ID, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] add policy[%s] success", policy.ID))
+}
+
+// RemovePolicy 删除授权策略
+func (c *Cli) RemovePolicy(policyID string) {
+	policyCache, ok := c.cache.(sw.PolicyCache)
+	if !ok {
+		log.Fatal().Msg("[x] cache does not support policy")
+		return
+	}
+	if err := policyCache.PolicyDelete(policyID); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] remove policy[%s] failed, %s", policyID, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] remove policy[%s] success", policyID))
+}
+
+// SetUserRole 设置企微用户的管理角色，管理员与运营可以在单聊中使用 /grant /stats 等管理指令
+func (c *Cli) SetUserRole(userID string, role sw.Role) {
+	adminCache, ok := c.cache.(sw.AdminCache)
+	if !ok {
+		log.Fatal().Msg("[x] cache does not support role")
+		return
+	}
+	userUID, err := c.cache.UserID2UID(fmt.Sprintf("wecom:%s", userID))
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set user[%s] role failed, %s", userID, err.Error()))
+		return
+	}
+	if err = adminCache.UserRoleStore(userUID, role); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set user[%s] role failed, %s", userID, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] set user[%s] role [%s] success", userID, role))
+}
+
+// SetUserInstructions 设置企微用户的自定义说明，可以是 sw.PersonaPresets 中的名称，为空时清除
+// 用户也可以在单聊中使用 /persona 设置
+func (c *Cli) SetUserInstructions(userID string, instructions string) {
+	personaCache, ok := c.cache.(sw.PersonaCache)
+	if !ok {
+		log.Fatal().Msg("[x] cache does not support instructions")
+		return
+	}
+	userUID, err := c.cache.UserID2UID(fmt.Sprintf("wecom:%s", userID))
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set user[%s] instructions failed, %s", userID, err.Error()))
+		return
+	}
+	if instructions, err = sw.ResolveInstructions(instructions); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set user[%s] instructions failed, %s", userID, err.Error()))
+		return
+	}
+	if err = personaCache.UserInstructionsStore(userUID, instructions); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set user[%s] instructions failed, %s", userID, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] set user[%s] instructions success", userID))
+}
+
+// AddTemplate 保存 prompt 模板的新版本，用户可以使用 /t <模板> <内容> 提问
+// text 可以使用 {{.User.Name}} {{.Date}} {{.Time}} {{.SmartID}} {{.Input}}
+func (c *Cli) AddTemplate(name string, text string) {
+	tmpl, err := sw.StoreTemplate(c.cache, name, text)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] add template[%s] failed, %s", name, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] add template[%s] success", tmpl.Ref()))
+}
+
+// SetSmartTemplate 设置 smart 的默认模板，ref 为 name 时使用最新版本，为 name@version 时固定版本，为空时取消
+func (c *Cli) SetSmartTemplate(smartID string, ref string) {
+	c.setDefaultTemplate(sw.TemplateScopeSmart(smartID), ref)
+}
+
+// SetUserTemplate 设置企微用户的默认模板，优先于 smart 的默认模板
+func (c *Cli) SetUserTemplate(userID string, ref string) {
+	userUID, err := c.cache.UserID2UID(fmt.Sprintf("wecom:%s", userID))
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set user[%s] template failed, %s", userID, err.Error()))
+		return
 	}
+	c.setDefaultTemplate(sw.TemplateScopeUser(userUID), ref)
+}
 
+func (c *Cli) setDefaultTemplate(scope string, ref string) {
+	if err := sw.StoreDefaultTemplate(c.cache, scope, ref); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set %s template failed, %s", scope, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] set %s template [%s] success", scope, ref))
+}
+
+// ConfigureGroup 保存群聊配置，ChatID 为群机器人回调消息中的 ChatId，群内的提问通过群机器人接收（见 NewRobotChat）
+// 也可以在群内 @机器人 发送 /group 设置，应用群聊（appchat）只能推送消息，不支持在其中提问
+func (c *Cli) ConfigureGroup(group *sw.Group) {
+	groupCache, ok := c.cache.(sw.GroupCache)
+	if !ok {
+		log.Fatal().Msg("[x] cache does not support group")
+		return
+	}
+	if err := groupCache.GroupStore(group); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] configure group[%s] failed, %s", group.ChatID, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] configure group[%s] success", group.ChatID))
 }
 
 // addConfigure 新增配置信息
@@ -98,12 +318,84 @@ func (c *Cli) AddChatGPTConfigure(token string) string {
 	return configureID
 }
 
+// AddOpenAICompatibleConfigure 兼容 OpenAI 接口的服务，如 llama.cpp server 的 http://localhost:8080/v1
+// 不需要鉴权时 token 为空
+func (c *Cli) AddOpenAICompatibleConfigure(baseURL string, token string, model string) string {
+	configureID := fmt.Sprintf("%s:%s", cahtgpt.ProviderOpenAICompatible, utils.MD5(baseURL+model))
+	c.addConfigure(configureID, sc.Configure{
+		"baseURL": baseURL,
+		"token":   token,
+		"model":   model,
+	})
+	return configureID
+}
+
+// AddQwenConfigure 通义千问，model 为空时使用 qwen-turbo
+func (c *Cli) AddQwenConfigure(token string, model string) string {
+	configureID := fmt.Sprintf("%s:%s", cahtgpt.ProviderQwen, utils.MD5(token+model))
+	configure := sc.Configure{"token": token}
+	if model != "" {
+		configure["model"] = model
+	}
+	c.addConfigure(configureID, configure)
+	return configureID
+}
+
+// AddErnieConfigure 文心一言，token 为千帆的 API Key，model 为空时使用 ernie-4.0-turbo-8k
+func (c *Cli) AddErnieConfigure(token string, model string) string {
+	configureID := fmt.Sprintf("%s:%s", cahtgpt.ProviderErnie, utils.MD5(token+model))
+	configure := sc.Configure{"token": token}
+	if model != "" {
+		configure["model"] = model
+	}
+	c.addConfigure(configureID, configure)
+	return configureID
+}
+
+// AddAnthropicConfigure Anthropic Claude，model 为空时使用 anthropic.DefaultModel
+func (c *Cli) AddAnthropicConfigure(token string, model string) string {
+	configureID := fmt.Sprintf("%s:%s", anthropic.Provider, utils.MD5(token+model))
+	configure := sc.Configure{"token": token}
+	if model != "" {
+		configure["model"] = model
+	}
+	c.addConfigure(configureID, configure)
+	return configureID
+}
+
+// AddOllamaConfigure 本地 Ollama 服务，baseURL 为空时使用 http://localhost:11434
+func (c *Cli) AddOllamaConfigure(baseURL string, model string) string {
+	configureID := fmt.Sprintf("%s:%s", ollama.Provider, utils.MD5(baseURL+model))
+	configure := sc.Configure{"model": model}
+	if baseURL != "" {
+		configure["baseURL"] = baseURL
+	}
+	c.addConfigure(configureID, configure)
+	return configureID
+}
+
+// NewSmart 按配置ID的类型创建 smart，如 chatgpt:、qwen:、ernie:、anthropic:、ollama:、openai-compatible:
 func (c *Cli) NewSmart(configureID string) smart.Smart {
 	configure, err := c.cache.Configure(configureID)
 	if err != nil {
 		log.Fatal().Msg(fmt.Sprintf("[x] new smart[%s] failed, %s", configureID, err.Error()))
 	}
-	return cahtgpt.NewChatGPT(configure["token"].(string))
+	s, err := sw.NewSmart(configureID, configure)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] new smart[%s] failed, %s", configureID, err.Error()))
+	}
+	return s
+}
+
+// SetSystemPrompt 设置 smart 配置的系统提示，需在 NewChat 之前调用，用户的自定义说明会合并到其后
+func (c *Cli) SetSystemPrompt(configureID string, prompt string) {
+	configure, err := c.cache.Configure(configureID)
+	if err != nil || configure == nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] set configure[%s] system prompt failed, configure not found", configureID))
+		return
+	}
+	configure["systemPrompt"] = prompt
+	c.addConfigure(configureID, configure)
 }
 
 func (c *Cli) AddWecomConfigure(configure sc.Configure) string {
@@ -121,7 +413,9 @@ func (c *Cli) NewChat(configureID string, smarts ...string) chat.Chat {
 		log.Fatal().Msg(fmt.Sprintf("[x] new smart[%s] failed, %s", configureID, err.Error()))
 	}
 
-	var wecomClient = workwx.New(configure["corpID"].(string))
+	// 企微API请求超时，避免发送消息时阻塞
+	var wecomClient = workwx.New(configure["corpID"].(string),
+		workwx.WithHTTPClient(&http.Client{Timeout: 10 * time.Second}))
 
 	corpSecret := configure["corpSecret"].(string)
 	agentID := configure["agentID"].(int64)
@@ -134,22 +428,27 @@ func (c *Cli) NewChat(configureID string, smarts ...string) chat.Chat {
 		},
 	)
 
-	var chatGPTs = make(map[string]smart.Smart)
-
-	for i := range smarts {
-		chatGPTs[smarts[i]] = c.NewSmart(smarts[i])
-	}
-
+	c.newSmarts(smarts...)
 	c.chat = tencent.NewSmartWecomChat(
 		c.wecomApp,
-		chatGPTs, // 绑定已创建的AI
-		[]chat.Filter{ // 拦截器，自定义拦截规则
-			filter.NewDefaultFilter(c.cache),
-		},
+		c.smarts,  // 绑定已创建的AI
+		c.filters, // 拦截器，自定义拦截规则
 		c.cache,
 	)
 
+	if c.moderation != nil { // 发送前审核答复
+		c.chat.AddCompletionHandler(c.moderation.CompletionHandler)
+	}
 	c.chat.AddCompletionHandler(c.wecomApp.ChatGPTCompletionHandler)
+	// 通讯录新增成员时自动导入并使用 smarts
+	c.chat.(*tencent.WecomAppChat).SetDefaultSmarts(smarts...)
+	c.chat.(*tencent.WecomAppChat).SetRedactor(c.redactor)
+	if c.aggregation != nil {
+		c.chat.(*tencent.WecomAppChat).SetAggregation(c.aggregation.timeout, c.aggregation.judge)
+	}
+	if c.router != nil {
+		c.chat.(*tencent.WecomAppChat).SetRouter(c.router)
+	}
 	evens := configure["evens"].([]interface{})
 	for i := range evens {
 		// 创建一个监听事件接口，用于接收用户发送的消息
@@ -164,3 +463,290 @@ func (c *Cli) NewChat(configureID string, smarts ...string) chat.Chat {
 
 	return c.chat
 }
+
+// EnableRedaction 向 smart 提问前脱敏手机号、身份证号、邮箱、银行卡号与 keywords，需在 NewChat 之前调用
+// patterns 为自定义脱敏的正则表达式，答复中的占位符会还原为原始数据
+func (c *Cli) EnableRedaction(keywords []string, patterns ...string) {
+	redactor, err := sw.NewRedactor(keywords, patterns...)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] enable redaction failed, %s", err.Error()))
+		return
+	}
+	c.redactor = redactor
+	if c.moderation != nil {
+		c.moderation.SetRedactor(redactor)
+	}
+}
+
+// RegisterTool 注册 smart 可以调用的工具，只有 smartIDs 中支持工具调用的 smart 可以调用
+// 每次调用都会以提问用户为操作人记录到操作记录
+func (c *Cli) RegisterTool(tool *sw.Tool, smartIDs ...string) {
+	if c.tools == nil {
+		c.tools = sw.NewToolRegistry(c.cache)
+	}
+	if err := c.tools.Register(tool); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] register tool[%s] failed, %s", tool.Name, err.Error()))
+		return
+	}
+	for i := range smartIDs {
+		if err := c.tools.Allow(smartIDs[i], tool.Name); err != nil {
+			log.Fatal().Msg(fmt.Sprintf("[x] register tool[%s] failed, %s", tool.Name, err.Error()))
+			return
+		}
+		c.applyTools(smartIDs[i])
+	}
+	log.Info().Msg(fmt.Sprintf("[*] register tool[%s] for %v success", tool.Name, smartIDs))
+}
+
+// EnableDirectoryTool 允许 smartIDs 查询应用可见范围内的企微通讯录，需在 NewChat 之后调用
+// 通讯录每小时刷新一次，showMobile 为 false 时不返回手机号
+func (c *Cli) EnableDirectoryTool(showMobile bool, smartIDs ...string) {
+	if c.wecomApp == nil {
+		log.Fatal().Msg("[x] enable directory tool failed, NewChat required")
+		return
+	}
+	c.RegisterTool(tencent.NewDirectory(c.wecomApp, tencent.DefaultDirectoryTTL, showMobile).Tool(), smartIDs...)
+}
+
+// EnableScheduler 开启定时任务，需在 NewChat 之后调用，多个实例同时开启时只有一个实例执行到期任务
+// smartIDs 可以为用户创建、查看与取消提醒，用户创建的定时提问由 promptSmartID 答复
+func (c *Cli) EnableScheduler(promptSmartID string, smartIDs ...string) {
+	if c.wecomApp == nil {
+		log.Fatal().Msg("[x] enable scheduler failed, NewChat required")
+		return
+	}
+	if _, ok := c.cache.(sw.ScheduleCache); !ok {
+		log.Fatal().Msg("[x] enable scheduler failed, cache does not support schedule")
+		return
+	}
+	c.scheduler = tencent.NewScheduler(c.wecomApp, c.cache, c.smarts, promptSmartID)
+	c.scheduler.SetRedactor(c.redactor)
+	c.RegisterTool(c.scheduler.ReminderTool(), smartIDs...)
+	go c.scheduler.Run(context.Background())
+	log.Info().Msg("[*] scheduler started")
+}
+
+// AddScheduledPrompt 按 cron 定时以 prompt 向 smartID 提问，并将答复发送给 userIDs，需在 EnableScheduler 之后调用
+// 相同 id 的任务会被覆盖，重复执行不会重复创建
+func (c *Cli) AddScheduledPrompt(id string, cron string, smartID string, prompt string, userIDs ...string) {
+	if c.scheduler == nil {
+		log.Fatal().Msg("[x] add scheduled prompt failed, EnableScheduler required")
+		return
+	}
+	job := &sw.ScheduleJob{
+		ID:      id,
+		Kind:    sw.ScheduleKindPrompt,
+		Creator: sw.ActorSystem,
+		UserIDs: userIDs,
+		Content: prompt,
+		SmartID: smartID,
+		Cron:    cron,
+	}
+	if err := c.scheduler.Add(context.Background(), job); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] add scheduled prompt[%s] failed, %s", id, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[*] add scheduled prompt[%s] next at %s", id, job.Next.Format("2006-01-02 15:04")))
+}
+
+// EnableBroadcast 开启主动发送消息，需在 NewChat 之后、EnableConsole 之前调用
+// rate 为每分钟最多调用发送接口的次数，dailyLimit 为每天最多发送的人次，为 0 时不限制
+// 开启后管理员的 /broadcast 公告与管理接口的群发都按频率发送并记录发送结果
+func (c *Cli) EnableBroadcast(rate int, dailyLimit int) {
+	if c.wecomApp == nil {
+		log.Fatal().Msg("[x] enable broadcast failed, NewChat required")
+		return
+	}
+	if _, ok := c.cache.(sw.BroadcastCache); !ok {
+		log.Fatal().Msg("[x] enable broadcast failed, cache does not support broadcast")
+		return
+	}
+	c.broadcaster = tencent.NewBroadcaster(c.wecomApp, c.cache, c.smarts, rate, dailyLimit)
+	c.broadcaster.SetRedactor(c.redactor)
+	if wecomChat, ok := c.chat.(*tencent.WecomAppChat); ok {
+		wecomChat.SetBroadcaster(c.broadcaster.Announce)
+	}
+}
+
+// Broadcast 向 target 中的成员发送 content 并等待完成，需在 EnableBroadcast 之后调用
+// template 为 true 时 content 可使用 {{.User.Name}} 等模板变量，smartID 不为空时由 smart 根据 content 为每个接收人生成消息
+func (c *Cli) Broadcast(target sw.BroadcastTarget, content string, template bool, smartID string) (*sw.Broadcast, error) {
+	if c.broadcaster == nil {
+		return nil, errors.New("EnableBroadcast required")
+	}
+	broadcast := &sw.Broadcast{Target: target, Content: content, Template: template, SmartID: smartID}
+	err := c.broadcaster.Send(context.Background(), broadcast)
+	return broadcast, err
+}
+
+// applyTools 为已创建的 smart 设置允许调用的工具
+func (c *Cli) applyTools(smartID string) {
+	if c.tools == nil {
+		return
+	}
+	if s, ok := c.smarts[smartID].(sw.ToolSmart); ok {
+		s.SetTools(c.tools.ToolSet(smartID))
+	}
+}
+
+// EnableRouting 开启意图路由，需在 NewChat 之前调用
+// 未指定 smart 的提问按 intents 的关键字与正则分配 smart，未命中时由 classifierSmartID 分类，都未识别时使用 defaultSmartID
+// classifierSmartID 为空时只使用规则
+func (c *Cli) EnableRouting(defaultSmartID string, classifierSmartID string, intents ...sw.Intent) {
+	router, err := sw.NewRouter(defaultSmartID, intents...)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] enable routing failed, %s", err.Error()))
+		return
+	}
+	router.SetClassifier(classifierSmartID)
+	c.newSmarts(router.SmartIDs()...)
+	c.router = router
+}
+
+// EnableAggregation 开启汇总模式，需在 NewChat 之前调用
+// 用户使用多个 smart 时等待所有答复（最多 timeout）后合并为一条，judgeSmartID 不为空时由该 smart 评审各答复
+func (c *Cli) EnableAggregation(timeout time.Duration, judgeSmartID string) {
+	if judgeSmartID != "" {
+		c.newSmarts(judgeSmartID)
+	}
+	c.aggregation = &aggregation{timeout: timeout, judge: judgeSmartID}
+}
+
+// EnableModeration 审核提问与答复，需在 NewChat 之前调用，action 为空时不审核对应内容
+// keywords 与 patterns 为本地黑名单，chatGPTConfigureID 不为空时同时使用该配置的 OpenAI moderation 接口
+// 开启脱敏时 OpenAI moderation 接口只收到脱敏后的提问与答复
+func (c *Cli) EnableModeration(questionAction sw.ModerationAction, answerAction sw.ModerationAction,
+	chatGPTConfigureID string, keywords []string, patterns ...string) {
+	var moderators []sw.Moderator
+	if len(keywords) > 0 || len(patterns) > 0 {
+		moderator, err := sw.NewKeywordModerator(keywords, patterns...)
+		if err != nil {
+			log.Fatal().Msg(fmt.Sprintf("[x] enable moderation failed, %s", err.Error()))
+			return
+		}
+		moderators = append(moderators, moderator)
+	}
+	if chatGPTConfigureID != "" {
+		configure, err := c.cache.Configure(chatGPTConfigureID)
+		if err != nil || configure == nil {
+			log.Fatal().Msg(fmt.Sprintf("[x] enable moderation failed, configure[%s] not found", chatGPTConfigureID))
+			return
+		}
+		moderators = append(moderators, cahtgpt.NewModerator(configure["token"].(string)))
+	}
+
+	c.newSmarts() // 先创建默认拦截器，审核在权限检查之后执行
+	c.moderation = filter.NewModerationFilter(c.cache, questionAction, answerAction, moderators...)
+	c.moderation.SetRedactor(c.redactor)
+	c.filters = append(c.filters, c.moderation)
+}
+
+// EnableCardButtons 在应用答复下方发送“重新生成”、“继续”与切换 smart 的按钮卡片，需在 NewChat 之后调用
+// names 为切换按钮上显示的 smart 名称，key 为 smart 配置ID
+func (c *Cli) EnableCardButtons(names map[string]string) {
+	wecomChat, ok := c.chat.(*tencent.WecomAppChat)
+	if !ok {
+		return
+	}
+	for smartID, name := range names {
+		wecomChat.SetSmartName(smartID, name)
+	}
+	wecomChat.AddCompletionHandler(wecomChat.CardCompletionHandler)
+}
+
+// newSmarts 创建 smart 与拦截器，应用与群机器人共用
+func (c *Cli) newSmarts(smarts ...string) {
+	if c.smarts == nil {
+		c.smarts = make(map[string]smart.Smart)
+	}
+	for i := range smarts {
+		if _, ok := c.smarts[smarts[i]]; !ok {
+			c.smarts[smarts[i]] = c.NewSmart(smarts[i])
+			c.applyTools(smarts[i])
+		}
+	}
+	if c.filters == nil {
+		c.filters = []chat.Filter{
+			filter.NewDefaultFilter(c.cache),
+		}
+	}
+}
+
+// AddRobotConfigure 导入群机器人配置，key 为机器人 webhook 地址中的 key
+func (c *Cli) AddRobotConfigure(configure sc.Configure) string {
+	configureID := fmt.Sprintf("wecom-robot:%s", utils.MD5(configure["webhookKey"].(string)))
+	c.addConfigure(configureID, configure)
+	return configureID
+}
+
+// NewRobotChat 创建群机器人聊天，与 NewChat 创建的应用共用 smart、拦截器与 cache
+func (c *Cli) NewRobotChat(configureID string, smarts ...string) chat.Chat {
+	configure, err := c.cache.Configure(configureID)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] new robot[%s] failed, %s", configureID, err.Error()))
+	}
+
+	c.newSmarts(smarts...)
+	robot := tencent.NewWecomRobotChat(c.smarts, c.filters, c.cache).(*tencent.WecomRobotChat)
+	if c.moderation != nil {
+		robot.AddCompletionHandler(c.moderation.CompletionHandler)
+	}
+	robot.AddCompletionHandler(robot.RobotCompletionHandler)
+	robot.SetRedactor(c.redactor)
+	if c.aggregation != nil {
+		robot.SetAggregation(c.aggregation.timeout, c.aggregation.judge)
+	}
+	if c.router != nil {
+		robot.SetRouter(c.router)
+	}
+
+	if err := robot.AddEventHandler(&tencent.WecomRobotEventConfigure{
+		Uri:            configure["uri"].(string),
+		Token:          configure["token"].(string),
+		EncodingAESKey: configure["encodingAESKey"].(string),
+		WebhookKey:     configure["webhookKey"].(string),
+	}); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	return robot
+}
+
+// AddKfConfigure 导入微信客服接收事件配置
+func (c *Cli) AddKfConfigure(configure sc.Configure) string {
+	configureID := fmt.Sprintf("wecom-kf:%s", utils.MD5(configure["uri"].(string)+configure["token"].(string)))
+	c.addConfigure(configureID, configure)
+	return configureID
+}
+
+// NewKfChat 创建微信客服聊天，需在 NewChat 之后调用，使用已创建的企微应用调用客服接口
+// smarts 同时作为外部用户首次提问时自动注册使用的 smart
+func (c *Cli) NewKfChat(configureID string, smarts ...string) chat.Chat {
+	configure, err := c.cache.Configure(configureID)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("[x] new kf[%s] failed, %s", configureID, err.Error()))
+	}
+
+	c.newSmarts(smarts...)
+	kf := tencent.NewWecomKfChat(c.wecomApp, c.smarts, c.filters, c.cache).(*tencent.WecomKfChat)
+	kf.SetDefaultSmarts(smarts...)
+	if c.moderation != nil {
+		kf.AddCompletionHandler(c.moderation.CompletionHandler)
+	}
+	kf.AddCompletionHandler(kf.KfCompletionHandler)
+	kf.SetRedactor(c.redactor)
+	if c.aggregation != nil {
+		kf.SetAggregation(c.aggregation.timeout, c.aggregation.judge)
+	}
+	if c.router != nil {
+		kf.SetRouter(c.router)
+	}
+
+	if err := kf.AddEventHandler(&tencent.WecomKfEventConfigure{
+		Uri:            configure["uri"].(string),
+		Token:          configure["token"].(string),
+		EncodingAESKey: configure["encodingAESKey"].(string),
+	}); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	return kf
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 报表导出格式
+const (
+	ReportFormatCSV  = "csv"
+	ReportFormatJSON = "json"
+)
+
+// 报表统计维度
+const (
+	ReportBySmart    = "smart"
+	ReportByTemplate = "template"
+	ReportByDept     = "dept"
+)
+
+// FeedbackSummary 某一维度下的满意度统计
+type FeedbackSummary struct {
+	Dimension string `json:"dimension"`
+	Key       string `json:"key"`
+	Name      string `json:"name,omitempty"`
+	Total     int    `json:"total"`
+	Good      int    `json:"good"`
+	Bad       int    `json:"bad"`
+	// Satisfaction 满意度，Good / Total
+	Satisfaction float64 `json:"satisfaction"`
+}
+
+// summarizeFeedback 按 smart、prompt 模板与部门统计满意度
+func summarizeFeedback(feedbacks []sw.Feedback) []FeedbackSummary {
+	index := make(map[[2]string]*FeedbackSummary)
+	var summaries []*FeedbackSummary
+	add := func(dimension string, key string, rating sw.Rating) {
+		summary, ok := index[[2]string{dimension, key}]
+		if !ok {
+			summary = &FeedbackSummary{Dimension: dimension, Key: key}
+			index[[2]string{dimension, key}] = summary
+			summaries = append(summaries, summary)
+		}
+		summary.Total++
+		if rating == sw.RatingGood {
+			summary.Good++
+		} else if rating == sw.RatingBad {
+			summary.Bad++
+		}
+	}
+
+	for i := range feedbacks {
+		feedback := feedbacks[i]
+		add(ReportBySmart, feedback.SmartID, feedback.Rating)
+		add(ReportByTemplate, feedback.Template, feedback.Rating)
+		for j := range feedback.DeptIDs {
+			add(ReportByDept, strconv.FormatInt(feedback.DeptIDs[j], 10), feedback.Rating)
+		}
+	}
+
+	result := make([]FeedbackSummary, 0, len(summaries))
+	for i := range summaries {
+		summaries[i].Satisfaction = float64(summaries[i].Good) / float64(summaries[i].Total)
+		result = append(result, *summaries[i])
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Dimension != result[j].Dimension {
+			return result[i].Dimension < result[j].Dimension
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// FeedbackReport 导出 [start, end] 内的评价满意度报表，format 为 csv 或 json
+// 部门使用企微部门名称，NewChat 之前调用时只有部门ID
+func (c *Cli) FeedbackReport(start time.Time, end time.Time, format string, w io.Writer) error {
+	feedbackCache, ok := c.cache.(sw.FeedbackCache)
+	if !ok {
+		return errors.New("cache does not support feedback")
+	}
+	feedbacks, err := feedbackCache.Feedbacks(start, end)
+	if err != nil {
+		return err
+	}
+
+	summaries := summarizeFeedback(feedbacks)
+	deptNames := c.deptNames()
+	for i := range summaries {
+		if summaries[i].Dimension == ReportByDept {
+			summaries[i].Name = deptNames[summaries[i].Key]
+		}
+	}
+
+	switch format {
+	case ReportFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summaries)
+	case ReportFormatCSV:
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"dimension", "key", "name", "total", "good", "bad", "satisfaction"})
+		for i := range summaries {
+			_ = writer.Write([]string{
+				summaries[i].Dimension,
+				summaries[i].Key,
+				summaries[i].Name,
+				strconv.Itoa(summaries[i].Total),
+				strconv.Itoa(summaries[i].Good),
+				strconv.Itoa(summaries[i].Bad),
+				fmt.Sprintf("%.4f", summaries[i].Satisfaction),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return errors.New(fmt.Sprintf("report format [%s] unsupported", format))
+	}
+}
+
+// deptNames 企微部门ID与名称，未创建应用或查询失败时返回空
+func (c *Cli) deptNames() map[string]string {
+	names := make(map[string]string)
+	if c.wecomApp == nil {
+		return names
+	}
+	depts, err := c.wecomApp.Depts()
+	if err != nil {
+		return names
+	}
+	for i := range depts {
+		names[strconv.FormatInt(depts[i].ID, 10)] = depts[i].Name
+	}
+	return names
+}
+
+// AuditReport 导出 [start, end] 内的操作记录，entity 为空时导出所有类型，format 为 csv 或 json
+func (c *Cli) AuditReport(start time.Time, end time.Time, entity string, format string, w io.Writer) error {
+	auditCache, ok := c.cache.(sw.AuditCache)
+	if !ok {
+		return errors.New("cache does not support audit")
+	}
+	entries, err := auditCache.AuditEntries(sw.AuditQuery{Start: start, End: end, Entity: entity})
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ReportFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case ReportFormatCSV:
+		return sw.WriteAuditCSV(w, entries)
+	default:
+		return errors.New(fmt.Sprintf("report format [%s] unsupported", format))
+	}
+}
@@ -5,14 +5,19 @@ import (
 	sc "github.com/openai-smart/smart-chat"
 	"github.com/openai-smart/smart-wecom/cmd"
 	"github.com/rs/zerolog/log"
+	"os"
 )
 
 func main() {
 
 	cli := cmd.Cli{}
+	shutdown := cli.EnableTracing(os.Getenv("OTEL_TRACES_EXPORTER")) // otlp、console 或 none
+	defer shutdown()
 	cli.SetRedis("127.0.0.1:6379", "123456")
 
 	chatGPTConfigureID := cli.AddChatGPTConfigure("sk-sxxxxxxxxxxxxxxxxxxxxxxxxxxxxx") // 将chatGPT配置导入到数据库，导入后注释此段代码
+	// ollamaConfigureID := cli.AddOllamaConfigure("", "qwen2:7b") // 本地模型，不需要访问外网，提问时与其它 smart 相同
+	// compatibleConfigureID := cli.AddOpenAICompatibleConfigure("http://localhost:8080/v1", "", "llama") // llama.cpp server 等兼容 OpenAI 接口的服务
 
 	wecomConfigureID := cli.AddWecomConfigure(sc.Configure{ // 将企微配置导入到数据库，导入后注释此段代码
 		"corpID":     "xxxxxxxxxx",
@@ -28,8 +33,58 @@ func main() {
 	})
 
 	fmt.Println(wecomConfigureID, chatGPTConfigureID)
+	// cli.EnableRedaction([]string{"客户名称"}, `合同编号\d+`) // 提问前脱敏手机号、身份证号、邮箱、银行卡号与关键字
+	// cli.EnableModeration(sw.ModerationBlock, sw.ModerationReplace, chatGPTConfigureID, []string{"违禁词"}) // 审核提问与答复
+	// 按意图分配 smart，规则未命中时由 chatGPTConfigureID 分类，都未识别时使用 chatGPTConfigureID
+	// cli.EnableRouting(chatGPTConfigureID, chatGPTConfigureID,
+	// 	sw.Intent{Name: "code", Description: "编程与代码", SmartID: chatGPTConfigureID, Keywords: []string{"代码", "sql", "golang"}},
+	// 	sw.Intent{Name: "translation", Description: "翻译", SmartID: chatGPTConfigureID, Keywords: []string{"翻译"}},
+	// 	sw.Intent{Name: "hr", Description: "人事制度、假期与报销", SmartID: chatGPTConfigureID},
+	// 	sw.Intent{Name: "chat", Description: "闲聊", SmartID: chatGPTConfigureID})
+	// 允许 chatGPTConfigureID 调用内部 HTTP 接口查询订单，需在 NewChat 之前调用
+	// cli.RegisterTool(sw.NewHTTPTool("query_order", "按订单号查询订单状态", http.MethodGet, "http://erp.internal/api/orders",
+	// 	json.RawMessage(`{"type":"object","properties":{"id":{"type":"string","description":"订单号"}},"required":["id"]}`), nil), chatGPTConfigureID)
+	// cli.EnableAggregation(time.Minute, chatGPTConfigureID) // 使用多个 smart 时合并为一条答复，并由 chatGPTConfigureID 评审
 	c := cli.NewChat(wecomConfigureID, chatGPTConfigureID)
+	// cli.EnableDirectoryTool(false, chatGPTConfigureID) // 允许 smart 查询通讯录中的同事，回答“谁负责某事”等问题
+	// cli.EnableScheduler(chatGPTConfigureID, chatGPTConfigureID) // 用户可以让 smart 创建提醒，如“明天9点提醒我交周报”
+	// cli.AddScheduledPrompt("daily-news", "0 9 * * 1-5", chatGPTConfigureID, "整理今天的科技新闻摘要", "zhangsan") // 工作日 9 点发送摘要
+	// cli.EnableBroadcast(tencent.DefaultBroadcastRate, 10000) // 主动发送消息，按频率发送并记录发送结果，需在 EnableConsole 之前调用
+	// 向部门2的成员发送由 smart 生成的个性化消息
+	// _, _ = cli.Broadcast(sw.BroadcastTarget{DeptIDs: []int64{2}}, "为{{.User.Name}}写一句 {{.Date}} 的早安问候", true, chatGPTConfigureID)
 	cli.ConfigureWecomUsers(chatGPTConfigureID) // 第一次执行需要导入企微用户，导入后注释此段代码
+	// _ = cli.SyncWecomUsers(true, chatGPTConfigureID) // 只打印通讯录变更，不执行
+	// cli.ScheduleWecomSync(time.Hour, chatGPTConfigureID) // 每小时同步一次通讯录
+	// cli.AddDeptPolicy(2, true, chatGPTConfigureID)         // 部门2及其子部门成员可以使用 chatGPTConfigureID
+	// cli.SetUserRole("zhangsan", sw.RoleAdmin)                // 设置管理员，单聊中可使用 /grant /suspend /broadcast 等指令
+	// cli.SetSystemPrompt(chatGPTConfigureID, "你是公司内部助手") // smart 的系统提示，用户可在单聊中使用 /persona 设置自定义说明
+	// cli.AddTemplate("weekly-report", "请根据以下内容为{{.User.Name}}整理 {{.Date}} 的周报：\n{{.Input}}") // 使用 /t weekly-report <内容> 提问
+	// cli.SetSmartTemplate(chatGPTConfigureID, "weekly-report@1") // smart 的默认模板，固定版本便于比较满意度
+	cli.EnableMonitor() // 开启 /healthz、/readyz 与 /metrics
+	// cli.EnableConsole(":8090", os.Getenv("CONSOLE_TOKEN")) // 开启管理接口与管理页面，与消息服务使用不同端口
+	// _ = cli.AuditReport(time.Now().AddDate(0, 0, -30), time.Now(), "", cmd.ReportFormatCSV, os.Stdout) // 导出最近 30 天的操作记录
+	// 导出最近 7 天的满意度报表，支持 csv 与 json
+	// _ = cli.FeedbackReport(time.Now().AddDate(0, 0, -7), time.Now(), cmd.ReportFormatCSV, os.Stdout)
+	// cli.EnableCardButtons(map[string]string{chatGPTConfigureID: "GPT-3.5"}) // 答复下方显示重新生成、继续等按钮
+
+	// 群机器人，与应用共用 smart 与用户，使用单独端口接收消息
+	// robotConfigureID := cli.AddRobotConfigure(sc.Configure{
+	// 	"uri":            "/api/v1/robot",
+	// 	"token":          "xxxxxxxx",
+	// 	"encodingAESKey": "xxxxxxxxxxxxxxxxxxx",
+	// 	"webhookKey":     "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx",
+	// })
+	// robot := cli.NewRobotChat(robotConfigureID, chatGPTConfigureID)
+	// go robot.Accept("[::]:8003")
+
+	// 微信客服，外部微信用户首次提问时自动注册并使用 chatGPTConfigureID
+	// kfConfigureID := cli.AddKfConfigure(sc.Configure{
+	// 	"uri":            "/api/v1/kf",
+	// 	"token":          "xxxxxxxx",
+	// 	"encodingAESKey": "xxxxxxxxxxxxxxxxxxx",
+	// })
+	// kf := cli.NewKfChat(kfConfigureID, chatGPTConfigureID)
+	// go kf.Accept("[::]:8004")
 	// 等待消息
 	if err := c.Accept("[::]:8002"); err != nil {
 		log.Fatal().Msg(err.Error())
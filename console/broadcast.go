@@ -0,0 +1,102 @@
+package console
+
+import (
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// broadcastRequest 发送消息的请求
+type broadcastRequest struct {
+	sw.BroadcastTarget
+	Content string `json:"content"`
+	// Template content 是否为模板
+	Template bool   `json:"template"`
+	SmartID  string `json:"smartID"`
+}
+
+// broadcastDetail 群发与每个接收人的发送结果
+type broadcastDetail struct {
+	*sw.Broadcast
+	Deliveries []sw.BroadcastDelivery `json:"deliveries"`
+}
+
+func broadcastCache(cache sc.Cache) (sw.BroadcastCache, error) {
+	broadcastCache, ok := cache.(sw.BroadcastCache)
+	if !ok {
+		return nil, errors.New("cache does not support broadcast")
+	}
+	return broadcastCache, nil
+}
+
+// broadcasts GET 群发记录；POST 向成员、部门或标签发送消息，后台发送，返回群发ID
+func (s *Server) broadcasts(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	switch r.Method {
+	case http.MethodGet:
+		broadcastCache, err := broadcastCache(cache)
+		if err != nil {
+			writeError(w, http.StatusNotImplemented, err)
+			return
+		}
+		start, end, err := timeRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		broadcasts, err := broadcastCache.Broadcasts(start, end)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, broadcasts)
+	case http.MethodPost:
+		if s.broadcaster == nil {
+			writeError(w, http.StatusNotImplemented, errors.New("broadcast unsupported"))
+			return
+		}
+		var req broadcastRequest
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		broadcast := &sw.Broadcast{Target: req.BroadcastTarget, Content: req.Content, Template: req.Template, SmartID: req.SmartID}
+		if err := s.broadcaster.Start(r.Context(), broadcast); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, broadcast)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// broadcast GET /api/broadcasts/{id} 群发进度与每个接收人的发送结果
+func (s *Server) broadcast(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	broadcastCache, err := broadcastCache(cache)
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/broadcasts/")
+	broadcast, err := broadcastCache.Broadcast(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	deliveries, err := broadcastCache.BroadcastDeliveries(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].UserID < deliveries[j].UserID })
+	writeJSON(w, http.StatusOK, broadcastDetail{Broadcast: broadcast, Deliveries: deliveries})
+}
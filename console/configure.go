@@ -0,0 +1,143 @@
+package console
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// configures GET 所有配置ID
+func (s *Server) configures(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	manageCache, ok := cache.(sw.ManageCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support configure list"))
+		return
+	}
+	ids, err := manageCache.ConfigureIDs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
+
+// configure GET 查询配置，密钥脱敏后返回
+// PUT 保存配置，值为脱敏值的密钥保持原值不变
+func (s *Server) configure(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	id := strings.TrimPrefix(r.URL.Path, "/api/configures/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	configure, err := cache.Configure(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if configure == nil {
+			writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("configure [%s] not found", id)))
+			return
+		}
+		writeJSON(w, http.StatusOK, sw.RedactConfigure(configure))
+	case http.MethodPut:
+		var req sc.Configure
+		if err = readJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		for name, value := range req {
+			if value == sw.RedactedValue {
+				req[name] = configure[name]
+			}
+		}
+		if err = cache.ConfigureStore(id, req); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sw.RedactConfigure(req))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// UsageRow 用户一天的答复次数
+type UsageRow struct {
+	Day    string     `json:"day"`
+	UID    sc.UserUID `json:"uid"`
+	UserID string     `json:"userID"`
+	Name   string     `json:"name"`
+	Used   int64      `json:"used"`
+}
+
+// usageReport GET 企微用户在 [start, end] 内每天的答复次数，不包含没有答复的天
+func (s *Server) usageReport(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	adminCache, err := adminCache(cache)
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	bindings, err := userBindings(cache, "wecom:")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rows := make([]UsageRow, 0)
+	for userUID, userIDs := range bindings {
+		user, err := cache.User(userUID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if user == nil {
+			continue
+		}
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			used, err := adminCache.UserUsage(userUID, day)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if used == 0 {
+				continue
+			}
+			rows = append(rows, UsageRow{
+				Day:    day.Format("2006-01-02"),
+				UID:    userUID,
+				UserID: userIDs[0],
+				Name:   user.Name,
+				Used:   used,
+			})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Day != rows[j].Day {
+			return rows[i].Day < rows[j].Day
+		}
+		return rows[i].UserID < rows[j].UserID
+	})
+	writeJSON(w, http.StatusOK, rows)
+}
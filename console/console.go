@@ -0,0 +1,236 @@
+package console
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//go:embed web
+var web embed.FS
+
+// actor 管理接口操作记录中的操作人，请求头 X-Operator 不为空时记录为 console:[X-Operator]
+const actor = "console"
+
+// Server 管理接口与管理页面，/api/ 下的接口需要 Authorization: Bearer <token>
+type Server struct {
+	cache sc.Cache
+	token string
+	// broadcaster 主动发送消息，为空时不支持发送
+	broadcaster BroadcastSender
+	mux         *http.ServeMux
+}
+
+// BroadcastSender 检查并在后台发送群发，Start 返回后 broadcast 不再被修改
+type BroadcastSender interface {
+	Start(ctx context.Context, broadcast *sw.Broadcast) error
+}
+
+// SetBroadcaster 开启 POST /api/broadcasts 发送消息
+func (s *Server) SetBroadcaster(broadcaster BroadcastSender) {
+	s.broadcaster = broadcaster
+}
+
+// NewServer 创建管理服务，token 为空时所有接口都拒绝访问
+func NewServer(cache sc.Cache, token string) *Server {
+	s := &Server{cache: cache, token: token}
+	s.mux = s.routes()
+	return s
+}
+
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users", s.users)
+	mux.HandleFunc("/api/users/", s.user)
+	mux.HandleFunc("/api/configures", s.configures)
+	mux.HandleFunc("/api/configures/", s.configure)
+	mux.HandleFunc("/api/reports/usage", s.usageReport)
+	mux.HandleFunc("/api/audit", s.audits)
+	mux.HandleFunc("/api/moderation", s.moderation)
+	mux.HandleFunc("/api/routes", s.routeDecisions)
+	mux.HandleFunc("/api/broadcasts", s.broadcasts)
+	mux.HandleFunc("/api/broadcasts/", s.broadcast)
+
+	static, _ := fs.Sub(web, "web")
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	return mux
+}
+
+// ServeHTTP 请求的 ctx 带上操作人，接口通过 requestCache 修改数据时记录操作人
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") && !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	operator := actor
+	if name, _ := url.QueryUnescape(r.Header.Get("X-Operator")); strings.TrimSpace(name) != "" {
+		operator = fmt.Sprintf("%s:%s", actor, strings.TrimSpace(name))
+	}
+	s.mux.ServeHTTP(w, r.WithContext(sw.WithActor(r.Context(), operator)))
+}
+
+// requestCache 绑定请求 ctx 的 cache，受请求取消控制并记录 ctx 中的操作人
+func (s *Server) requestCache(r *http.Request) sc.Cache {
+	return sw.CacheWithContext(r.Context(), s.cache)
+}
+
+// ListenAndServe 在独立的地址上提供管理服务，不与企微回调共用端口
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func adminCache(cache sc.Cache) (sw.AdminCache, error) {
+	adminCache, ok := cache.(sw.AdminCache)
+	if !ok {
+		return nil, errors.New("cache does not support admin")
+	}
+	return adminCache, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func readJSON(r *http.Request, v any) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errors.New(fmt.Sprintf("invalid body, %s", err.Error()))
+	}
+	return nil
+}
+
+// timeRange 查询参数中的 start 与 end，格式为 2006-01-02，end 包含当天，默认为最近 7 天
+func timeRange(r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	year, month, day := now.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, now.Location()).AddDate(0, 0, -6)
+	end := now
+	if value := r.URL.Query().Get("start"); value != "" {
+		t, err := time.ParseInLocation("2006-01-02", value, now.Location())
+		if err != nil {
+			return start, end, errors.New(fmt.Sprintf("invalid start [%s]", value))
+		}
+		start = t
+	}
+	if value := r.URL.Query().Get("end"); value != "" {
+		t, err := time.ParseInLocation("2006-01-02", value, now.Location())
+		if err != nil {
+			return start, end, errors.New(fmt.Sprintf("invalid end [%s]", value))
+		}
+		end = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return start, end, nil
+}
+
+// audits GET 操作记录，entity 与 target 过滤对象，format 为 csv 时导出 csv 文件
+func (s *Server) audits(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	auditCache, ok := cache.(sw.AuditCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support audit"))
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := auditCache.AuditEntries(sw.AuditQuery{
+		Start:  start,
+		End:    end,
+		Entity: r.URL.Query().Get("entity"),
+		Target: r.URL.Query().Get("target"),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.csv", start.Format("20060102")))
+		if err = sw.WriteAuditCSV(w, entries); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[console] export audit %s", err.Error()))
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// moderation GET 内容审核不通过的记录，用于人工复查
+func (s *Server) moderation(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	moderationCache, ok := cache.(sw.ModerationCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support moderation"))
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	incidents, err := moderationCache.ModerationIncidents(start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, incidents)
+}
+
+// routeDecisions GET 意图路由的分配结果，用于分析路由效果
+func (s *Server) routeDecisions(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	routeCache, ok := cache.(sw.RouteCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support routes"))
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	decisions, err := routeCache.Routes(start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, decisions)
+}
@@ -0,0 +1,453 @@
+package console
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/pkg/errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// User 管理接口返回的用户信息
+type User struct {
+	UID    sc.UserUID    `json:"uid"`
+	Name   string        `json:"name"`
+	Status sc.UserStatus `json:"status"`
+	// UserIDs 绑定的平台用户ID，如 wecom:zhangsan
+	UserIDs []string `json:"userIDs"`
+	// Smarts 拥有的 smart
+	Smarts []string `json:"smarts"`
+	// Answer 提问使用的 smart
+	Answer    []string        `json:"answer"`
+	Role      sw.Role         `json:"role"`
+	Quota     int64           `json:"quota"`
+	UsedToday int64           `json:"usedToday"`
+	Profile   *sw.UserProfile `json:"profile,omitempty"`
+	// Instructions 用户的自定义说明
+	Instructions string `json:"instructions"`
+}
+
+// userBindings 以 prefix 开头的平台用户ID，按 UserUID 分组
+func userBindings(cache sc.Cache, prefix string) (map[sc.UserUID][]string, error) {
+	profileCache, ok := cache.(sw.UserProfileCache)
+	if !ok {
+		return nil, errors.New("cache does not support user profile")
+	}
+	bindings, err := profileCache.UserBindings(prefix)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[sc.UserUID][]string)
+	for userID, userUID := range bindings {
+		users[userUID] = append(users[userUID], userID)
+	}
+	for userUID := range users {
+		sort.Strings(users[userUID])
+	}
+	return users, nil
+}
+
+// loadUser 用户详情，用户不存在时返回 nil
+func loadUser(cache sc.Cache, userUID sc.UserUID, userIDs []string) (*User, error) {
+	user, err := cache.User(userUID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	view := &User{UID: user.UID, Name: user.Name, Status: user.Status, UserIDs: userIDs, Role: sw.RoleUser}
+	if view.Smarts, err = cache.UserSmartUIDs(userUID); err != nil {
+		return nil, err
+	}
+	if view.Answer, err = cache.UserAnswer(userUID); err != nil {
+		return nil, err
+	}
+	if adminCache, ok := cache.(sw.AdminCache); ok {
+		if view.Role, err = adminCache.UserRole(userUID); err != nil {
+			return nil, err
+		}
+		if view.Quota, err = adminCache.UserQuota(userUID); err != nil {
+			return nil, err
+		}
+		if view.UsedToday, err = adminCache.UserUsage(userUID, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if profileCache, ok := cache.(sw.UserProfileCache); ok {
+		if view.Profile, err = profileCache.UserProfile(userUID); err != nil {
+			return nil, err
+		}
+	}
+	if personaCache, ok := cache.(sw.PersonaCache); ok {
+		if view.Instructions, err = personaCache.UserInstructions(userUID); err != nil {
+			return nil, err
+		}
+	}
+	return view, nil
+}
+
+// users GET 查询用户列表，prefix 为平台用户ID前缀，默认为 wecom:
+// POST 新增用户并绑定平台用户ID
+func (s *Server) users(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	switch r.Method {
+	case http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		if prefix == "" {
+			prefix = "wecom:"
+		}
+		bindings, err := userBindings(cache, prefix)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		users := make([]*User, 0, len(bindings))
+		for userUID, userIDs := range bindings {
+			user, err := loadUser(cache, userUID, userIDs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if user != nil {
+				users = append(users, user)
+			}
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].UserIDs[0] < users[j].UserIDs[0] })
+		writeJSON(w, http.StatusOK, users)
+	case http.MethodPost:
+		var req struct {
+			// UserID 带平台前缀的用户ID，如 wecom:zhangsan
+			UserID string   `json:"userID"`
+			Name   string   `json:"name"`
+			Smarts []string `json:"smarts"`
+		}
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !strings.Contains(req.UserID, ":") {
+			writeError(w, http.StatusBadRequest, errors.New("userID must have platform prefix, e.g. wecom:zhangsan"))
+			return
+		}
+		if _, err := cache.UserID2UID(req.UserID); err == nil {
+			writeError(w, http.StatusConflict, errors.New(fmt.Sprintf("user [%s] exists", req.UserID)))
+			return
+		}
+		for i := range req.Smarts {
+			if err := sw.SmartConfigured(cache, req.Smarts[i]); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		user := &sc.User{
+			UID:    sc.UserUID(utils.MD5(strings.SplitN(req.UserID, ":", 2)[1])), // 与 ConfigureWecomUsers 相同
+			Name:   req.Name,
+			Status: sc.UserStatusActive,
+		}
+		if err := sw.ProvisionUser(cache, req.UserID, user, req.Smarts...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		view, err := loadUser(cache, user.UID, []string{req.UserID})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, view)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// user 单个用户的接口
+//
+//	GET    /api/users/{uid}
+//	PUT    /api/users/{uid}                 修改名称、状态与角色
+//	DELETE /api/users/{uid}                 锁定用户并解除所有平台用户ID绑定
+//	POST   /api/users/{uid}/smarts          授权 smart
+//	DELETE /api/users/{uid}/smarts/{smart}  收回 smart
+//	PUT    /api/users/{uid}/quota           设置每日提问次数
+//	PUT    /api/users/{uid}/instructions    设置自定义说明
+//	GET    /api/users/{uid}/sessions        查询会话，q 为问题或答复中的关键字
+func (s *Server) user(w http.ResponseWriter, r *http.Request) {
+	cache := s.requestCache(r)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/")
+	userUID := sc.UserUID(parts[0])
+	bindCache, ok := cache.(sw.UserBindCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support user bindings"))
+		return
+	}
+	userIDs, err := bindCache.UserIDs(userUID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	user, err := loadUser(cache, userUID, userIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("user [%s] not found", userUID)))
+		return
+	}
+
+	route := r.Method + " " + strings.Join(append([]string{""}, parts[1:]...), "/")
+	switch {
+	case route == "GET ":
+		writeJSON(w, http.StatusOK, user)
+	case route == "PUT ":
+		s.updateUser(w, r, user)
+	case route == "DELETE ":
+		s.deleteUser(w, r, user)
+	case route == "POST /smarts":
+		s.grant(w, r, user)
+	case strings.HasPrefix(route, "DELETE /smarts/") && len(parts) == 3:
+		s.revoke(w, r, user, parts[2])
+	case route == "PUT /quota":
+		s.quota(w, r, user)
+	case route == "PUT /instructions":
+		s.instructions(w, r, user)
+	case route == "GET /sessions":
+		s.sessions(w, r, user)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	var req struct {
+		Name   *string        `json:"name"`
+		Status *sc.UserStatus `json:"status"`
+		Role   *sw.Role       `json:"role"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Role != nil {
+		if _, ok := sw.ParseRole(string(*req.Role)); !ok {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("unknown role [%s]", *req.Role)))
+			return
+		}
+	}
+	if req.Status != nil {
+		switch *req.Status {
+		case sc.UserStatusActive, sc.UserStatusDown, sc.UserStatusBlock:
+		default:
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("unknown status [%d]", *req.Status)))
+			return
+		}
+	}
+	user, err := cache.User(view.UID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	if req.Status != nil {
+		user.Status = *req.Status
+		// 与 /suspend 相同，暂停单独记录，通讯录同步不会恢复
+		if adminCache, ok := cache.(sw.AdminCache); ok {
+			if err = adminCache.UserSuspendStore(user.UID, user.Status == sc.UserStatusDown); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+	if err = cache.UserStore(user); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if req.Role != nil && *req.Role != view.Role {
+		role := *req.Role
+		adminCache, err := adminCache(cache)
+		if err != nil {
+			writeError(w, http.StatusNotImplemented, err)
+			return
+		}
+		if err = adminCache.UserRoleStore(view.UID, role); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	s.writeUser(w, r, view)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	user, err := cache.User(view.UID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	user.Status = sc.UserStatusBlock
+	if err = cache.UserStore(user); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if bindCache, ok := cache.(sw.UserBindCache); ok {
+		for _, userID := range view.UserIDs {
+			if err = bindCache.UserUIDUnbind(userID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) grant(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	var req struct {
+		Smarts []string `json:"smarts"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Smarts) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("smarts required"))
+		return
+	}
+	for i := range req.Smarts {
+		if err := sw.SmartConfigured(cache, req.Smarts[i]); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := cache.UserSmartsStore(view.UID, req.Smarts...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := cache.UserAnswerStore(view.UID, req.Smarts...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeUser(w, r, view)
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request, view *User, smartID string) {
+	cache := s.requestCache(r)
+	adminCache, err := adminCache(cache)
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err = adminCache.UserSmartsRemove(view.UID, smartID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeUser(w, r, view)
+}
+
+func (s *Server) quota(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	var req struct {
+		Quota int64 `json:"quota"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Quota < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("quota must not be negative"))
+		return
+	}
+	adminCache, err := adminCache(cache)
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err = adminCache.UserQuotaStore(view.UID, req.Quota); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeUser(w, r, view)
+}
+
+func (s *Server) instructions(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	var req struct {
+		// Instructions 自定义说明或 sw.PersonaPresets 中的名称，为空时清除
+		Instructions string `json:"instructions"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	instructions, err := sw.ResolveInstructions(req.Instructions)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	personaCache, ok := cache.(sw.PersonaCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support instructions"))
+		return
+	}
+	if err = personaCache.UserInstructionsStore(view.UID, instructions); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeUser(w, r, view)
+}
+
+// writeUser 返回修改后的用户信息
+func (s *Server) writeUser(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	user, err := loadUser(cache, view.UID, view.UserIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// Session 管理接口返回的会话
+type Session struct {
+	ID       sc.SessionID `json:"id"`
+	SmartID  string       `json:"smartID"`
+	Question string       `json:"question"`
+	Answer   string       `json:"answer"`
+}
+
+func (s *Server) sessions(w http.ResponseWriter, r *http.Request, view *User) {
+	cache := s.requestCache(r)
+	manageCache, ok := cache.(sw.ManageCache)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("cache does not support session search"))
+		return
+	}
+	start, end, err := timeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	sessions, err := manageCache.Sessions(view.UID, start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	keyword := r.URL.Query().Get("q")
+	result := make([]Session, 0, len(sessions))
+	for i := range sessions {
+		session := Session{
+			ID:       sessions[i].ID,
+			SmartID:  sessions[i].SmartID,
+			Question: sw.QuestionText(sessions[i].Question),
+			Answer:   fmt.Sprint(sessions[i].Answer),
+		}
+		if keyword != "" && !strings.Contains(session.Question, keyword) && !strings.Contains(session.Answer, keyword) {
+			continue
+		}
+		result = append(result, session)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
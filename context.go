@@ -0,0 +1,69 @@
+package smart_wecom
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	"github.com/pkg/errors"
+)
+
+// ContextCache 可以绑定 context 的 cache
+// 绑定后的操作会作为 ctx 中 span 的子 span 被追踪，并在 ctx 超时或取消时中止
+type ContextCache interface {
+	sc.Cache
+
+	// WithContext 返回绑定 ctx 的 cache
+	WithContext(context.Context) sc.Cache
+}
+
+// CacheWithContext cache 实现了 ContextCache 时绑定 ctx，否则原样返回
+func CacheWithContext(ctx context.Context, cache sc.Cache) sc.Cache {
+	if c, ok := cache.(ContextCache); ok {
+		return c.WithContext(ctx)
+	}
+	return cache
+}
+
+// ContextSmart 支持 context 的 smart，ctx 超时或取消时应尽快返回
+type ContextSmart interface {
+	smart.Smart
+
+	// AskContext 提问
+	AskContext(context.Context, sc.Question) (sc.Answer, error)
+}
+
+// AskWithContext s 实现了 ContextSmart 时使用 ctx 提问
+// 否则在 ctx 结束时直接返回 ctx.Err()，此时 Ask 仍会在后台执行完成
+// s 为空或 Ask 发生 panic 时返回错误
+func AskWithContext(ctx context.Context, s smart.Smart, q sc.Question) (sc.Answer, error) {
+	if s == nil {
+		return nil, errors.New("smart not found")
+	}
+	if cs, ok := s.(ContextSmart); ok {
+		return cs.AskContext(ctx, q)
+	}
+
+	type result struct {
+		answer sc.Answer
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		// 后台执行时已不在调用方的 recover 中
+		defer func() {
+			if err := recover(); err != nil {
+				ch <- result{nil, errors.New(fmt.Sprintf("smart ask panic, %v", err))}
+			}
+		}()
+		answer, err := s.Ask(q)
+		ch <- result{answer, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.answer, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package smart_wecom
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MessageRole 对话消息角色
+type MessageRole string
+
+const (
+	// MessageRoleSystem 系统提示
+	MessageRoleSystem MessageRole = "system"
+	// MessageRoleUser 用户提问
+	MessageRoleUser MessageRole = "user"
+	// MessageRoleAssistant smart 答复
+	MessageRoleAssistant MessageRole = "assistant"
+)
+
+// Message 对话中的一条消息
+type Message struct {
+	Role    MessageRole
+	Content string
+}
+
+// Conversation 带上下文的提问，smart 需要根据 History 回答 Question
+// 不支持上下文的 smart 可以只使用 Question
+type Conversation struct {
+	History  []Message
+	Question string
+	// Instructions 用户的自定义说明，smart 需要合并到系统提示中
+	Instructions string
+}
+
+// ChatMessages 将提问转换为对话消息，Conversation 会带上历史上下文
+// smart 的系统提示与用户的自定义说明合并为第一条 system 消息
+func ChatMessages(systemPrompt string, q any) []Message {
+	var history []Message
+	var instructions string
+	switch v := q.(type) {
+	case Conversation:
+		history, instructions = v.History, v.Instructions
+	case *Conversation:
+		history, instructions = v.History, v.Instructions
+	}
+
+	msgs := make([]Message, 0, len(history)+2)
+	var system []string
+	if systemPrompt = strings.TrimSpace(systemPrompt); systemPrompt != "" {
+		system = append(system, systemPrompt)
+	}
+	if instructions = strings.TrimSpace(instructions); instructions != "" {
+		system = append(system, fmt.Sprintf("用户的自定义说明，请在不违反以上要求的前提下遵循：\n%s", instructions))
+	}
+	if len(system) > 0 {
+		msgs = append(msgs, Message{Role: MessageRoleSystem, Content: strings.Join(system, "\n\n")})
+	}
+	msgs = append(msgs, history...)
+	return append(msgs, Message{Role: MessageRoleUser, Content: QuestionText(q)})
+}
+
+// WithInstructions 为提问附加用户的自定义说明
+func WithInstructions(q any, instructions string) Conversation {
+	switch v := q.(type) {
+	case Conversation:
+		v.Instructions = instructions
+		return v
+	case *Conversation:
+		conversation := *v
+		conversation.Instructions = instructions
+		return conversation
+	default:
+		return Conversation{Question: QuestionText(q), Instructions: instructions}
+	}
+}
+
+// QuestionText 取出提问的文本内容
+func QuestionText(q any) string {
+	switch v := q.(type) {
+	case string:
+		return v
+	case Conversation:
+		return v.Question
+	case *Conversation:
+		return v.Question
+	default:
+		return ""
+	}
+}
+
+// AggregateSmartID 汇总模式下合并答复的 SmartID，不对应实际的 smart
+const AggregateSmartID = "aggregate"
@@ -0,0 +1,123 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"strconv"
+	"time"
+)
+
+// Rating 用户对答复的评价
+type Rating int
+
+const (
+	RatingBad  Rating = -1
+	RatingGood Rating = 1
+)
+
+// FeedbackPendingTTL 最近一次答复可被评价的时间
+const FeedbackPendingTTL = 24 * time.Hour
+
+// Feedback 用户对一次答复的评价
+type Feedback struct {
+	SessionID sc.SessionID
+	SmartID   string
+	UserUID   sc.UserUID
+	// UserID 平台用户ID，如企微 UserID
+	UserID string
+	// DeptIDs 评价时用户所属的部门
+	DeptIDs []int64
+	// Template 提问使用的 prompt 模板，未使用时为空
+	Template   string
+	Question   string
+	Answer     string
+	Rating     Rating
+	AnsweredAt time.Time
+	RatedAt    time.Time
+}
+
+// FeedbackCache 答复评价存储
+type FeedbackCache interface {
+	// FeedbackPending 用户最近一次未评价的答复，不存在时返回 nil
+	FeedbackPending(userUID sc.UserUID) (*Feedback, error)
+
+	// FeedbackPendingStore 保存用户最近一次答复，FeedbackPendingTTL 后过期
+	FeedbackPendingStore(feedback *Feedback) error
+
+	// FeedbackStore 保存评价，同一会话同一 smart 重复评价时覆盖
+	FeedbackStore(feedback *Feedback) error
+
+	// Feedbacks 评价时间在 [start, end] 内的所有评价
+	Feedbacks(start time.Time, end time.Time) ([]Feedback, error)
+}
+
+func (r Redis) FeedbackPending(userUID sc.UserUID) (feedback *Feedback, err error) {
+	// key -> feedback:last:[userUID] => Feedback
+	result, err := r.client.Get(r.ctx, fmt.Sprintf("feedback:last:%s", userUID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	feedback = &Feedback{}
+	if err = msgpack.Unmarshal([]byte(result), feedback); err != nil {
+		return nil, err
+	}
+	return feedback, nil
+}
+
+func (r Redis) FeedbackPendingStore(feedback *Feedback) error {
+	// key -> feedback:last:[userUID] => Feedback
+	feedbackPack, err := msgpack.Marshal(feedback)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.ctx, fmt.Sprintf("feedback:last:%s", feedback.UserUID),
+		feedbackPack, FeedbackPendingTTL).Err()
+}
+
+func (r Redis) FeedbackStore(feedback *Feedback) error {
+	// key -> feedback:info:[sessionID]:[smartID] => Feedback
+	// key -> feedback:time => zset(feedback:info:[sessionID]:[smartID], RatedAt)
+	feedbackPack, err := msgpack.Marshal(feedback)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("feedback:info:%s:%s", feedback.SessionID, feedback.SmartID)
+	pipe := r.client.TxPipeline()
+	pipe.Set(r.ctx, key, feedbackPack, 0)
+	pipe.ZAdd(r.ctx, "feedback:time", redis.Z{Score: float64(feedback.RatedAt.Unix()), Member: key})
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+func (r Redis) Feedbacks(start time.Time, end time.Time) ([]Feedback, error) {
+	keys, err := r.client.ZRangeByScore(r.ctx, "feedback:time", &redis.ZRangeBy{
+		Min: strconv.FormatInt(start.Unix(), 10),
+		Max: strconv.FormatInt(end.Unix(), 10),
+	}).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	results, err := r.client.MGet(r.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	feedbacks := make([]Feedback, 0, len(results))
+	for i := range results {
+		result, ok := results[i].(string)
+		if !ok {
+			continue
+		}
+		var feedback Feedback
+		if err = msgpack.Unmarshal([]byte(result), &feedback); err != nil {
+			return nil, err
+		}
+		feedbacks = append(feedbacks, feedback)
+	}
+	return feedbacks, nil
+}
@@ -0,0 +1,101 @@
+package smart_wecom
+
+import (
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DefaultGroupMemorySize 默认群聊上下文保留的消息条数
+const DefaultGroupMemorySize = 10
+
+// Group 群聊配置，群聊中的提问通过群机器人接收，机器人只在被 @ 时收到消息
+type Group struct {
+	// ChatID 群机器人回调消息中的 ChatId
+	ChatID string
+	Name   string
+	// SmartIDs 群内提问使用的 smart，为空时使用提问用户自己的配置
+	SmartIDs []string
+	// MemorySize 群聊上下文保留的消息条数，0 表示不保留
+	MemorySize int
+}
+
+// GroupCache 群聊配置与上下文存储
+type GroupCache interface {
+	// Group 群聊配置，不存在时返回 nil
+	Group(chatID string) (*Group, error)
+
+	// GroupStore 保存群聊配置
+	GroupStore(*Group) error
+
+	// GroupMemory 群聊中与 smart 的对话上下文，按时间顺序
+	GroupMemory(chatID string, smartID string) ([]Message, error)
+
+	// GroupMemoryAppend 追加对话上下文，只保留最近 size 条
+	GroupMemoryAppend(chatID string, smartID string, size int, messages ...Message) error
+}
+
+func (r Redis) Group(chatID string) (group *Group, err error) {
+	// key -> group:info:[chatID] => Group
+	result, err := r.client.Get(r.ctx, fmt.Sprintf("group:info:%s", chatID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = msgpack.Unmarshal([]byte(result), &group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (r Redis) GroupStore(group *Group) error {
+	// key -> group:info:[chatID] => Group
+	before, err := r.Group(group.ChatID)
+	if err != nil {
+		return err
+	}
+	groupPack, err := msgpack.Marshal(group)
+	if err != nil {
+		return err
+	}
+	if err = r.client.Set(r.ctx, fmt.Sprintf("group:info:%s", group.ChatID), groupPack, 0).Err(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityGroup, group.ChatID, "store", before, group)
+}
+
+func (r Redis) GroupMemory(chatID string, smartID string) (messages []Message, err error) {
+	// key -> group:memory:[chatID]:[smartID] => [...Message]
+	result, err := r.client.LRange(r.ctx, fmt.Sprintf("group:memory:%s:%s", chatID, smartID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		message := Message{}
+		if err = msgpack.Unmarshal([]byte(result[i]), &message); err == nil {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (r Redis) GroupMemoryAppend(chatID string, smartID string, size int, messages ...Message) error {
+	// key -> group:memory:[chatID]:[smartID] => [...Message]
+	key := fmt.Sprintf("group:memory:%s:%s", chatID, smartID)
+	values := make([]interface{}, 0, len(messages))
+	for i := range messages {
+		messagePack, err := msgpack.Marshal(messages[i])
+		if err != nil {
+			return err
+		}
+		values = append(values, messagePack)
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.RPush(r.ctx, key, values...)
+	pipe.LTrim(r.ctx, key, int64(-size), -1)
+	_, err := pipe.Exec(r.ctx)
+	return err
+}
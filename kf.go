@@ -0,0 +1,29 @@
+package smart_wecom
+
+import (
+	"fmt"
+	"github.com/redis/go-redis/v9"
+)
+
+// KfCache 微信客服拉取消息的游标存储
+type KfCache interface {
+	// KfCursor 客服账号上次拉取消息的游标，不存在时返回空
+	KfCursor(openKfID string) (string, error)
+
+	// KfCursorStore 保存客服账号拉取消息的游标
+	KfCursorStore(openKfID string, cursor string) error
+}
+
+func (r Redis) KfCursor(openKfID string) (string, error) {
+	// key -> kf:cursor:[openKfID] => cursor
+	cursor, err := r.client.Get(r.ctx, fmt.Sprintf("kf:cursor:%s", openKfID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return cursor, err
+}
+
+func (r Redis) KfCursorStore(openKfID string, cursor string) error {
+	// key -> kf:cursor:[openKfID] => cursor
+	return r.client.Set(r.ctx, fmt.Sprintf("kf:cursor:%s", openKfID), cursor, 0).Err()
+}
@@ -0,0 +1,90 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManageCache 管理接口使用的查询
+type ManageCache interface {
+	// Sessions 用户在 [start, end] 内保存的会话，按天查询 SessionStore 保存的记录
+	Sessions(userUID sc.UserUID, start time.Time, end time.Time) ([]sc.Session, error)
+
+	// ConfigureIDs 所有配置ID
+	ConfigureIDs() ([]string, error)
+}
+
+func (r Redis) Sessions(userUID sc.UserUID, start time.Time, end time.Time) ([]sc.Session, error) {
+	// key -> session:[time]:[UserUID]:[SessionID] => Session
+	var sessions []sc.Session
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		iter := r.client.Scan(r.ctx, 0,
+			fmt.Sprintf("session:%s:%s:*", day.Format("20060102"), userUID), 100).Iterator()
+		for iter.Next(r.ctx) {
+			result, err := r.client.Get(r.ctx, iter.Val()).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			var session sc.Session
+			if err = msgpack.Unmarshal([]byte(result), &session); err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, session)
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+func (r Redis) ConfigureIDs() ([]string, error) {
+	//key -> configure:[configureID]
+	var ids []string
+	iter := r.client.Scan(r.ctx, 0, "configure:*", 100).Iterator()
+	for iter.Next(r.ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), "configure:"))
+	}
+	sort.Strings(ids)
+	return ids, iter.Err()
+}
+
+// RedactedValue 脱敏后的配置值
+const RedactedValue = "******"
+
+// secretKeys 配置项名称包含这些关键字时视为密钥
+var secretKeys = []string{"token", "secret", "key", "password", "passwd"}
+
+// IsSecretKey 配置项是否为密钥
+func IsSecretKey(name string) bool {
+	name = strings.ToLower(name)
+	for i := range secretKeys {
+		if strings.Contains(name, secretKeys[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactConfigure 返回密钥替换为 RedactedValue 的配置副本
+func RedactConfigure(configure sc.Configure) sc.Configure {
+	if configure == nil {
+		return nil
+	}
+	redacted := make(sc.Configure, len(configure))
+	for name, value := range configure {
+		if IsSecretKey(name) && fmt.Sprint(value) != "" {
+			value = RedactedValue
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
@@ -0,0 +1,170 @@
+package smart_wecom
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModerationAction 内容审核不通过时的处理方式
+type ModerationAction string
+
+const (
+	// ModerationBlock 拦截提问，答复替换为拦截提示
+	ModerationBlock ModerationAction = "block"
+	// ModerationWarn 记录后继续，答复末尾附加提示
+	ModerationWarn ModerationAction = "warn"
+	// ModerationReplace 答复中命中的内容替换为 *，无法定位命中内容时替换为拦截提示；提问无法替换，按 block 处理
+	ModerationReplace ModerationAction = "replace"
+)
+
+// ModerationStage 审核的内容
+type ModerationStage string
+
+const (
+	ModerationStageQuestion ModerationStage = "question"
+	ModerationStageAnswer   ModerationStage = "answer"
+)
+
+// ModerationResult 一次审核的结果
+type ModerationResult struct {
+	Flagged bool
+	// Source 审核来源，如 blocklist、openai
+	Source string
+	// Categories 命中的分类
+	Categories []string
+	// Matches 命中的原文，用于替换，无法定位时为空
+	Matches []string
+}
+
+// Moderator 内容审核
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (*ModerationResult, error)
+}
+
+// LocalModerator 只在本地审核、不将内容发送到外部服务的审核，开启脱敏时仍审核原文
+type LocalModerator interface {
+	Moderator
+	Local() bool
+}
+
+// KeywordModerator 本地关键字与正则表达式黑名单
+type KeywordModerator struct {
+	pattern *regexp.Regexp
+}
+
+// Local 黑名单在本地匹配
+func (moderator *KeywordModerator) Local() bool {
+	return true
+}
+
+// NewKeywordModerator 创建黑名单审核，keywords 为关键字，patterns 为正则表达式
+func NewKeywordModerator(keywords []string, patterns ...string) (*KeywordModerator, error) {
+	alternatives := make([]string, 0, len(keywords)+len(patterns))
+	for i := range keywords {
+		if keyword := strings.TrimSpace(keywords[i]); keyword != "" {
+			alternatives = append(alternatives, regexp.QuoteMeta(keyword))
+		}
+	}
+	for i := range patterns {
+		if _, err := regexp.Compile(patterns[i]); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid moderation pattern [%s], %s", patterns[i], err.Error()))
+		}
+		alternatives = append(alternatives, fmt.Sprintf("(?:%s)", patterns[i]))
+	}
+	if len(alternatives) == 0 {
+		return nil, errors.New("moderation keywords or patterns required")
+	}
+	return &KeywordModerator{pattern: regexp.MustCompile(strings.Join(alternatives, "|"))}, nil
+}
+
+func (moderator *KeywordModerator) Moderate(_ context.Context, text string) (*ModerationResult, error) {
+	matches := moderator.pattern.FindAllString(text, -1)
+	if len(matches) == 0 {
+		return &ModerationResult{Source: "blocklist"}, nil
+	}
+	return &ModerationResult{
+		Flagged:    true,
+		Source:     "blocklist",
+		Categories: []string{"blocklist"},
+		Matches:    matches,
+	}, nil
+}
+
+// MaskMatches 将 text 中命中的内容替换为等长的 *
+func MaskMatches(text string, matches []string) string {
+	// 较长的内容优先替换
+	sorted := append([]string(nil), matches...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, len(sorted)*2)
+	for i := range sorted {
+		if sorted[i] != "" {
+			pairs = append(pairs, sorted[i], strings.Repeat("*", len([]rune(sorted[i]))))
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// ModerationIncident 审核不通过的记录，用于人工复查
+type ModerationIncident struct {
+	Time       time.Time
+	SessionID  sc.SessionID
+	SmartID    string
+	UserUID    sc.UserUID
+	Stage      ModerationStage
+	Source     string
+	Categories []string
+	Matches    []string
+	Action     ModerationAction
+	// Content 审核的原始内容
+	Content string
+}
+
+// ModerationCache 审核记录存储
+type ModerationCache interface {
+	// ModerationIncidentStore 保存审核记录
+	ModerationIncidentStore(incident *ModerationIncident) error
+
+	// ModerationIncidents 时间在 [start, end] 内的审核记录
+	ModerationIncidents(start time.Time, end time.Time) ([]ModerationIncident, error)
+}
+
+func (r Redis) ModerationIncidentStore(incident *ModerationIncident) error {
+	// key -> moderation:time => zset(ModerationIncident, Time)
+	incidentPack, err := msgpack.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	return r.client.ZAdd(r.ctx, "moderation:time", redis.Z{
+		Score:  float64(incident.Time.UnixNano()),
+		Member: incidentPack,
+	}).Err()
+}
+
+func (r Redis) ModerationIncidents(start time.Time, end time.Time) ([]ModerationIncident, error) {
+	// key -> moderation:time => zset(ModerationIncident, Time)
+	result, err := r.client.ZRangeByScore(r.ctx, "moderation:time", &redis.ZRangeBy{
+		Min: strconv.FormatInt(start.UnixNano(), 10),
+		Max: strconv.FormatInt(end.UnixNano(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	incidents := make([]ModerationIncident, 0, len(result))
+	for i := range result {
+		var incident ModerationIncident
+		if err = msgpack.Unmarshal([]byte(result[i]), &incident); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, incident)
+	}
+	return incidents, nil
+}
@@ -0,0 +1,60 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ReadyTimeout /readyz 所有检查项的超时时间，依赖无响应时及时返回 503
+const ReadyTimeout = 3 * time.Second
+
+// Check 就绪检查，返回 nil 表示依赖可用，ctx 超时或取消时应尽快返回
+type Check func(ctx context.Context) error
+
+// Pinger 可以检测连通性的依赖，如 Redis
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Register 在 mux 上注册 /healthz、/readyz 与 /metrics
+// checks 为 /readyz 需要执行的检查项，key 为检查项名称
+func Register(mux *http.ServeMux, checks map[string]Check) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("/readyz", ReadyHandler(checks))
+	mux.Handle("/metrics", promhttp.Handler())
+}
+
+// ReadyHandler 在 ReadyTimeout 内执行所有检查项，任意一项失败返回 503
+func ReadyHandler(checks map[string]Check) http.Handler {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), ReadyTimeout)
+		defer cancel()
+		status := http.StatusOK
+		result := make(map[string]string, len(names))
+		for _, name := range names {
+			if err := checks[name](ctx); err != nil {
+				status = http.StatusServiceUnavailable
+				result[name] = err.Error()
+				continue
+			}
+			result[name] = "ok"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "smart_wecom"
+
+var (
+	// IncomingMessages 接收到的企微消息数，按消息类型统计
+	IncomingMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "incoming_messages_total",
+		Help:      "Number of incoming WeCom messages by message type.",
+	}, []string{"type"})
+
+	// FilterRejections 被拦截器拒绝的消息数，按拦截原因统计
+	FilterRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "filter_rejections_total",
+		Help:      "Number of sessions rejected by filters by reason.",
+	}, []string{"reason"})
+
+	// SmartLatency smart 答复耗时
+	SmartLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "smart_latency_seconds",
+		Help:      "Time spent waiting for a smart to answer by smart ID.",
+		Buckets:   []float64{.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"smart_id"})
+
+	// SmartErrors smart 答复失败次数
+	SmartErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "smart_errors_total",
+		Help:      "Number of failed smart calls by smart ID.",
+	}, []string{"smart_id"})
+
+	// SmartTokens smart 消耗的 token 数，type 为 prompt 或 completion
+	SmartTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "smart_tokens_total",
+		Help:      "Number of tokens consumed by smart platform, model and type.",
+	}, []string{"platform", "model", "type"})
+
+	// Redactions 提问前脱敏的数据个数，按数据类型统计
+	Redactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redactions_total",
+		Help:      "Number of sensitive values redacted before asking a smart by kind.",
+	}, []string{"kind"})
+
+	// Routes 按意图分配 smart 的次数，method 为 rule、model 或 default
+	Routes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "routes_total",
+		Help:      "Number of questions routed to a smart by intent and method.",
+	}, []string{"intent", "method"})
+
+	// ScheduledJobs 执行的定时任务数，kind 为 reminder 或 prompt，result 为 success 或 failure
+	ScheduledJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduled_jobs_total",
+		Help:      "Number of scheduled jobs executed by kind and result.",
+	}, []string{"kind", "result"})
+
+	// WecomSendFailures 发送企微消息失败次数
+	WecomSendFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wecom_send_failures_total",
+		Help:      "Number of failed WeCom message sends.",
+	})
+)
+
+// RejectReason 取出拦截器错误中的拦截原因，无法识别时返回 other
+func RejectReason(err error) string {
+	var r interface{ Reason() string }
+	if errors.As(err, &r) {
+		return r.Reason()
+	}
+	return "other"
+}
@@ -0,0 +1,133 @@
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Provider 配置ID的类型，配置项：baseURL、model、systemPrompt
+const Provider = "ollama"
+
+// DefaultBaseURL Ollama 默认地址
+const DefaultBaseURL = "http://localhost:11434"
+
+// defaultTimeout 本地模型答复较慢，未使用 ctx 提问时的超时时间
+const defaultTimeout = 5 * time.Minute
+
+func init() {
+	sw.RegisterProvider(Provider, func(configure sc.Configure) (smart.Smart, error) {
+		model := sw.ConfigureString(configure, "model", "")
+		if model == "" {
+			return nil, errors.New("ollama model required")
+		}
+		ollama := NewOllama(sw.ConfigureString(configure, "baseURL", DefaultBaseURL), model)
+		ollama.SetSystemPrompt(sw.ConfigureString(configure, "systemPrompt", ""))
+		return ollama, nil
+	})
+}
+
+// Ollama 使用本地 Ollama 服务的 /api/chat 接口，不需要访问外网
+type Ollama struct {
+	smart.Smart
+
+	client  *http.Client
+	baseURL string
+	model   string
+	// systemPrompt smart 的系统提示，与用户的自定义说明合并后作为 system 消息
+	systemPrompt string
+}
+
+func NewOllama(baseURL string, model string) *Ollama {
+	return &Ollama{
+		client:  &http.Client{Timeout: defaultTimeout},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		model:   model,
+	}
+}
+
+// SetSystemPrompt 设置 smart 的系统提示
+func (ollama *Ollama) SetSystemPrompt(prompt string) {
+	ollama.systemPrompt = strings.TrimSpace(prompt)
+}
+
+func (ollama *Ollama) Platform() string {
+	return "Ollama"
+}
+
+func (ollama *Ollama) Ask(q sc.Question) (sc.Answer, error) {
+	return ollama.AskContext(context.Background(), q)
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+}
+
+type chatResponse struct {
+	Model           string      `json:"model"`
+	Message         chatMessage `json:"message"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+	Error           string      `json:"error"`
+}
+
+// AskContext 提问，ctx 超时或取消时中止请求
+func (ollama *Ollama) AskContext(ctx context.Context, q sc.Question) (sc.Answer, error) {
+	messages := sw.ChatMessages(ollama.systemPrompt, q)
+	req := chatRequest{Model: ollama.model, Messages: make([]chatMessage, 0, len(messages))}
+	for i := range messages {
+		req.Messages = append(req.Messages, chatMessage{Role: string(messages[i].Role), Content: messages[i].Content})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ollama.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := ollama.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var resp chatResponse
+	if err = json.Unmarshal(respBody, &resp); err != nil {
+		return nil, errors.New(fmt.Sprintf("ollama status %d, %s", httpResp.StatusCode, err.Error()))
+	}
+	if httpResp.StatusCode != http.StatusOK || resp.Error != "" {
+		return nil, errors.New(fmt.Sprintf("ollama status %d, %s", httpResp.StatusCode, resp.Error))
+	}
+
+	monitor.SmartTokens.WithLabelValues(ollama.Platform(), resp.Model, "prompt").Add(float64(resp.PromptEvalCount))
+	monitor.SmartTokens.WithLabelValues(ollama.Platform(), resp.Model, "completion").Add(float64(resp.EvalCount))
+	return resp.Message.Content, nil
+}
+
+func (ollama *Ollama) Balance() (float32, error) {
+	return 0, nil
+}
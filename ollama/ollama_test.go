@@ -0,0 +1,68 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAskContext(t *testing.T) {
+	var req chatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/chat" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request %s", err.Error())
+		}
+		_, _ = w.Write([]byte(`{"model":"qwen2","message":{"role":"assistant","content":"你好"},"prompt_eval_count":3,"eval_count":2}`))
+	}))
+	defer server.Close()
+
+	ollama := NewOllama(server.URL+"/", "qwen2")
+	ollama.SetSystemPrompt("你是助手")
+	answer, err := ollama.AskContext(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "你好" {
+		t.Errorf("answer = %v, want 你好", answer)
+	}
+	if req.Model != "qwen2" || req.Stream {
+		t.Errorf("model = %s, stream = %v", req.Model, req.Stream)
+	}
+	if len(req.Messages) != 2 || req.Messages[0].Role != "system" || req.Messages[0].Content != "你是助手" ||
+		req.Messages[1].Role != "user" || req.Messages[1].Content != "hello" {
+		t.Errorf("messages = %+v", req.Messages)
+	}
+}
+
+func TestAskContextError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"status", http.StatusInternalServerError, `{}`, "ollama status 500"},
+		{"error field", http.StatusOK, `{"error":"model not found"}`, "model not found"},
+		{"not json", http.StatusBadGateway, `bad gateway`, "ollama status 502"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := NewOllama(server.URL, "qwen2").AskContext(context.Background(), "hello")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
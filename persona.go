@@ -0,0 +1,66 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"strings"
+)
+
+// MaxInstructionsLength 自定义说明的最大字数
+const MaxInstructionsLength = 1000
+
+// PersonaPresets 预置的自定义说明，设置时可以直接使用名称
+var PersonaPresets = map[string]string{
+	"concise":  "Answer in concise English. Use short sentences and bullet points, no more than 150 words.",
+	"detailed": "请使用中文详细回答，先给出结论，再分点说明原因、步骤与注意事项。",
+	"code":     "Reply with code only, no explanations. Use comments in the code when clarification is needed.",
+}
+
+// ResolveInstructions 预置名称转换为对应的自定义说明，并检查长度
+func ResolveInstructions(instructions string) (string, error) {
+	instructions = strings.TrimSpace(instructions)
+	if preset, ok := PersonaPresets[strings.ToLower(instructions)]; ok {
+		return preset, nil
+	}
+	if n := len([]rune(instructions)); n > MaxInstructionsLength {
+		return "", errors.New(fmt.Sprintf("instructions too long, %d > %d", n, MaxInstructionsLength))
+	}
+	return instructions, nil
+}
+
+// PersonaCache 用户自定义说明存储，提问时与 smart 的系统提示合并
+type PersonaCache interface {
+	// UserInstructions 用户的自定义说明，未设置时为空
+	UserInstructions(userUID sc.UserUID) (string, error)
+
+	// UserInstructionsStore 设置用户的自定义说明，为空时删除
+	UserInstructionsStore(userUID sc.UserUID, instructions string) error
+}
+
+func (r Redis) UserInstructions(userUID sc.UserUID) (string, error) {
+	// key -> user:instructions:[userUID] => string
+	result, err := r.client.Get(r.ctx, fmt.Sprintf("user:instructions:%s", userUID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return result, err
+}
+
+func (r Redis) UserInstructionsStore(userUID sc.UserUID, instructions string) error {
+	// key -> user:instructions:[userUID] => string
+	before, err := r.UserInstructions(userUID)
+	if err != nil {
+		return err
+	}
+	if instructions == "" {
+		err = r.client.Del(r.ctx, fmt.Sprintf("user:instructions:%s", userUID)).Err()
+	} else {
+		err = r.client.Set(r.ctx, fmt.Sprintf("user:instructions:%s", userUID), instructions, 0).Err()
+	}
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntityInstructions, string(userUID), "store", before, instructions)
+}
@@ -0,0 +1,279 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"sort"
+	"strconv"
+)
+
+// PolicySubject 授权策略的对象类型
+type PolicySubject int
+
+const (
+	// PolicySubjectDept 企微部门
+	PolicySubjectDept PolicySubject = iota
+	// PolicySubjectTag 企微标签
+	PolicySubjectTag
+)
+
+// Policy 按部门或标签授权 smart 的策略
+type Policy struct {
+	ID      string
+	Subject PolicySubject
+	// SubjectID 部门ID或标签ID
+	SubjectID int64
+	// IncludeChildren 部门策略是否包含子部门
+	IncludeChildren bool
+	SmartIDs        []string
+}
+
+// PolicyCache 授权策略与部门层级存储
+type PolicyCache interface {
+	// Policies 所有授权策略
+	Policies() ([]Policy, error)
+
+	// PolicyStore 保存授权策略，ID 相同时覆盖
+	PolicyStore(*Policy) error
+
+	// PolicyDelete 删除授权策略
+	PolicyDelete(id string) error
+
+	// DeptParents 部门ID与上级部门ID
+	DeptParents() (map[int64]int64, error)
+
+	// DeptParentsStore 保存部门层级，覆盖原有数据
+	DeptParentsStore(parents map[int64]int64) error
+}
+
+func (r Redis) Policies() ([]Policy, error) {
+	// key -> policy => hash(ID, Policy)
+	result, err := r.client.HGetAll(r.ctx, "policy").Result()
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]Policy, 0, len(result))
+	for _, value := range result {
+		var policy Policy
+		if err = msgpack.Unmarshal([]byte(value), &policy); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ID < policies[j].ID })
+	return policies, nil
+}
+
+func (r Redis) PolicyStore(policy *Policy) error {
+	// key -> policy => hash(ID, Policy)
+	before, err := r.policy(policy.ID)
+	if err != nil {
+		return err
+	}
+	policyPack, err := msgpack.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if err = r.client.HSet(r.ctx, "policy", policy.ID, policyPack).Err(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityPolicy, policy.ID, "store", before, policy)
+}
+
+func (r Redis) PolicyDelete(id string) error {
+	// key -> policy => hash(ID, Policy)
+	before, err := r.policy(id)
+	if err != nil {
+		return err
+	}
+	if err = r.client.HDel(r.ctx, "policy", id).Err(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityPolicy, id, "delete", before, nil)
+}
+
+// policy 单个策略，不存在时返回 nil
+func (r Redis) policy(id string) (*Policy, error) {
+	// key -> policy => hash(ID, Policy)
+	result, err := r.client.HGet(r.ctx, "policy", id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err = msgpack.Unmarshal([]byte(result), policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (r Redis) DeptParents() (map[int64]int64, error) {
+	// key -> dept:parent => hash(deptID, parentID)
+	result, err := r.client.HGetAll(r.ctx, "dept:parent").Result()
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int64]int64, len(result))
+	for dept, parent := range result {
+		deptID, err := strconv.ParseInt(dept, 10, 64)
+		if err != nil {
+			continue
+		}
+		parentID, err := strconv.ParseInt(parent, 10, 64)
+		if err != nil {
+			continue
+		}
+		parents[deptID] = parentID
+	}
+	return parents, nil
+}
+
+func (r Redis) DeptParentsStore(parents map[int64]int64) error {
+	// key -> dept:parent => hash(deptID, parentID)
+	values := make(map[string]any, len(parents))
+	for deptID, parentID := range parents {
+		values[strconv.FormatInt(deptID, 10)] = parentID
+	}
+	pipe := r.client.TxPipeline()
+	pipe.Del(r.ctx, "dept:parent")
+	if len(values) > 0 {
+		pipe.HSet(r.ctx, "dept:parent", values)
+	}
+	_, err := pipe.Exec(r.ctx)
+	return err
+}
+
+// inDept deptID 是否为 subjectID 或其子部门
+func inDept(deptID int64, subjectID int64, parents map[int64]int64, includeChildren bool) bool {
+	if deptID == subjectID {
+		return true
+	}
+	if !includeChildren {
+		return false
+	}
+	// 部门层级有限，避免错误数据导致死循环
+	for i := 0; i < 64; i++ {
+		parentID, ok := parents[deptID]
+		if !ok || parentID == deptID {
+			return false
+		}
+		if parentID == subjectID {
+			return true
+		}
+		deptID = parentID
+	}
+	return false
+}
+
+// Match 用户是否符合策略
+func (policy *Policy) Match(profile *UserProfile, parents map[int64]int64) bool {
+	switch policy.Subject {
+	case PolicySubjectDept:
+		for i := range profile.DeptIDs {
+			if inDept(profile.DeptIDs[i], policy.SubjectID, parents, policy.IncludeChildren) {
+				return true
+			}
+		}
+	case PolicySubjectTag:
+		for i := range profile.TagIDs {
+			if profile.TagIDs[i] == policy.SubjectID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PolicySmarts 策略授予用户的 smart，cache 不支持策略或用户没有通讯录信息时返回空
+func PolicySmarts(cache sc.Cache, userUID sc.UserUID) ([]string, error) {
+	policyCache, ok := cache.(PolicyCache)
+	if !ok {
+		return nil, nil
+	}
+	profileCache, ok := cache.(UserProfileCache)
+	if !ok {
+		return nil, nil
+	}
+
+	policies, err := policyCache.Policies()
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+	profile, err := profileCache.UserProfile(userUID)
+	if err != nil || profile == nil {
+		return nil, err
+	}
+	parents, err := policyCache.DeptParents()
+	if err != nil {
+		return nil, err
+	}
+
+	var smartIDs []string
+	seen := make(map[string]bool)
+	for i := range policies {
+		if !policies[i].Match(profile, parents) {
+			continue
+		}
+		for _, smartID := range policies[i].SmartIDs {
+			if !seen[smartID] {
+				seen[smartID] = true
+				smartIDs = append(smartIDs, smartID)
+			}
+		}
+	}
+	return smartIDs, nil
+}
+
+// SmartAllowed 用户是否可以使用 smart，包括直接授权与策略授权
+func SmartAllowed(cache sc.Cache, userUID sc.UserUID, smartID string) (bool, error) {
+	smartIDs, err := cache.UserSmartUIDs(userUID)
+	if err != nil {
+		return false, err
+	}
+	for i := range smartIDs {
+		if smartIDs[i] == smartID {
+			return true, nil
+		}
+	}
+
+	smartIDs, err = PolicySmarts(cache, userUID)
+	if err != nil {
+		return false, err
+	}
+	for i := range smartIDs {
+		if smartIDs[i] == smartID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// policyID 默认的策略ID
+func policyID(subject PolicySubject, subjectID int64) string {
+	return fmt.Sprintf("%d:%d", subject, subjectID)
+}
+
+// NewDeptPolicy 部门授权策略，includeChildren 为 true 时包含子部门
+func NewDeptPolicy(deptID int64, includeChildren bool, smartIDs ...string) *Policy {
+	return &Policy{
+		ID:              policyID(PolicySubjectDept, deptID),
+		Subject:         PolicySubjectDept,
+		SubjectID:       deptID,
+		IncludeChildren: includeChildren,
+		SmartIDs:        smartIDs,
+	}
+}
+
+// NewTagPolicy 标签授权策略
+func NewTagPolicy(tagID int64, smartIDs ...string) *Policy {
+	return &Policy{
+		ID:        policyID(PolicySubjectTag, tagID),
+		Subject:   PolicySubjectTag,
+		SubjectID: tagID,
+		SmartIDs:  smartIDs,
+	}
+}
@@ -0,0 +1,104 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"strings"
+	"time"
+)
+
+// UserProfile 用户在企微通讯录中的信息，由通讯录同步维护
+type UserProfile struct {
+	// UserID 企微用户ID
+	UserID string
+	// DeptIDs 所属部门
+	DeptIDs []int64
+	// Title 职务
+	Title string
+	// TagIDs 所属标签，包括通过部门加入的标签
+	TagIDs []int64
+}
+
+// UserProfileCache 用户通讯录信息存储
+type UserProfileCache interface {
+	// UserProfile 用户通讯录信息，不存在时返回 nil
+	UserProfile(userUID sc.UserUID) (*UserProfile, error)
+
+	// UserProfileStore 保存用户通讯录信息
+	UserProfileStore(userUID sc.UserUID, profile *UserProfile) error
+
+	// UserBindings 以 prefix 开头的平台用户ID与 UserUID 的绑定，如 prefix 为 wecom: 时返回所有企微用户
+	UserBindings(prefix string) (map[string]sc.UserUID, error)
+}
+
+func (r Redis) UserProfile(userUID sc.UserUID) (profile *UserProfile, err error) {
+	// key -> user:profile:[userUID] => UserProfile
+	result, err := r.client.Get(r.ctx, fmt.Sprintf("user:profile:%s", userUID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile = &UserProfile{}
+	if err = msgpack.Unmarshal([]byte(result), profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (r Redis) UserProfileStore(userUID sc.UserUID, profile *UserProfile) error {
+	// key -> user:profile:[userUID] => UserProfile
+	before, err := r.UserProfile(userUID)
+	if err != nil {
+		return err
+	}
+	profilePack, err := msgpack.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	if err = r.client.Set(r.ctx, fmt.Sprintf("user:profile:%s", userUID), profilePack, 0).Err(); err != nil {
+		return err
+	}
+	return r.audit(AuditEntityProfile, string(userUID), "store", before, profile)
+}
+
+func (r Redis) UserBindings(prefix string) (map[string]sc.UserUID, error) {
+	// key -> user:uid:[userID] => UserUID
+	bindings := make(map[string]sc.UserUID)
+	iter := r.client.Scan(r.ctx, 0, fmt.Sprintf("user:uid:%s*", prefix), 100).Iterator()
+	for iter.Next(r.ctx) {
+		key := iter.Val()
+		userUID, err := r.client.Get(r.ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bindings[strings.TrimPrefix(key, "user:uid:")] = sc.UserUID(userUID)
+	}
+	return bindings, iter.Err()
+}
+
+// ProfileSyncCache 通讯录同步锁，多个实例定时同步时只有持有锁的实例执行
+type ProfileSyncCache interface {
+	// ProfileSyncLock 获取 ttl 内有效的锁，owner 已持有时续期，其它实例持有时返回 false
+	ProfileSyncLock(owner string, ttl time.Duration) (bool, error)
+
+	// ProfileSyncUnlock 释放 owner 持有的锁
+	ProfileSyncUnlock(owner string) error
+}
+
+func (r Redis) ProfileSyncLock(owner string, ttl time.Duration) (bool, error) {
+	// key -> user:profile:lock => owner
+	locked, err := scheduleLockScript.Run(r.ctx, r.client, []string{"user:profile:lock"},
+		owner, ttl.Milliseconds()).Int()
+	return locked == 1, err
+}
+
+func (r Redis) ProfileSyncUnlock(owner string) error {
+	return scheduleUnlockScript.Run(r.ctx, r.client, []string{"user:profile:lock"}, owner).Err()
+}
@@ -0,0 +1,87 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SmartFactory 根据配置创建 smart
+type SmartFactory func(configure sc.Configure) (smart.Smart, error)
+
+var (
+	providerMu sync.RWMutex
+	providers  = make(map[string]SmartFactory)
+)
+
+// RegisterProvider 注册 smart 提供方，kind 为配置ID的类型，如 chatgpt、ollama
+// 提供方一般在包的 init 中注册，重复注册时覆盖
+func RegisterProvider(kind string, factory SmartFactory) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	providers[kind] = factory
+}
+
+// Providers 已注册的提供方类型
+func Providers() []string {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	kinds := make([]string, 0, len(providers))
+	for kind := range providers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// ConfigureKind 配置ID的类型，即第一个 : 之前的部分，如 ollama:xxx 的类型为 ollama
+func ConfigureKind(configureID string) string {
+	kind, _, _ := strings.Cut(configureID, ":")
+	return kind
+}
+
+// NewSmart 按配置ID的类型使用对应的提供方创建 smart
+func NewSmart(configureID string, configure sc.Configure) (smart.Smart, error) {
+	if configure == nil {
+		return nil, errors.New(fmt.Sprintf("configure [%s] not found", configureID))
+	}
+	kind := ConfigureKind(configureID)
+	providerMu.RLock()
+	factory, ok := providers[kind]
+	providerMu.RUnlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown smart provider [%s], registered %v", kind, Providers()))
+	}
+	return factory(configure)
+}
+
+// SmartConfigured 检查 smartID 的配置存在且类型为已注册的提供方，用于授权前校验
+func SmartConfigured(cache sc.Cache, smartID string) error {
+	kind := ConfigureKind(smartID)
+	providerMu.RLock()
+	_, ok := providers[kind]
+	providerMu.RUnlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("smart [%s] unknown provider [%s]", smartID, kind))
+	}
+	configure, err := cache.Configure(smartID)
+	if err != nil {
+		return err
+	}
+	if configure == nil {
+		return errors.New(fmt.Sprintf("smart [%s] not found", smartID))
+	}
+	return nil
+}
+
+// ConfigureString 字符串配置项，不存在或为空时返回 def
+func ConfigureString(configure sc.Configure, key string, def string) string {
+	if v, ok := configure[key].(string); ok && v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,225 @@
+package smart_wecom
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 脱敏的数据类型，同时作为占位符的前缀
+const (
+	RedactPhone    = "PHONE"
+	RedactIDCard   = "IDCARD"
+	RedactEmail    = "EMAIL"
+	RedactBankCard = "BANKCARD"
+	RedactKeyword  = "KEYWORD"
+	RedactCustom   = "CUSTOM"
+)
+
+var (
+	emailPattern    = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	idCardPattern   = regexp.MustCompile(`\b\d{17}[\dXx]\b`)
+	bankCardPattern = regexp.MustCompile(`\b\d{4}(?:[ -]?\d{4}){2}[ -]?\d{4,7}\b`)
+	phonePattern    = regexp.MustCompile(`\+?\b(?:86[ -]?)?1[3-9]\d{9}\b`)
+)
+
+// Redactor 向 smart 提问前替换敏感数据，答复中的占位符可以还原为原始数据
+type Redactor struct {
+	rules []redactRule
+	// restore 是否在答复中还原占位符
+	restore bool
+}
+
+type redactRule struct {
+	kind    string
+	pattern *regexp.Regexp
+	// valid 为空时所有匹配都脱敏
+	valid func(string) bool
+}
+
+// NewRedactor 创建脱敏器，默认识别手机号、身份证号、邮箱与银行卡号
+// keywords 为需要脱敏的关键字，如客户名称；patterns 为自定义正则表达式
+func NewRedactor(keywords []string, patterns ...string) (*Redactor, error) {
+	redactor := &Redactor{
+		rules: []redactRule{
+			{kind: RedactEmail, pattern: emailPattern},
+			{kind: RedactIDCard, pattern: idCardPattern, valid: validIDCard},
+			{kind: RedactBankCard, pattern: bankCardPattern, valid: validBankCard},
+			{kind: RedactPhone, pattern: phonePattern},
+		},
+		restore: true,
+	}
+
+	if len(keywords) > 0 {
+		quoted := make([]string, 0, len(keywords))
+		for i := range keywords {
+			if keyword := strings.TrimSpace(keywords[i]); keyword != "" {
+				quoted = append(quoted, regexp.QuoteMeta(keyword))
+			}
+		}
+		// 较长的关键字优先匹配
+		sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+		if len(quoted) > 0 {
+			redactor.rules = append(redactor.rules,
+				redactRule{kind: RedactKeyword, pattern: regexp.MustCompile(strings.Join(quoted, "|"))})
+		}
+	}
+	for i := range patterns {
+		pattern, err := regexp.Compile(patterns[i])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid redact pattern [%s], %s", patterns[i], err.Error()))
+		}
+		redactor.rules = append(redactor.rules, redactRule{kind: RedactCustom, pattern: pattern})
+	}
+	return redactor, nil
+}
+
+// SetRestore 设置是否在答复中还原占位符，默认还原
+func (redactor *Redactor) SetRestore(restore bool) {
+	redactor.restore = restore
+}
+
+// Redaction 一次提问的脱敏结果，同一原始数据使用同一个占位符
+type Redaction struct {
+	redactor     *Redactor
+	restore      bool
+	placeholders map[string]string
+	originals    map[string]string
+	// Counts 各类型脱敏的数据个数
+	Counts map[string]int
+}
+
+// Total 脱敏的数据总数
+func (redaction *Redaction) Total() int {
+	total := 0
+	for _, count := range redaction.Counts {
+		total += count
+	}
+	return total
+}
+
+// Redact 脱敏提问，Conversation 的上下文同时脱敏
+func (redactor *Redactor) Redact(question sc.Question) (sc.Question, *Redaction) {
+	redaction := &Redaction{
+		redactor:     redactor,
+		restore:      redactor.restore,
+		placeholders: make(map[string]string),
+		originals:    make(map[string]string),
+		Counts:       make(map[string]int),
+	}
+
+	var conversation Conversation
+	switch v := question.(type) {
+	case string:
+		return redactor.redactText(v, redaction), redaction
+	case Conversation:
+		conversation = v
+	case *Conversation:
+		conversation = *v
+	default:
+		return question, redaction
+	}
+
+	history := make([]Message, len(conversation.History))
+	for i := range conversation.History {
+		history[i] = Message{
+			Role:    conversation.History[i].Role,
+			Content: redactor.redactText(conversation.History[i].Content, redaction),
+		}
+	}
+	return Conversation{
+		History:      history,
+		Question:     redactor.redactText(conversation.Question, redaction),
+		Instructions: redactor.redactText(conversation.Instructions, redaction),
+	}, redaction
+}
+
+func (redactor *Redactor) redactText(text string, redaction *Redaction) string {
+	for _, rule := range redactor.rules {
+		text = rule.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.valid != nil && !rule.valid(match) {
+				return match
+			}
+			return redaction.placeholder(rule.kind, match)
+		})
+	}
+	return text
+}
+
+func (redaction *Redaction) placeholder(kind string, original string) string {
+	if placeholder, ok := redaction.placeholders[original]; ok {
+		return placeholder
+	}
+	redaction.Counts[kind]++
+	placeholder := fmt.Sprintf("[%s_%d]", kind, redaction.Counts[kind])
+	redaction.placeholders[original] = placeholder
+	redaction.originals[placeholder] = original
+	return placeholder
+}
+
+// Redact 使用同一组占位符脱敏提问之后的内容，如返回给 smart 的工具结果
+func (redaction *Redaction) Redact(text string) string {
+	if redaction.redactor == nil {
+		return text
+	}
+	return redaction.redactor.redactText(text, redaction)
+}
+
+type redactionKey struct{}
+
+// WithRedaction 返回带有本次提问脱敏结果的 ctx，工具结果使用同一组占位符脱敏
+func WithRedaction(ctx context.Context, redaction *Redaction) context.Context {
+	return context.WithValue(ctx, redactionKey{}, redaction)
+}
+
+// RedactionFromContext ctx 中的脱敏结果，未开启脱敏时返回 nil
+func RedactionFromContext(ctx context.Context) *Redaction {
+	redaction, _ := ctx.Value(redactionKey{}).(*Redaction)
+	return redaction
+}
+
+// Restore 将答复中的占位符还原为原始数据，脱敏器设置为不还原时原样返回
+func (redaction *Redaction) Restore(answer string) string {
+	if !redaction.restore || len(redaction.originals) == 0 {
+		return answer
+	}
+	pairs := make([]string, 0, len(redaction.originals)*2)
+	for placeholder, original := range redaction.originals {
+		pairs = append(pairs, placeholder, original)
+	}
+	return strings.NewReplacer(pairs...).Replace(answer)
+}
+
+// validIDCard 校验18位身份证号的校验码
+func validIDCard(id string) bool {
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i := range weights {
+		sum += int(id[i]-'0') * weights[i]
+	}
+	return "10X98765432"[sum%11] == strings.ToUpper(id[17:])[0]
+}
+
+// validBankCard 使用 Luhn 算法校验银行卡号
+func validBankCard(card string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(card)
+	if len(digits) < 16 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
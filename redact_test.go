@@ -0,0 +1,130 @@
+package smart_wecom
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidIDCard(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"11010519491231002X", true},
+		{"11010519491231002x", true},
+		{"110105194912310021", false},
+		{"440308199901011235", false},
+	}
+	for _, tt := range tests {
+		if got := validIDCard(tt.id); got != tt.want {
+			t.Errorf("validIDCard(%s) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestValidBankCard(t *testing.T) {
+	tests := []struct {
+		card string
+		want bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"6212345678901234566", false},
+		{"4111111111111112", false},
+		{"411111111111", false},
+	}
+	for _, tt := range tests {
+		if got := validBankCard(tt.card); got != tt.want {
+			t.Errorf("validBankCard(%s) = %v, want %v", tt.card, got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	redactor, err := NewRedactor([]string{"星河科技", "星河"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"chinese around phone", "电话13800138000找张三", "电话[PHONE_1]找张三"},
+		{"country code", "打+86 13800138000", "打[PHONE_1]"},
+		{"id card", "身份证11010519491231002X请核对", "身份证[IDCARD_1]请核对"},
+		{"invalid id card kept", "编号110105194912310021", "编号110105194912310021"},
+		{"bank card", "卡号4111 1111 1111 1111已冻结", "卡号[BANKCARD_1]已冻结"},
+		{"invalid bank card kept", "单号4111111111111112", "单号4111111111111112"},
+		{"email", "发到zhang.san@example.com。", "发到[EMAIL_1]。"},
+		{"longer keyword first", "星河科技与星河", "[KEYWORD_1]与[KEYWORD_2]"},
+		{"numbering per kind", "13800138000和13900139000，a@b.cn",
+			"[PHONE_1]和[PHONE_2]，[EMAIL_1]"},
+		{"same value same placeholder", "13800138000，再打一次13800138000", "[PHONE_1]，再打一次[PHONE_1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			question, redaction := redactor.Redact(tt.text)
+			if question != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.text, question, tt.want)
+			}
+			if restored := redaction.Restore(question.(string)); restored != tt.text {
+				t.Errorf("Restore(%q) = %q, want %q", question, restored, tt.text)
+			}
+		})
+	}
+}
+
+func TestRedactConversation(t *testing.T) {
+	redactor, err := NewRedactor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	question, redaction := redactor.Redact(&Conversation{
+		History:      []Message{{Role: MessageRoleUser, Content: "我的电话是13800138000"}},
+		Question:     "把13800138000发给a@b.cn",
+		Instructions: "称呼我为13900139000",
+	})
+	conversation := question.(Conversation)
+	if conversation.History[0].Content != "我的电话是[PHONE_1]" {
+		t.Errorf("history = %q", conversation.History[0].Content)
+	}
+	if conversation.Question != "把[PHONE_1]发给[EMAIL_1]" {
+		t.Errorf("question = %q", conversation.Question)
+	}
+	if conversation.Instructions != "称呼我为[PHONE_2]" {
+		t.Errorf("instructions = %q", conversation.Instructions)
+	}
+	if redaction.Total() != 3 || redaction.Counts[RedactPhone] != 2 {
+		t.Errorf("counts = %v", redaction.Counts)
+	}
+
+	// 工具结果沿用提问的占位符，新数据继续编号
+	ctx := WithRedaction(context.Background(), redaction)
+	if result := RedactionFromContext(ctx).Redact("13800138000 与 13700137000"); result != "[PHONE_1] 与 [PHONE_3]" {
+		t.Errorf("tool result = %q", result)
+	}
+	if answer := redaction.Restore("已发送给[PHONE_1]和[PHONE_3]"); answer != "已发送给13800138000和13700137000" {
+		t.Errorf("answer = %q", answer)
+	}
+}
+
+func TestRedactWithoutRestore(t *testing.T) {
+	redactor, err := NewRedactor(nil, `订单\d{6}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor.SetRestore(false)
+	question, redaction := redactor.Redact("查询订单123456")
+	if question != "查询[CUSTOM_1]" {
+		t.Errorf("question = %q", question)
+	}
+	if answer := redaction.Restore("[CUSTOM_1]已发货"); answer != "[CUSTOM_1]已发货" {
+		t.Errorf("answer = %q", answer)
+	}
+
+	if _, err = NewRedactor(nil, `(`); err == nil {
+		t.Error("invalid pattern expected error")
+	}
+}
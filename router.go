@@ -0,0 +1,222 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分配 smart 的方式
+const (
+	RouteMethodRule    = "rule"
+	RouteMethodModel   = "model"
+	RouteMethodDefault = "default"
+)
+
+// IntentDefault 未识别出意图时使用的意图名称
+const IntentDefault = "default"
+
+// Intent 提问的意图及处理该意图的 smart
+type Intent struct {
+	// Name 意图名称，如 code、translation、hr、chat
+	Name string
+	// Description 意图说明，用于模型分类
+	Description string
+	SmartID     string
+	// Keywords 与 Patterns 命中任一时按规则分配，不需要模型分类
+	Keywords []string
+	Patterns []string
+}
+
+type intentRule struct {
+	intent  *Intent
+	pattern *regexp.Regexp
+}
+
+// Router 按提问的意图分配 smart，依次使用关键字与正则规则、分类模型，都未识别时使用默认 smart
+type Router struct {
+	intents []Intent
+	rules   []intentRule
+
+	defaultSmartID string
+	// classifier 分类模型使用的 smart，为空时只使用规则
+	classifier string
+}
+
+// NewRouter 创建意图路由，规则按 intents 的顺序匹配
+func NewRouter(defaultSmartID string, intents ...Intent) (*Router, error) {
+	router := &Router{intents: intents, defaultSmartID: defaultSmartID}
+	for i := range router.intents {
+		intent := &router.intents[i]
+		if intent.Name == "" || intent.SmartID == "" {
+			return nil, errors.New(fmt.Sprintf("intent [%d] name and smart required", i))
+		}
+		alternatives := make([]string, 0, len(intent.Keywords)+len(intent.Patterns))
+		for j := range intent.Keywords {
+			if keyword := strings.TrimSpace(intent.Keywords[j]); keyword != "" {
+				alternatives = append(alternatives, "(?i:"+regexp.QuoteMeta(keyword)+")")
+			}
+		}
+		for j := range intent.Patterns {
+			if _, err := regexp.Compile(intent.Patterns[j]); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid intent [%s] pattern [%s], %s",
+					intent.Name, intent.Patterns[j], err.Error()))
+			}
+			alternatives = append(alternatives, fmt.Sprintf("(?:%s)", intent.Patterns[j]))
+		}
+		if len(alternatives) > 0 {
+			router.rules = append(router.rules, intentRule{
+				intent:  intent,
+				pattern: regexp.MustCompile(strings.Join(alternatives, "|")),
+			})
+		}
+	}
+	return router, nil
+}
+
+// SetClassifier 设置规则未命中时用于分类的 smart，建议使用响应快、成本低的模型
+func (router *Router) SetClassifier(smartID string) {
+	router.classifier = smartID
+}
+
+// Classifier 分类模型使用的 smart，未设置时为空
+func (router *Router) Classifier() string {
+	return router.classifier
+}
+
+// SmartIDs 路由可能使用的所有 smart
+func (router *Router) SmartIDs() []string {
+	smartIDs := make([]string, 0, len(router.intents)+2)
+	for i := range router.intents {
+		smartIDs = append(smartIDs, router.intents[i].SmartID)
+	}
+	if router.defaultSmartID != "" {
+		smartIDs = append(smartIDs, router.defaultSmartID)
+	}
+	if router.classifier != "" {
+		smartIDs = append(smartIDs, router.classifier)
+	}
+	return smartIDs
+}
+
+// MatchRule 按规则识别意图，未命中时返回 nil
+func (router *Router) MatchRule(question string) (*Intent, string) {
+	for i := range router.rules {
+		if matched := router.rules[i].pattern.FindString(question); matched != "" {
+			return router.rules[i].intent, matched
+		}
+	}
+	return nil, ""
+}
+
+// ClassifyPrompt 分类模型的提问
+func (router *Router) ClassifyPrompt(question string) string {
+	lines := make([]string, 0, len(router.intents))
+	for i := range router.intents {
+		description := router.intents[i].Description
+		if description == "" {
+			description = router.intents[i].Name
+		}
+		lines = append(lines, fmt.Sprintf("- %s：%s", router.intents[i].Name, description))
+	}
+	return fmt.Sprintf("请判断下面的问题属于哪一类，只回答类别名称，都不属于时回答 %s。\n类别：\n%s\n\n问题：\n%s",
+		IntentDefault, strings.Join(lines, "\n"), question)
+}
+
+// ParseClassification 从分类模型的答复中取出意图，未识别时返回 nil
+func (router *Router) ParseClassification(answer string) *Intent {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	// 优先完全匹配，否则使用答复中最先出现的意图名称
+	var found *Intent
+	position := len(answer)
+	for i := range router.intents {
+		name := strings.ToLower(router.intents[i].Name)
+		if answer == name {
+			return &router.intents[i]
+		}
+		if index := strings.Index(answer, name); index >= 0 && index < position {
+			found, position = &router.intents[i], index
+		}
+	}
+	return found
+}
+
+// Decide 生成分配结果，intent 为空时使用默认 smart
+func (router *Router) Decide(intent *Intent, method string, matched string) *RouteDecision {
+	decision := &RouteDecision{
+		Time:    time.Now(),
+		Intent:  IntentDefault,
+		SmartID: router.defaultSmartID,
+		Method:  RouteMethodDefault,
+	}
+	if intent != nil {
+		decision.Intent, decision.SmartID, decision.Method, decision.Matched = intent.Name, intent.SmartID, method, matched
+	}
+	return decision
+}
+
+// DefaultSmartID 未识别出意图时使用的 smart
+func (router *Router) DefaultSmartID() string {
+	return router.defaultSmartID
+}
+
+// RouteDecision 一次提问的分配结果，用于分析路由效果
+type RouteDecision struct {
+	Time      time.Time
+	SessionID sc.SessionID
+	UserUID   sc.UserUID
+	Intent    string
+	SmartID   string
+	Method    string
+	// Matched 命中的关键字或分类模型的答复
+	Matched string
+	// FallbackSmartID 分配的 smart 被拦截时实际使用的默认 smart
+	FallbackSmartID string
+}
+
+// RouteCache 分配结果存储
+type RouteCache interface {
+	// RouteStore 保存分配结果
+	RouteStore(decision *RouteDecision) error
+
+	// Routes 时间在 [start, end] 内的分配结果
+	Routes(start time.Time, end time.Time) ([]RouteDecision, error)
+}
+
+func (r Redis) RouteStore(decision *RouteDecision) error {
+	// key -> route:time => zset(RouteDecision, Time)
+	decisionPack, err := msgpack.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	return r.client.ZAdd(r.ctx, "route:time", redis.Z{
+		Score:  float64(decision.Time.UnixNano()),
+		Member: decisionPack,
+	}).Err()
+}
+
+func (r Redis) Routes(start time.Time, end time.Time) ([]RouteDecision, error) {
+	// key -> route:time => zset(RouteDecision, Time)
+	result, err := r.client.ZRangeByScore(r.ctx, "route:time", &redis.ZRangeBy{
+		Min: strconv.FormatInt(start.UnixNano(), 10),
+		Max: strconv.FormatInt(end.UnixNano(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	decisions := make([]RouteDecision, 0, len(result))
+	for i := range result {
+		var decision RouteDecision
+		if err = msgpack.Unmarshal([]byte(result[i]), &decision); err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
@@ -0,0 +1,359 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleKind 定时任务类型
+type ScheduleKind string
+
+const (
+	// ScheduleKindReminder 到期时直接发送 Content
+	ScheduleKindReminder ScheduleKind = "reminder"
+	// ScheduleKindPrompt 到期时以 Content 向 SmartID 提问并发送答复
+	ScheduleKindPrompt ScheduleKind = "prompt"
+)
+
+// ScheduleJob 定时任务，Cron 为空时只执行一次
+type ScheduleJob struct {
+	ID   string
+	Kind ScheduleKind
+	// Creator 创建人，如 wecom:zhangsan，系统创建时为 system
+	Creator string
+	// UserIDs 接收消息的企微用户ID
+	UserIDs []string
+	Content string
+	// SmartID Kind 为 prompt 时提问的 smart
+	SmartID string
+	// Cron 周期执行的 cron 表达式：分 时 日 月 周
+	Cron string
+	// Next 下次执行时间
+	Next    time.Time
+	Created time.Time
+}
+
+// Recurring 是否周期执行
+func (job *ScheduleJob) Recurring() bool {
+	return job.Cron != ""
+}
+
+// Reschedule 计算 after 之后的下次执行时间，只执行一次的任务返回 false
+func (job *ScheduleJob) Reschedule(after time.Time) (bool, error) {
+	if !job.Recurring() {
+		return false, nil
+	}
+	cron, err := ParseCron(job.Cron)
+	if err != nil {
+		return false, err
+	}
+	job.Next = cron.Next(after)
+	return !job.Next.IsZero(), nil
+}
+
+// cronField cron 表达式中一个字段的取值范围
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Cron 解析后的 cron 表达式，按本地时间计算
+type Cron struct {
+	expr string
+	// fields 每个字段允许的取值
+	fields [5]map[int]bool
+	// anyDom anyDow 日与周是否为 *，都不为 * 时任一命中即可
+	anyDom, anyDow bool
+}
+
+// ParseCron 解析 5 个字段的 cron 表达式，支持 *、a-b、*/n、a-b/n 与逗号分隔的列表，周日为 0 或 7
+func ParseCron(expr string) (*Cron, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, errors.New(fmt.Sprintf("invalid cron [%s], 5 fields required", expr))
+	}
+	cron := &Cron{expr: strings.Join(parts, " "), anyDom: parts[2] == "*", anyDow: parts[4] == "*"}
+	for i := range parts {
+		values, err := parseCronField(parts[i], cronFields[i])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid cron [%s], %s", expr, err.Error()))
+		}
+		cron.fields[i] = values
+	}
+	if cron.fields[4][7] {
+		cron.fields[4][0] = true
+	}
+	return cron, nil
+}
+
+func parseCronField(part string, field cronField) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, item := range strings.Split(part, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return nil, errors.New(fmt.Sprintf("%s step [%s]", field.name, stepPart))
+			}
+			step = n
+		}
+
+		start, end := field.min, field.max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(from); err != nil {
+				return nil, errors.New(fmt.Sprintf("%s value [%s]", field.name, from))
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(to); err != nil {
+					return nil, errors.New(fmt.Sprintf("%s value [%s]", field.name, to))
+				}
+			} else if hasStep {
+				end = field.max
+			}
+		}
+		if start < field.min || end > field.max || start > end {
+			return nil, errors.New(fmt.Sprintf("%s [%s] out of range %d-%d", field.name, item, field.min, field.max))
+		}
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func (cron *Cron) String() string {
+	return cron.expr
+}
+
+// dayMatches t 所在的日期是否命中日与周
+func (cron *Cron) dayMatches(t time.Time) bool {
+	dom, dow := cron.fields[2][t.Day()], cron.fields[4][int(t.Weekday())]
+	switch {
+	case cron.anyDom && cron.anyDow:
+		return true
+	case cron.anyDom:
+		return dow
+	case cron.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next after 之后的下一个执行时间，5 年内没有命中时返回零值
+func (cron *Cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	end := after.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if !cron.fields[3][int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.fields[1][t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.fields[0][t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// ScheduleCache 定时任务存储，到期任务由持有锁的实例执行
+type ScheduleCache interface {
+	// ScheduleStore 保存任务，按 Next 加入到期队列
+	ScheduleStore(job *ScheduleJob) error
+
+	// ScheduleRemove 删除任务
+	ScheduleRemove(id string) error
+
+	// Schedules 所有任务，按下次执行时间排序
+	Schedules() ([]ScheduleJob, error)
+
+	// ScheduleDue 下次执行时间不晚于 now 的任务
+	ScheduleDue(now time.Time) ([]ScheduleJob, error)
+
+	// ScheduleClaim 领取到期任务，next 为空时删除任务，否则保存下次执行时间
+	// 任务在 ScheduleDue 之后已被删除时返回 false，不再执行也不会重新保存
+	ScheduleClaim(id string, next *ScheduleJob) (bool, error)
+
+	// ScheduleLock 获取 ttl 内有效的锁，owner 已持有时续期，其它实例持有时返回 false
+	ScheduleLock(owner string, ttl time.Duration) (bool, error)
+
+	// ScheduleUnlock 释放 owner 持有的锁
+	ScheduleUnlock(owner string) error
+}
+
+// RemoveCreatorSchedules 删除 creator 创建的全部任务，用户被暂停或删除时调用，cache 不支持 ScheduleCache 时忽略
+func RemoveCreatorSchedules(cache sc.Cache, creator string) (int, error) {
+	scheduleCache, ok := cache.(ScheduleCache)
+	if !ok {
+		return 0, nil
+	}
+	jobs, err := scheduleCache.Schedules()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := range jobs {
+		if jobs[i].Creator != creator {
+			continue
+		}
+		if err = scheduleCache.ScheduleRemove(jobs[i].ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (r Redis) ScheduleStore(job *ScheduleJob) error {
+	// key -> schedule:job => hash(ID, ScheduleJob)
+	// key -> schedule:due => zset(ID, Next)
+	jobPack, err := msgpack.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.ctx, "schedule:job", job.ID, jobPack)
+		pipe.ZAdd(r.ctx, "schedule:due", redis.Z{Score: float64(job.Next.UnixNano()), Member: job.ID})
+		return nil
+	})
+	return err
+}
+
+func (r Redis) ScheduleRemove(id string) error {
+	_, err := r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(r.ctx, "schedule:job", id)
+		pipe.ZRem(r.ctx, "schedule:due", id)
+		return nil
+	})
+	return err
+}
+
+func (r Redis) Schedules() ([]ScheduleJob, error) {
+	ids, err := r.client.ZRange(r.ctx, "schedule:due", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return r.scheduleJobs(ids)
+}
+
+func (r Redis) ScheduleDue(now time.Time) ([]ScheduleJob, error) {
+	ids, err := r.client.ZRangeByScore(r.ctx, "schedule:due", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixNano(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return r.scheduleJobs(ids)
+}
+
+func (r Redis) scheduleJobs(ids []string) ([]ScheduleJob, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	result, err := r.client.HMGet(r.ctx, "schedule:job", ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]ScheduleJob, 0, len(result))
+	for i := range result {
+		jobPack, ok := result[i].(string)
+		if !ok { // 任务已删除
+			continue
+		}
+		var job ScheduleJob
+		if err = msgpack.Unmarshal([]byte(jobPack), &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// scheduleClaimScript 任务仍然存在时删除或保存下次执行时间
+var scheduleClaimScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	return 0
+end
+if ARGV[2] == "" then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	return 1
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+return 1`)
+
+func (r Redis) ScheduleClaim(id string, next *ScheduleJob) (bool, error) {
+	var jobPack []byte
+	var score string
+	if next != nil {
+		var err error
+		if jobPack, err = msgpack.Marshal(next); err != nil {
+			return false, err
+		}
+		score = strconv.FormatInt(next.Next.UnixNano(), 10)
+	}
+	claimed, err := scheduleClaimScript.Run(r.ctx, r.client, []string{"schedule:job", "schedule:due"},
+		id, jobPack, score).Int()
+	return claimed == 1, err
+}
+
+// scheduleLockScript owner 持有锁时续期，锁不存在时获取
+var scheduleLockScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if owner then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1`)
+
+// scheduleUnlockScript 只释放 owner 持有的锁
+var scheduleUnlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func (r Redis) ScheduleLock(owner string, ttl time.Duration) (bool, error) {
+	// key -> schedule:lock => owner
+	locked, err := scheduleLockScript.Run(r.ctx, r.client, []string{"schedule:lock"},
+		owner, ttl.Milliseconds()).Int()
+	return locked == 1, err
+}
+
+func (r Redis) ScheduleUnlock(owner string) error {
+	return scheduleUnlockScript.Run(r.ctx, r.client, []string{"schedule:lock"}, owner).Err()
+}
@@ -0,0 +1,88 @@
+package smart_wecom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	}
+	for _, expr := range tests {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) expected error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"every minute", "* * * * *", at(10, 19, 10, 7).Add(30 * time.Second), at(10, 19, 10, 8)},
+		{"step", "*/15 * * * *", at(10, 19, 10, 7), at(10, 19, 10, 15)},
+		{"step at boundary", "*/15 * * * *", at(10, 19, 10, 45), at(10, 19, 11, 0)},
+		{"list", "0,30 8 * * *", at(10, 19, 8, 0), at(10, 19, 8, 30)},
+		{"range with step", "0 9-13/2 * * *", at(10, 19, 10, 0), at(10, 19, 11, 0)},
+		{"range with step next day", "0 9-13/2 * * *", at(10, 19, 13, 0), at(10, 20, 9, 0)},
+		{"value with step", "0 20/2 * * *", at(10, 19, 21, 0), at(10, 19, 22, 0)},
+		{"weekdays", "0 9 * * 1-5", at(10, 23, 10, 0), at(10, 26, 9, 0)},
+		{"sunday as 0", "0 8 * * 0", at(10, 19, 0, 0), at(10, 25, 8, 0)},
+		{"sunday as 7", "0 8 * * 7", at(10, 19, 0, 0), at(10, 25, 8, 0)},
+		{"day of month", "30 6 1 * *", at(10, 19, 0, 0), at(11, 1, 6, 30)},
+		{"month", "0 0 1 1 *", at(10, 19, 0, 0), time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"dom or dow, dow first", "0 0 1 * 5", at(10, 24, 0, 0), at(10, 30, 0, 0)},
+		{"dom or dow, dom first", "0 0 1 * 5", at(10, 30, 1, 0), at(11, 1, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(10, 19, 0, 0), time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"february 30 never matches", "0 0 30 2 *", at(10, 19, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cron, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cron.Next(tt.after); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleJobReschedule(t *testing.T) {
+	after := time.Date(2026, time.October, 19, 9, 0, 0, 0, time.UTC)
+	once := &ScheduleJob{ID: "once", Next: after}
+	if ok, err := once.Reschedule(after); ok || err != nil {
+		t.Errorf("one-time job Reschedule = %v, %v", ok, err)
+	}
+
+	daily := &ScheduleJob{ID: "daily", Cron: "0 9 * * *", Next: after}
+	if ok, err := daily.Reschedule(after); !ok || err != nil {
+		t.Fatalf("recurring job Reschedule = %v, %v", ok, err)
+	}
+	if want := after.AddDate(0, 0, 1); !daily.Next.Equal(want) {
+		t.Errorf("Next = %s, want %s", daily.Next, want)
+	}
+
+	never := &ScheduleJob{ID: "never", Cron: "0 0 30 2 *", Next: after}
+	if ok, err := never.Reschedule(after); ok || err != nil {
+		t.Errorf("never matching job Reschedule = %v, %v", ok, err)
+	}
+}
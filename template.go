@@ -0,0 +1,323 @@
+package smart_wecom
+
+import (
+	"bytes"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// 模板保存在配置中，配置ID为 template:[name]，各版本按顺序保存在 versions 中
+// 默认模板保存在配置 template-default 中，smart:[smartID] 与 user:[UserUID] => 模板引用
+const (
+	TemplateConfigurePrefix  = "template:"
+	TemplateDefaultConfigure = "template-default"
+)
+
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// PromptTemplate 某一版本的 prompt 模板
+type PromptTemplate struct {
+	Name string
+	// Version 从 1 开始，每次修改增加一个版本，旧版本保留用于比较答复效果
+	Version int
+	Text    string
+}
+
+// TemplateData 渲染模板可以使用的变量，如 {{.User.Name}}、{{.Date}}、{{.Input}}
+type TemplateData struct {
+	User    *sc.User
+	SmartID string
+	// Date 当天日期，格式为 2006-01-02
+	Date string
+	// Time 当前时间，格式为 15:04
+	Time string
+	// Input 用户输入的内容
+	Input string
+}
+
+// NewTemplateData 当前时间的模板变量
+func NewTemplateData(user *sc.User, smartID string, input string) *TemplateData {
+	now := time.Now()
+	return &TemplateData{
+		User:    user,
+		SmartID: smartID,
+		Date:    now.Format("2006-01-02"),
+		Time:    now.Format("15:04"),
+		Input:   input,
+	}
+}
+
+// Ref 模板引用，格式为 name@version，用于评价统计
+func (t *PromptTemplate) Ref() string {
+	return fmt.Sprintf("%s@%d", t.Name, t.Version)
+}
+
+// Render 渲染模板，模板未使用 {{.Input}} 时用户输入附加在末尾
+func (t *PromptTemplate) Render(data *TemplateData) (string, error) {
+	tmpl, err := template.New(t.Ref()).Option("missingkey=error").Parse(t.Text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if !usesField(tmpl.Tree.Root, "Input") && data.Input != "" {
+		buf.WriteString("\n\n")
+		buf.WriteString(data.Input)
+	}
+	return buf.String(), nil
+}
+
+// usesField 模板中是否使用了 {{.name}}，包括条件与管道中的使用
+func usesField(node parse.Node, name string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesField(child, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesField(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesField(cmd, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesField(arg, name) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == name
+	case *parse.ChainNode:
+		return usesField(n.Node, name)
+	case *parse.IfNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.RangeNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.WithNode:
+		return usesField(n.Pipe, name) || usesField(n.List, name) || usesField(n.ElseList, name)
+	case *parse.TemplateNode:
+		return usesField(n.Pipe, name)
+	}
+	return false
+}
+
+// ParseTemplateRef 解析模板引用 name 或 name@version，version 为 0 时使用最新版本
+func ParseTemplateRef(ref string) (string, int, error) {
+	name, version, found := strings.Cut(strings.TrimSpace(ref), "@")
+	if !templateNamePattern.MatchString(name) {
+		return "", 0, errors.New(fmt.Sprintf("invalid template name [%s]", name))
+	}
+	if !found {
+		return name, 0, nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v <= 0 {
+		return "", 0, errors.New(fmt.Sprintf("invalid template version [%s]", ref))
+	}
+	return name, v, nil
+}
+
+// templateVersions 模板配置中保存的所有版本
+func templateVersions(cache sc.Cache, name string) ([]string, error) {
+	configure, err := cache.Configure(TemplateConfigurePrefix + name)
+	if err != nil || configure == nil {
+		return nil, err
+	}
+	return configureVersions(configure), nil
+}
+
+// configureVersions 模板配置中的 versions
+func configureVersions(configure sc.Configure) []string {
+	var versions []string
+	switch v := configure["versions"].(type) {
+	case []string:
+		versions = v
+	case []any:
+		for i := range v {
+			versions = append(versions, fmt.Sprint(v[i]))
+		}
+	}
+	return versions
+}
+
+// TemplateCache 模板版本存储
+type TemplateCache interface {
+	// TemplateAppend 原子地追加模板的新版本并返回版本号，并发保存时版本号不重复
+	TemplateAppend(name string, text string) (int, error)
+}
+
+// LoadTemplate 按模板引用读取模板，模板或版本不存在时返回错误
+func LoadTemplate(cache sc.Cache, ref string) (*PromptTemplate, error) {
+	name, version, err := ParseTemplateRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := templateVersions(cache, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errors.New(fmt.Sprintf("template [%s] not found", name))
+	}
+	if version == 0 {
+		version = len(versions)
+	}
+	if version > len(versions) {
+		return nil, errors.New(fmt.Sprintf("template [%s] version [%d] not found", name, version))
+	}
+	return &PromptTemplate{Name: name, Version: version, Text: versions[version-1]}, nil
+}
+
+// StoreTemplate 保存模板的新版本，返回新版本的模板
+func StoreTemplate(cache sc.Cache, name string, text string) (*PromptTemplate, error) {
+	if !templateNamePattern.MatchString(name) {
+		return nil, errors.New(fmt.Sprintf("invalid template name [%s]", name))
+	}
+	if _, err := template.New(name).Parse(text); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid template [%s], %s", name, err.Error()))
+	}
+	templateCache, ok := cache.(TemplateCache)
+	if !ok {
+		return nil, errors.New("cache does not support template")
+	}
+	version, err := templateCache.TemplateAppend(name, text)
+	if err != nil {
+		return nil, err
+	}
+	return &PromptTemplate{Name: name, Version: version, Text: text}, nil
+}
+
+// templateAppendRetries 并发修改同一模板时 TemplateAppend 重试的次数
+const templateAppendRetries = 10
+
+func (r Redis) TemplateAppend(name string, text string) (int, error) {
+	// key -> configure:template:[name] => Configure{name, versions}
+	id := TemplateConfigurePrefix + name
+	key := fmt.Sprintf("configure:%s", id)
+	var before, after sc.Configure
+	for i := 0; i < templateAppendRetries; i++ {
+		err := r.client.Watch(r.ctx, func(tx *redis.Tx) error {
+			before = nil
+			result, err := tx.Get(r.ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if len(result) > 0 {
+				if err = msgpack.Unmarshal([]byte(result), &before); err != nil {
+					return err
+				}
+			}
+			after = sc.Configure{"name": name, "versions": append(configureVersions(before), text)}
+			configurePack, err := msgpack.Marshal(after)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(r.ctx, key, configurePack, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr { // 其它实例同时保存了新版本
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err = r.audit(AuditEntityConfigure, id, "store", before, after); err != nil {
+			return 0, err
+		}
+		return len(configureVersions(after)), nil
+	}
+	return 0, errors.New(fmt.Sprintf("template [%s] is being modified, try again", name))
+}
+
+// TemplateNames 所有模板名称，cache 需要支持 ManageCache
+func TemplateNames(cache sc.Cache) ([]string, error) {
+	manageCache, ok := cache.(ManageCache)
+	if !ok {
+		return nil, errors.New("cache does not support configure list")
+	}
+	ids, err := manageCache.ConfigureIDs()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range ids {
+		if strings.HasPrefix(ids[i], TemplateConfigurePrefix) {
+			names = append(names, strings.TrimPrefix(ids[i], TemplateConfigurePrefix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// TemplateScopeSmart 默认模板的 smart 范围
+func TemplateScopeSmart(smartID string) string {
+	return fmt.Sprintf("smart:%s", smartID)
+}
+
+// TemplateScopeUser 默认模板的用户范围
+func TemplateScopeUser(userUID sc.UserUID) string {
+	return fmt.Sprintf("user:%s", userUID)
+}
+
+// DefaultTemplateRef 提问默认使用的模板引用，用户的默认模板优先于 smart，未设置时为空
+func DefaultTemplateRef(cache sc.Cache, smartID string, userUID sc.UserUID) (string, error) {
+	configure, err := cache.Configure(TemplateDefaultConfigure)
+	if err != nil || configure == nil {
+		return "", err
+	}
+	for _, scope := range []string{TemplateScopeUser(userUID), TemplateScopeSmart(smartID)} {
+		if ref, ok := configure[scope].(string); ok && ref != "" {
+			return ref, nil
+		}
+	}
+	return "", nil
+}
+
+// StoreDefaultTemplate 设置 scope 的默认模板，ref 为空时取消
+func StoreDefaultTemplate(cache sc.Cache, scope string, ref string) error {
+	if ref != "" {
+		if _, err := LoadTemplate(cache, ref); err != nil {
+			return err
+		}
+	}
+	configure, err := cache.Configure(TemplateDefaultConfigure)
+	if err != nil {
+		return err
+	}
+	defaults := make(sc.Configure, len(configure)+1)
+	for k, v := range configure {
+		defaults[k] = v
+	}
+	if ref == "" {
+		delete(defaults, scope)
+	} else {
+		defaults[scope] = ref
+	}
+	return cache.ConfigureStore(TemplateDefaultConfigure, defaults)
+}
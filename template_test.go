@@ -0,0 +1,33 @@
+package smart_wecom
+
+import (
+	sc "github.com/openai-smart/smart-chat"
+	"testing"
+)
+
+func TestPromptTemplateRender(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"input used", "翻译：{{.Input}}", "翻译：hello"},
+		{"input appended", "你好 {{.User.Name}}", "你好 张三\n\nhello"},
+		{"input in condition", "{{if .Input}}有输入{{end}}", "有输入"},
+		{"input in pipeline", "{{.Input | printf \"%q\"}}", `"hello"`},
+		{"input mentioned in text", "请参考 .Input 字段", "请参考 .Input 字段\n\nhello"},
+		{"input in comment", "总结{{/* .Input */}}", "总结\n\nhello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := &PromptTemplate{Name: "test", Version: 1, Text: tt.text}
+			got, err := tmpl.Render(&TemplateData{User: &sc.User{Name: "张三"}, Input: "hello"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
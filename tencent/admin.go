@@ -0,0 +1,425 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/xen0n/go-workwx"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminCommand 单聊中的管理指令，/group 在群聊中执行
+type adminCommand struct {
+	// required 执行指令需要的最低角色
+	required sw.Role
+	// args 最少参数个数
+	args  int
+	usage string
+	run   func(p *pipeline, ctx context.Context, cmd *adminContext) (string, error)
+}
+
+// adminContext 一次管理指令的执行信息
+type adminContext struct {
+	cache  sw.AdminCache
+	actor  *sc.User
+	args   []string
+	target string
+	// chatID 在群机器人所在群聊中执行时的 ChatId
+	chatID string
+	// reply 在后台执行的指令完成后答复结果
+	reply func(answer string)
+}
+
+// groupChatMessage 群聊中收到的消息，如群机器人消息
+type groupChatMessage interface {
+	GroupChatID() string
+}
+
+// groupCommand 在群聊中设置群聊配置的指令
+const groupCommand = "/group"
+
+// adminCommands 管理指令，以 / 开头，参数以空格分隔
+var adminCommands = map[string]adminCommand{
+	"/grant": {required: sw.RoleOperator, args: 2, usage: "/grant <UserID> <smart>...",
+		run: (*pipeline).adminGrant},
+	"/revoke": {required: sw.RoleOperator, args: 2, usage: "/revoke <UserID> <smart>...",
+		run: (*pipeline).adminRevoke},
+	"/quota": {required: sw.RoleOperator, args: 2, usage: "/quota <UserID> <每天次数，0 为不限制>",
+		run: (*pipeline).adminQuota},
+	"/stats": {required: sw.RoleOperator, usage: "/stats",
+		run: (*pipeline).adminStats},
+	"/template": {required: sw.RoleOperator, args: 2, usage: "/template <模板> <模板内容，可使用 {{.User.Name}} {{.Date}} {{.Input}}>",
+		run: (*pipeline).adminTemplate},
+	"/usetemplate": {required: sw.RoleOperator, args: 1, usage: "/usetemplate <UserID> <模板[@版本]，为空时取消>",
+		run: (*pipeline).adminUseTemplate},
+	"/suspend": {required: sw.RoleAdmin, args: 1, usage: "/suspend <UserID>",
+		run: (*pipeline).adminSuspend},
+	"/resume": {required: sw.RoleAdmin, args: 1, usage: "/resume <UserID>",
+		run: (*pipeline).adminResume},
+	"/role": {required: sw.RoleAdmin, args: 2, usage: "/role <UserID> <user|operator|admin>",
+		run: (*pipeline).adminRole},
+	"/broadcast": {required: sw.RoleAdmin, args: 1, usage: "/broadcast <markdown 公告>",
+		run: (*pipeline).adminBroadcast},
+	groupCommand: {required: sw.RoleOperator, args: 1, usage: "/group <smart>... 或 /group - 使用成员自己的 smart，在群内 @机器人 发送",
+		run: (*pipeline).adminGroup},
+}
+
+// parseAdminCommand 消息是否为管理指令
+func parseAdminCommand(content string) (string, []string, bool) {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	name := strings.ToLower(fields[0])
+	if _, ok := adminCommands[name]; !ok {
+		return "", nil, false
+	}
+	return name, fields[1:], true
+}
+
+// fields0 消息的第一个字段，即指令名称
+func fields0(content string) string {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// SetBroadcaster 设置 /broadcast 在后台发送公告并返回群发ID的方法，未设置时不支持公告
+func (p *pipeline) SetBroadcaster(broadcast func(ctx context.Context, markdown string) (string, error)) {
+	p.broadcast = broadcast
+}
+
+// Broadcast 向应用可见范围内的所有成员发送 markdown 公告
+func (app *WecomApp) Broadcast(markdown string) error {
+	return app.client.SendMarkdownMessage(&workwx.Recipient{UserIDs: []string{"@all"}}, markdown, false)
+}
+
+// admin 检查角色后执行管理指令并答复结果，所有执行的指令都记录到操作记录
+// 指令修改的数据由 cache 记录，操作人为 [userPlatform]:[userID]
+func (p *pipeline) admin(ctx context.Context, session sc.Session, userID string,
+	name string, args []string, msg IncomingMessage) {
+	content := msg.Content()
+	operator := fmt.Sprintf("%s:%s", p.userPlatform, userID)
+	ctx = sw.WithActor(ctx, operator)
+	cache, ok := sw.CacheWithContext(ctx, p.cache).(sw.AdminCache)
+	if !ok {
+		p.reply(session, "不支持管理指令")
+		return
+	}
+	role, err := cache.UserRole(session.User.UID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.UserRole %s", session.ID, err.Error()))
+		return
+	}
+	command := adminCommands[name]
+	if !role.Covers(command.required) {
+		log.Warn().Msg(fmt.Sprintf("[%s] user [%s] role [%s] denied %s", session.ID, session.User.UID, role, name))
+		p.reply(session, "没有执行该指令的权限")
+		return
+	}
+	if len(args) < command.args {
+		p.reply(session, fmt.Sprintf("用法：%s", command.usage))
+		return
+	}
+
+	cmd := &adminContext{cache: cache, actor: session.User, args: args,
+		reply: func(answer string) { p.reply(session, answer) }}
+	if len(args) > 0 {
+		cmd.target = args[0]
+	}
+	if m, ok := msg.(groupChatMessage); ok {
+		cmd.chatID = m.GroupChatID()
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(content), fields0(content)))
+	switch name { // 公告与模板内容保留原始换行
+	case "/broadcast":
+		cmd.target = "@all"
+		cmd.args = []string{rest}
+	case "/template":
+		cmd.args = []string{cmd.target, strings.TrimSpace(strings.TrimPrefix(rest, cmd.target))}
+	case groupCommand:
+		cmd.target = cmd.chatID
+	}
+
+	answer, err := command.run(p, ctx, cmd)
+	entry := &sw.AuditEntry{
+		Time:   time.Now(),
+		Actor:  operator,
+		Action: strings.TrimPrefix(name, "/"),
+		Entity: sw.AuditEntityCommand,
+		Target: cmd.target,
+		Detail: strings.Join(args, " "),
+	}
+	if err != nil {
+		entry.Detail = fmt.Sprintf("%s failed, %s", entry.Detail, err.Error())
+		answer = fmt.Sprintf("执行失败：%s", err.Error())
+	}
+	if auditCache, ok := cache.(sw.AuditCache); ok {
+		if auditErr := auditCache.AuditAppend(entry); auditErr != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] cache.AuditAppend %s", session.ID, auditErr.Error()))
+		}
+	}
+	log.Info().Msg(fmt.Sprintf("[%s] user [%s] run %s %v", session.ID, session.User.UID, name, args))
+	p.reply(session, answer)
+}
+
+// targetUser 指令对象的企微 UserID 对应的用户
+func (p *pipeline) targetUser(ctx context.Context, userID string) (*sc.User, error) {
+	cache := sw.CacheWithContext(ctx, p.cache)
+	userUID, err := cache.UserID2UID(fmt.Sprintf("%s:%s", p.userPlatform, userID))
+	if err != nil {
+		return nil, err
+	}
+	user, err := cache.User(userUID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New(fmt.Sprintf("user [%s] not found", userID))
+	}
+	return user, nil
+}
+
+func (p *pipeline) adminGrant(ctx context.Context, cmd *adminContext) (string, error) {
+	user, err := p.targetUser(ctx, cmd.target)
+	if err != nil {
+		return "", err
+	}
+	smartIDs := cmd.args[1:]
+	for i := range smartIDs {
+		if _, ok := p.smart[smartIDs[i]]; !ok {
+			return "", errors.New(fmt.Sprintf("smart [%s] not found", smartIDs[i]))
+		}
+	}
+	cache := sw.CacheWithContext(ctx, p.cache)
+	if err = cache.UserSmartsStore(user.UID, smartIDs...); err != nil {
+		return "", err
+	}
+	if err = cache.UserAnswerStore(user.UID, smartIDs...); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已为 %s 授权 %s", cmd.target, strings.Join(smartIDs, ", ")), nil
+}
+
+func (p *pipeline) adminRevoke(ctx context.Context, cmd *adminContext) (string, error) {
+	user, err := p.targetUser(ctx, cmd.target)
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.cache.UserSmartsRemove(user.UID, cmd.args[1:]...); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已收回 %s 的 %s", cmd.target, strings.Join(cmd.args[1:], ", ")), nil
+}
+
+func (p *pipeline) adminQuota(ctx context.Context, cmd *adminContext) (string, error) {
+	user, err := p.targetUser(ctx, cmd.target)
+	if err != nil {
+		return "", err
+	}
+	quota, err := strconv.ParseInt(cmd.args[1], 10, 64)
+	if err != nil || quota < 0 {
+		return "", errors.New(fmt.Sprintf("invalid quota [%s]", cmd.args[1]))
+	}
+	if err = cmd.cache.UserQuotaStore(user.UID, quota); err != nil {
+		return "", err
+	}
+	if quota == 0 {
+		return fmt.Sprintf("已取消 %s 的每日提问限制", cmd.target), nil
+	}
+	return fmt.Sprintf("%s 每天最多可提问 %d 次", cmd.target, quota), nil
+}
+
+func (p *pipeline) setStatus(ctx context.Context, cmd *adminContext, status sc.UserStatus) error {
+	user, err := p.targetUser(ctx, cmd.target)
+	if err != nil {
+		return err
+	}
+	if user.UID == cmd.actor.UID {
+		return errors.New("cannot change own status")
+	}
+	// 暂停单独记录，避免通讯录同步与成员变更事件恢复用户状态
+	if err = cmd.cache.UserSuspendStore(user.UID, status != sc.UserStatusActive); err != nil {
+		return err
+	}
+	user.Status = status
+	cache := sw.CacheWithContext(ctx, p.cache)
+	if err = cache.UserStore(user); err != nil || status == sc.UserStatusActive {
+		return err
+	}
+	// 暂停后不再执行用户创建的定时提醒与定时提问
+	_, err = sw.RemoveCreatorSchedules(cache, fmt.Sprintf("%s:%s", p.userPlatform, cmd.target))
+	return err
+}
+
+func (p *pipeline) adminSuspend(ctx context.Context, cmd *adminContext) (string, error) {
+	if err := p.setStatus(ctx, cmd, sc.UserStatusDown); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已暂停 %s", cmd.target), nil
+}
+
+func (p *pipeline) adminResume(ctx context.Context, cmd *adminContext) (string, error) {
+	if err := p.setStatus(ctx, cmd, sc.UserStatusActive); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已恢复 %s", cmd.target), nil
+}
+
+func (p *pipeline) adminRole(ctx context.Context, cmd *adminContext) (string, error) {
+	role, ok := sw.ParseRole(cmd.args[1])
+	if !ok {
+		return "", errors.New(fmt.Sprintf("unknown role [%s]", cmd.args[1]))
+	}
+	user, err := p.targetUser(ctx, cmd.target)
+	if err != nil {
+		return "", err
+	}
+	if user.UID == cmd.actor.UID {
+		return "", errors.New("cannot change own role")
+	}
+	if err = cmd.cache.UserRoleStore(user.UID, role); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s 的角色已设置为 %s", cmd.target, role), nil
+}
+
+func (p *pipeline) adminBroadcast(ctx context.Context, cmd *adminContext) (string, error) {
+	if p.broadcast == nil {
+		return "", errors.New("broadcast unsupported")
+	}
+	if cmd.args[0] == "" {
+		return "", errors.New("empty announcement")
+	}
+	// 回调需要在限定时间内答复，公告在后台发送
+	id, err := p.broadcast(ctx, cmd.args[0])
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "公告已发送", nil
+	}
+	return fmt.Sprintf("公告发送中，群发ID：%s", id), nil
+}
+
+// adminGroup 设置群机器人所在群聊使用的 smart，"-" 为使用提问成员自己的 smart
+func (p *pipeline) adminGroup(ctx context.Context, cmd *adminContext) (string, error) {
+	if cmd.chatID == "" {
+		return "", errors.New("/group must be sent to the robot in a group chat")
+	}
+	groupCache, ok := p.groupCache(ctx)
+	if !ok {
+		return "", errors.New("cache does not support group")
+	}
+	smartIDs := cmd.args
+	if len(smartIDs) == 1 && smartIDs[0] == "-" {
+		smartIDs = nil
+	}
+	for i := range smartIDs {
+		if _, ok := p.smart[smartIDs[i]]; !ok {
+			return "", errors.New(fmt.Sprintf("smart [%s] not found", smartIDs[i]))
+		}
+	}
+	group, err := groupCache.Group(cmd.chatID)
+	if err != nil {
+		return "", err
+	}
+	if group == nil {
+		group = &sw.Group{ChatID: cmd.chatID, MemorySize: sw.DefaultGroupMemorySize}
+	}
+	group.SmartIDs = smartIDs
+	if err = groupCache.GroupStore(group); err != nil {
+		return "", err
+	}
+	if len(smartIDs) == 0 {
+		return "本群使用成员自己的 smart", nil
+	}
+	return fmt.Sprintf("本群使用 %s", strings.Join(smartIDs, ", ")), nil
+}
+
+// adminStatsTimeout 后台统计的超时时间
+const adminStatsTimeout = time.Minute
+
+// adminStats 用户数与当天的提问、评价统计，需要逐个读取用户，在后台统计后答复
+func (p *pipeline) adminStats(ctx context.Context, cmd *adminContext) (string, error) {
+	actor := sw.ActorFromContext(ctx)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Error().Msg(fmt.Sprintf("[x] admin stats %s", err))
+			}
+		}()
+		statsCtx, cancel := context.WithTimeout(sw.WithActor(context.Background(), actor), adminStatsTimeout)
+		defer cancel()
+		stats, err := p.stats(statsCtx)
+		if err != nil {
+			log.Warn().Msg(fmt.Sprintf("[x] admin stats %s", err.Error()))
+			stats = fmt.Sprintf("统计失败：%s", err.Error())
+		}
+		cmd.reply(stats)
+	}()
+	return "统计中，完成后发送结果", nil
+}
+
+// stats 统计用户数与当天的提问、评价
+func (p *pipeline) stats(ctx context.Context) (string, error) {
+	cache := sw.CacheWithContext(ctx, p.cache)
+	profileCache, ok := cache.(sw.UserProfileCache)
+	if !ok {
+		return "", errors.New("cache does not support user profile")
+	}
+	adminCache, ok := cache.(sw.AdminCache)
+	if !ok {
+		return "", errors.New("cache does not support admin")
+	}
+	bindings, err := profileCache.UserBindings(fmt.Sprintf("%s:", p.userPlatform))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	var active, inactive, used int64
+	for _, userUID := range bindings {
+		user, err := cache.User(userUID)
+		if err != nil {
+			return "", err
+		}
+		if user == nil {
+			continue
+		}
+		if user.Status == sc.UserStatusActive {
+			active++
+		} else {
+			inactive++
+		}
+		usage, err := adminCache.UserUsage(userUID, now)
+		if err != nil {
+			return "", err
+		}
+		used += usage
+	}
+
+	stats := fmt.Sprintf("用户：%d 个（正常 %d，停用 %d）\n今日答复：%d 次", active+inactive, active, inactive, used)
+	if feedbackCache, ok := cache.(sw.FeedbackCache); ok {
+		year, month, day := now.Date()
+		feedbacks, err := feedbackCache.Feedbacks(time.Date(year, month, day, 0, 0, 0, 0, now.Location()), now)
+		if err != nil {
+			return "", err
+		}
+		good := 0
+		for i := range feedbacks {
+			if feedbacks[i].Rating == sw.RatingGood {
+				good++
+			}
+		}
+		stats += fmt.Sprintf("\n今日评价：%d 条（有用 %d，没用 %d）", len(feedbacks), good, len(feedbacks)-good)
+	}
+	return stats, nil
+}
@@ -0,0 +1,144 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAggregateTimeout 汇总模式默认等待各 smart 答复的时间
+const DefaultAggregateTimeout = time.Minute
+
+// judgePrompt 评审 smart 的提问，%s 依次为问题与各 smart 的回答
+const judgePrompt = `以下是多个 AI 助手对同一问题的回答。请比较它们的准确性、完整性与可读性，选出最好的回答并简要说明理由；如果各回答都有不足，请综合它们给出一个更好的回答。
+
+问题：
+%s
+
+%s`
+
+// aggregation 汇总模式的配置
+type aggregation struct {
+	timeout time.Duration
+	// judge 评审答复的 smart，为空时不评审
+	judge string
+}
+
+// SetAggregation 开启汇总模式，向多个 smart 提问时等待所有答复，最多等待 timeout，合并为一条按 smart 标注的答复
+// judgeSmartID 不为空时由该 smart 比较各答复，选出或综合出最好的回答附加在末尾
+func (p *pipeline) SetAggregation(timeout time.Duration, judgeSmartID string) {
+	if timeout <= 0 {
+		timeout = DefaultAggregateTimeout
+	}
+	p.aggregation = &aggregation{timeout: timeout, judge: judgeSmartID}
+}
+
+// aggregateProcess 并发向 smartIDs 提问，各答复分别保存为会话，合并后的答复执行答复处理器
+// 合并答复的 SmartID 为 sw.AggregateSmartID
+func (p *pipeline) aggregateProcess(ctx context.Context, session sc.Session, group *sw.Group, smartIDs []string) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("[%s] %s", session.ID, err))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, p.sessionTimeout)
+	defer cancel()
+	waitCtx, waitCancel := context.WithTimeout(ctx, p.aggregation.timeout)
+	defer waitCancel()
+
+	results := make([]*answered, len(smartIDs))
+	var wg sync.WaitGroup
+	for i := range smartIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := session
+			s.SmartID = smartIDs[i]
+			result, err := p.ask(waitCtx, s, group)
+			if err != nil {
+				return
+			}
+			results[i] = result
+		}(i)
+	}
+	wg.Wait()
+
+	var content, templateRef string
+	sections := make([]string, 0, len(smartIDs)+1)
+	for i := range smartIDs {
+		result := results[i]
+		if result == nil {
+			sections = append(sections, fmt.Sprintf("【%s】\n（未能及时答复）", p.smartLabel(smartIDs[i])))
+			continue
+		}
+		content, templateRef = result.content, result.templateRef
+		sections = append(sections, fmt.Sprintf("【%s】\n%s", p.smartLabel(smartIDs[i]), result.session.Answer))
+
+		// 各 smart 的答复单独保存，用于会话记录、上下文与用量统计
+		if group != nil {
+			p.groupRemember(ctx, group, smartIDs[i], result.content, result.session.Answer)
+		}
+		if err := sw.CacheWithContext(ctx, p.cache).SessionStore(&result.session); err != nil {
+			log.Error().Msg(fmt.Sprintf("[%s] store session error %s", session.ID, err.Error()))
+		}
+	}
+	if content == "" { // 所有 smart 都未答复
+		log.Error().Msg(fmt.Sprintf("[%s] aggregate %v no answer", session.ID, smartIDs))
+		return
+	}
+
+	if verdict := p.judge(ctx, session, content, smartIDs, results); verdict != "" {
+		sections = append(sections, fmt.Sprintf("【评审 · %s】\n%s", p.smartLabel(p.aggregation.judge), verdict))
+	}
+
+	session.SmartID = sw.AggregateSmartID
+	session.Answer = strings.Join(sections, "\n\n")
+	if !p.complete(ctx, &session) {
+		return
+	}
+	p.feedbackRemember(ctx, &session, content, templateRef)
+}
+
+// judge 由评审 smart 比较各答复，少于两个答复或评审失败时返回空
+func (p *pipeline) judge(ctx context.Context, session sc.Session, content string,
+	smartIDs []string, results []*answered) string {
+	if p.aggregation.judge == "" {
+		return ""
+	}
+	if _, ok := p.smart[p.aggregation.judge]; !ok {
+		log.Warn().Msg(fmt.Sprintf("[%s] judge smart[%s] not found", session.ID, p.aggregation.judge))
+		return ""
+	}
+	answers := make([]string, 0, len(results))
+	for i := range results {
+		if results[i] != nil {
+			answers = append(answers, fmt.Sprintf("回答 %d（%s）：\n%s",
+				len(answers)+1, p.smartLabel(smartIDs[i]), results[i].session.Answer))
+		}
+	}
+	if len(answers) < 2 {
+		return ""
+	}
+
+	verdict, err := p.askSmart(ctx, session, p.aggregation.judge,
+		fmt.Sprintf(judgePrompt, content, strings.Join(answers, "\n\n")))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(verdict)
+}
+
+// smartLabel 答复中标注的 smart 平台与ID
+func (p *pipeline) smartLabel(smartID string) string {
+	if s, ok := p.smart[smartID]; ok {
+		return fmt.Sprintf("%s · %s", s.Platform(), smartID)
+	}
+	return smartID
+}
@@ -0,0 +1,414 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/tracing"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/xen0n/go-workwx"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBroadcastRate 每分钟最多调用发送消息接口的次数
+const DefaultBroadcastRate = 300
+
+// broadcastBatchSize 合并发送时每次最多的接收人数，企微接口限制为 1000
+const broadcastBatchSize = 1000
+
+// Broadcaster 主动发送消息给成员、部门或标签，按频率限制调用发送接口并记录每个接收人的发送结果
+// 同一时间只执行一个群发，避免超出应用的发送频率
+type Broadcaster struct {
+	app   *WecomApp
+	cache sc.Cache
+	smart map[string]smart.Smart
+	// rate 每分钟最多调用发送接口的次数
+	rate int
+	// dailyLimit 每天最多发送的人次，为 0 时不限制
+	dailyLimit int
+	redactor   *sw.Redactor
+
+	mu sync.Mutex
+}
+
+// NewBroadcaster 创建群发，rate 为每分钟最多调用发送接口的次数，dailyLimit 为每天最多发送的人次，为 0 时不限制
+func NewBroadcaster(app *WecomApp, cache sc.Cache, smarts map[string]smart.Smart, rate int, dailyLimit int) *Broadcaster {
+	if rate <= 0 {
+		rate = DefaultBroadcastRate
+	}
+	return &Broadcaster{app: app, cache: cache, smart: smarts, rate: rate, dailyLimit: dailyLimit}
+}
+
+// SetRedactor 由 smart 生成消息时提问前脱敏
+func (b *Broadcaster) SetRedactor(redactor *sw.Redactor) {
+	b.redactor = redactor
+}
+
+func (b *Broadcaster) broadcastCache(ctx context.Context) (sw.BroadcastCache, error) {
+	broadcastCache, ok := sw.CacheWithContext(ctx, b.cache).(sw.BroadcastCache)
+	if !ok {
+		return nil, errors.New("cache does not support broadcast")
+	}
+	return broadcastCache, nil
+}
+
+// Send 发送并等待完成，返回的错误为群发整体失败的原因，单个接收人的失败记录在发送结果中
+func (b *Broadcaster) Send(ctx context.Context, broadcast *sw.Broadcast) error {
+	if err := b.prepare(ctx, broadcast); err != nil {
+		return err
+	}
+	return b.send(ctx, broadcast)
+}
+
+// Start 检查并保存后在后台发送，通过 BroadcastCache 查询发送进度
+// 后台发送使用 broadcast 的副本，返回后 broadcast 不再被修改
+func (b *Broadcaster) Start(ctx context.Context, broadcast *sw.Broadcast) error {
+	if err := b.prepare(ctx, broadcast); err != nil {
+		return err
+	}
+	sending := *broadcast
+	go func() {
+		sendCtx := sw.WithActor(tracing.Detach(ctx), sending.Actor)
+		if err := b.send(sendCtx, &sending); err != nil {
+			log.Error().Msg(fmt.Sprintf("[x] broadcast [%s] failed, %s", sending.ID, err.Error()))
+		}
+	}()
+	return nil
+}
+
+// Announce 在后台向所有成员发送 markdown 公告，返回群发ID
+func (b *Broadcaster) Announce(ctx context.Context, markdown string) (string, error) {
+	broadcast := &sw.Broadcast{
+		Target:  sw.BroadcastTarget{UserIDs: []string{sw.BroadcastAll}},
+		Content: markdown,
+	}
+	if err := b.Start(ctx, broadcast); err != nil {
+		return "", err
+	}
+	return broadcast.ID, nil
+}
+
+// prepare 检查内容并保存群发，操作人为 ctx 中的操作人
+func (b *Broadcaster) prepare(ctx context.Context, broadcast *sw.Broadcast) error {
+	if err := broadcast.Validate(); err != nil {
+		return err
+	}
+	if broadcast.SmartID != "" {
+		if _, ok := b.smart[broadcast.SmartID]; !ok {
+			return errors.New(fmt.Sprintf("smart [%s] not found", broadcast.SmartID))
+		}
+	}
+	broadcastCache, err := b.broadcastCache(ctx)
+	if err != nil {
+		return err
+	}
+
+	broadcast.Time = time.Now()
+	broadcast.Actor = sw.ActorFromContext(ctx)
+	broadcast.ID = utils.MD5(fmt.Sprintf("%s:%s:%d", broadcast.Actor, broadcast.Content, broadcast.Time.UnixNano()))[:12]
+	broadcast.Status = sw.BroadcastStatusSending
+	if err = broadcastCache.BroadcastStore(broadcast); err != nil {
+		return err
+	}
+	b.audit(ctx, broadcast)
+	return nil
+}
+
+func (b *Broadcaster) audit(ctx context.Context, broadcast *sw.Broadcast) {
+	auditCache, ok := sw.CacheWithContext(ctx, b.cache).(sw.AuditCache)
+	if !ok {
+		return
+	}
+	if err := auditCache.AuditAppend(&sw.AuditEntry{
+		Time:   broadcast.Time,
+		Actor:  broadcast.Actor,
+		Action: "send",
+		Entity: sw.AuditEntityBroadcast,
+		Target: broadcast.ID,
+		After:  broadcast.Content,
+		Detail: fmt.Sprintf("users %v, depts %v, tags %v, smart %s", broadcast.Target.UserIDs,
+			broadcast.Target.DeptIDs, broadcast.Target.TagIDs, broadcast.SmartID),
+	}); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[x] broadcast [%s] cache.AuditAppend %s", broadcast.ID, err.Error()))
+	}
+}
+
+// send 展开接收人、预占发送额度后按频率发送，完成后保存发送统计
+func (b *Broadcaster) send(ctx context.Context, broadcast *sw.Broadcast) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	broadcastCache, err := b.broadcastCache(ctx)
+	if err != nil {
+		return err
+	}
+	err = b.deliver(ctx, broadcastCache, broadcast)
+	broadcast.Status, broadcast.Finished = sw.BroadcastStatusDone, time.Now()
+	if err != nil {
+		broadcast.Status, broadcast.Error = sw.BroadcastStatusFailed, err.Error()
+	}
+	if storeErr := broadcastCache.BroadcastStore(broadcast); storeErr != nil {
+		log.Warn().Msg(fmt.Sprintf("[x] broadcast [%s] cache.BroadcastStore %s", broadcast.ID, storeErr.Error()))
+	}
+	log.Info().Msg(fmt.Sprintf("[*] broadcast [%s] %s, %d recipients, %d sent, %d failed",
+		broadcast.ID, broadcast.Status, broadcast.Recipients, broadcast.Sent, broadcast.Failed))
+	return err
+}
+
+func (b *Broadcaster) deliver(ctx context.Context, broadcastCache sw.BroadcastCache, broadcast *sw.Broadcast) error {
+	users, skipped, err := b.recipients(&broadcast.Target)
+	if err != nil {
+		return err
+	}
+	broadcast.Recipients = len(users)
+	b.record(broadcastCache, broadcast, skipped, sw.DeliveryStatusSkipped, errors.New("not visible to app"))
+	if len(users) == 0 {
+		return errors.New("no recipients")
+	}
+	reserved, err := broadcastCache.BroadcastReserve(len(users), b.dailyLimit)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return errors.New(fmt.Sprintf("daily limit %d exceeded", b.dailyLimit))
+	}
+	// 发送失败与未发送的人次归还额度
+	defer func() {
+		if unsent := len(users) - broadcast.Sent; unsent > 0 {
+			if err := broadcastCache.BroadcastRelease(unsent); err != nil {
+				log.Warn().Msg(fmt.Sprintf("[x] broadcast [%s] cache.BroadcastRelease %s", broadcast.ID, err.Error()))
+			}
+		}
+	}()
+
+	limiter := time.NewTicker(time.Minute / time.Duration(b.rate))
+	defer limiter.Stop()
+	wait := func(i int) error {
+		if i == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-limiter.C:
+			return nil
+		}
+	}
+
+	if !broadcast.Personalized() {
+		for i := 0; i*broadcastBatchSize < len(users); i++ {
+			if err = wait(i); err != nil {
+				return err
+			}
+			end := (i + 1) * broadcastBatchSize
+			if end > len(users) {
+				end = len(users)
+			}
+			batch := users[i*broadcastBatchSize : end]
+			userIDs := make([]string, 0, len(batch))
+			for j := range batch {
+				userIDs = append(userIDs, batch[j].UserID)
+			}
+			invalid, err := b.app.SendMarkdown(userIDs, broadcast.Content)
+			b.result(broadcastCache, broadcast, userIDs, invalid, err)
+		}
+		return nil
+	}
+
+	for i := range users {
+		if err = wait(i); err != nil {
+			return err
+		}
+		content, err := b.render(ctx, broadcast, users[i])
+		var invalid []string
+		if err == nil {
+			invalid, err = b.app.SendMarkdown([]string{users[i].UserID}, content)
+		}
+		b.result(broadcastCache, broadcast, []string{users[i].UserID}, invalid, err)
+	}
+	return nil
+}
+
+// result 记录一次发送的结果并保存发送进度，invalid 为企微返回的无效接收人
+func (b *Broadcaster) result(broadcastCache sw.BroadcastCache, broadcast *sw.Broadcast,
+	userIDs []string, invalid []string, err error) {
+	if err != nil {
+		monitor.WecomSendFailures.Inc()
+		broadcast.Failed += len(userIDs)
+		b.record(broadcastCache, broadcast, userIDs, sw.DeliveryStatusFailed, err)
+	} else {
+		skip := make(map[string]bool, len(invalid))
+		for i := range invalid {
+			skip[invalid[i]] = true
+		}
+		sent := make([]string, 0, len(userIDs))
+		failed := make([]string, 0, len(invalid))
+		for i := range userIDs {
+			if skip[userIDs[i]] {
+				failed = append(failed, userIDs[i])
+			} else {
+				sent = append(sent, userIDs[i])
+			}
+		}
+		broadcast.Sent += len(sent)
+		broadcast.Failed += len(failed)
+		b.record(broadcastCache, broadcast, sent, sw.DeliveryStatusSent, nil)
+		b.record(broadcastCache, broadcast, failed, sw.DeliveryStatusFailed, errors.New("invalid user"))
+	}
+	if err = broadcastCache.BroadcastStore(broadcast); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[x] broadcast [%s] cache.BroadcastStore %s", broadcast.ID, err.Error()))
+	}
+}
+
+func (b *Broadcaster) record(broadcastCache sw.BroadcastCache, broadcast *sw.Broadcast,
+	userIDs []string, status sw.DeliveryStatus, err error) {
+	now := time.Now()
+	deliveries := make([]*sw.BroadcastDelivery, 0, len(userIDs))
+	for i := range userIDs {
+		delivery := &sw.BroadcastDelivery{UserID: userIDs[i], Time: now, Status: status}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := broadcastCache.BroadcastDeliveryStore(broadcast.ID, deliveries...); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[x] broadcast [%s] cache.BroadcastDeliveryStore %s", broadcast.ID, err.Error()))
+	}
+}
+
+// SendMarkdown 发送 markdown 消息，返回企微不能送达的接收人
+// go-workwx 的 SendMarkdownMessage 忽略了返回的 invaliduser，群发需要逐个记录发送结果
+// https://developer.work.weixin.qq.com/document/path/90236
+func (app *WecomApp) SendMarkdown(userIDs []string, content string) ([]string, error) {
+	var resp struct {
+		qyapiResult
+		InvalidUser string `json:"invaliduser"`
+	}
+	err := app.post("/cgi-bin/message/send", map[string]any{
+		"touser":   strings.Join(userIDs, "|"),
+		"msgtype":  "markdown",
+		"agentid":  app.client.AgentID,
+		"markdown": map[string]string{"content": content},
+	}, &resp)
+	if err != nil || resp.InvalidUser == "" {
+		return nil, err
+	}
+	return strings.Split(resp.InvalidUser, "|"), nil
+}
+
+// render 内容为模板时以接收人的用户信息渲染，指定 smart 时以内容提问并使用答复
+func (b *Broadcaster) render(ctx context.Context, broadcast *sw.Broadcast, info *workwx.UserInfo) (string, error) {
+	content := broadcast.Content
+	if broadcast.Template {
+		cache := sw.CacheWithContext(ctx, b.cache)
+		user := &sc.User{Name: info.Name}
+		if userUID, err := cache.UserID2UID(wecomUserID(info.UserID)); err == nil && userUID != "" {
+			if cached, err := cache.User(userUID); err == nil && cached != nil {
+				user = cached
+			}
+		}
+		var err error
+		if content, err = broadcast.PromptTemplate().Render(sw.NewTemplateData(user, broadcast.SmartID, "")); err != nil {
+			return "", err
+		}
+	}
+	if broadcast.SmartID == "" {
+		return content, nil
+	}
+	askCtx, cancel := context.WithTimeout(ctx, scheduleAskTimeout)
+	defer cancel()
+	return askText(askCtx, b.smart[broadcast.SmartID], broadcast.SmartID, b.redactor, content)
+}
+
+// recipients 展开接收范围，只包含应用可见的成员，不可见的用户ID 作为 skipped 返回
+func (b *Broadcaster) recipients(target *sw.BroadcastTarget) ([]*workwx.UserInfo, []string, error) {
+	all, err := b.app.ExportDepts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := make(map[string]bool)
+	visible := make(map[string]bool, len(all))
+	for i := range all {
+		visible[all[i].UserID] = true
+	}
+	var skipped []string
+	for _, userID := range target.UserIDs {
+		switch {
+		case userID == sw.BroadcastAll:
+			for i := range all {
+				selected[all[i].UserID] = true
+			}
+		case visible[userID]:
+			selected[userID] = true
+		default:
+			skipped = append(skipped, userID)
+		}
+	}
+
+	if len(target.DeptIDs) > 0 {
+		parents, err := b.app.DeptParents()
+		if err != nil {
+			return nil, nil, err
+		}
+		depts := make(map[int64]bool, len(target.DeptIDs))
+		for _, deptID := range target.DeptIDs {
+			depts[deptID] = true
+		}
+		for i := range all {
+			for _, dept := range all[i].Departments {
+				if inDepts(dept.DeptID, depts, parents) {
+					selected[all[i].UserID] = true
+				}
+			}
+		}
+	}
+
+	if len(target.TagIDs) > 0 {
+		userTags, err := b.app.UserTags(all)
+		if err != nil {
+			return nil, nil, err
+		}
+		tags := make(map[int64]bool, len(target.TagIDs))
+		for _, tagID := range target.TagIDs {
+			tags[tagID] = true
+		}
+		for userID, tagIDs := range userTags {
+			for _, tagID := range tagIDs {
+				if tags[tagID] {
+					selected[userID] = true
+				}
+			}
+		}
+	}
+
+	users := make([]*workwx.UserInfo, 0, len(selected))
+	for i := range all {
+		if selected[all[i].UserID] {
+			users = append(users, all[i])
+		}
+	}
+	return users, skipped, nil
+}
+
+// inDepts deptID 或其上级部门是否在 depts 中
+func inDepts(deptID int64, depts map[int64]bool, parents map[int64]int64) bool {
+	for seen := 0; seen <= len(parents); seen++ {
+		if depts[deptID] {
+			return true
+		}
+		parent, ok := parents[deptID]
+		if !ok || parent == deptID {
+			return false
+		}
+		deptID = parent
+	}
+	return false
+}
@@ -0,0 +1,382 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/rs/zerolog/log"
+	"github.com/xen0n/go-workwx"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 模板卡片类型
+// https://developer.work.weixin.qq.com/document/path/90236#模板卡片消息
+const (
+	CardTypeTextNotice        = "text_notice"
+	CardTypeButtonInteraction = "button_interaction"
+	CardTypeVoteInteraction   = "vote_interaction"
+)
+
+// 答复下方按钮的操作，作为按钮的 key
+const (
+	// CardActionRegenerate 使用同一个 smart 重新回答
+	CardActionRegenerate = "regenerate"
+	// CardActionContinue 基于上次的回答继续
+	CardActionContinue = "continue"
+	// CardActionGood 评价回答有用
+	CardActionGood = "good"
+	// CardActionBad 评价回答没用
+	CardActionBad = "bad"
+	// cardActionSwitch 切换到其它 smart 回答，后接 smartID
+	cardActionSwitch = "switch:"
+)
+
+// cardMaxButtons 按钮交互型卡片最多的按钮数量
+const cardMaxButtons = 6
+
+// CardActionSwitch 切换到 smartID 回答的按钮 key
+func CardActionSwitch(smartID string) string {
+	return cardActionSwitch + smartID
+}
+
+// CardTitle 卡片标题
+type CardTitle struct {
+	Title string `json:"title,omitempty"`
+	Desc  string `json:"desc,omitempty"`
+}
+
+// CardJump 点击卡片跳转，Type 1 跳转 URL
+type CardJump struct {
+	Type int    `json:"type"`
+	URL  string `json:"url,omitempty"`
+}
+
+// CardButton 卡片按钮，Style 1~4 对应不同颜色
+type CardButton struct {
+	Text  string `json:"text"`
+	Style int    `json:"style,omitempty"`
+	Key   string `json:"key"`
+}
+
+// CardOption 投票选项
+type CardOption struct {
+	ID        string `json:"id"`
+	Text      string `json:"text"`
+	IsChecked bool   `json:"is_checked,omitempty"`
+}
+
+// CardCheckbox 投票选择
+type CardCheckbox struct {
+	QuestionKey string       `json:"question_key"`
+	OptionList  []CardOption `json:"option_list"`
+	// Mode 0 单选 1 多选
+	Mode int `json:"mode"`
+}
+
+// TemplateCard 应用模板卡片消息
+type TemplateCard struct {
+	CardType     string        `json:"card_type"`
+	MainTitle    CardTitle     `json:"main_title"`
+	SubTitleText string        `json:"sub_title_text,omitempty"`
+	CardAction   *CardJump     `json:"card_action,omitempty"`
+	TaskID       string        `json:"task_id,omitempty"`
+	ButtonList   []CardButton  `json:"button_list,omitempty"`
+	Checkbox     *CardCheckbox `json:"checkbox,omitempty"`
+	SubmitButton *CardButton   `json:"submit_button,omitempty"`
+}
+
+// NewTextNoticeCard 文本通知型卡片，点击跳转到 url
+func NewTextNoticeCard(title string, desc string, url string) *TemplateCard {
+	return &TemplateCard{
+		CardType:   CardTypeTextNotice,
+		MainTitle:  CardTitle{Title: title, Desc: desc},
+		CardAction: &CardJump{Type: 1, URL: url},
+	}
+}
+
+// NewButtonCard 按钮交互型卡片，taskID 用于识别点击事件，同一应用内不能重复
+func NewButtonCard(taskID string, title string, desc string, buttons ...CardButton) *TemplateCard {
+	return &TemplateCard{
+		CardType:   CardTypeButtonInteraction,
+		MainTitle:  CardTitle{Title: title, Desc: desc},
+		TaskID:     taskID,
+		ButtonList: buttons,
+	}
+}
+
+// NewVoteCard 投票选择型卡片，multiple 为 true 时可多选
+func NewVoteCard(taskID string, title string, questionKey string,
+	options []CardOption, multiple bool, submit CardButton) *TemplateCard {
+	checkbox := &CardCheckbox{QuestionKey: questionKey, OptionList: options}
+	if multiple {
+		checkbox.Mode = 1
+	}
+	return &TemplateCard{
+		CardType:     CardTypeVoteInteraction,
+		MainTitle:    CardTitle{Title: title},
+		TaskID:       taskID,
+		Checkbox:     checkbox,
+		SubmitButton: &submit,
+	}
+}
+
+// WithSubTitle 设置卡片二级标题
+func (card *TemplateCard) WithSubTitle(text string) *TemplateCard {
+	card.SubTitleText = text
+	return card
+}
+
+// SendTemplateCard 发送模板卡片消息，应用群聊不支持模板卡片
+// https://developer.work.weixin.qq.com/document/path/90236
+func (app *WecomApp) SendTemplateCard(recipient *workwx.Recipient, card *TemplateCard) error {
+	err := app.post("/cgi-bin/message/send", map[string]any{
+		"touser":        strings.Join(recipient.UserIDs, "|"),
+		"toparty":       strings.Join(recipient.PartyIDs, "|"),
+		"totag":         strings.Join(recipient.TagIDs, "|"),
+		"msgtype":       "template_card",
+		"agentid":       app.client.AgentID,
+		"template_card": card,
+	}, nil)
+	if err != nil {
+		monitor.WecomSendFailures.Inc()
+	}
+	return err
+}
+
+// UpdateTemplateCardButton 将用户点击后的卡片按钮替换为不可点击的 replaceName
+// https://developer.work.weixin.qq.com/document/path/94888
+func (app *WecomApp) UpdateTemplateCardButton(userIDs []string, responseCode string, replaceName string) error {
+	return app.post("/cgi-bin/message/update_template_card", map[string]any{
+		"userids":       userIDs,
+		"agentid":       app.client.AgentID,
+		"response_code": responseCode,
+		"button": map[string]string{
+			"replace_name": replaceName,
+		},
+	}, nil)
+}
+
+// CardActionMessage 点击答复卡片按钮后重新提问的消息
+type CardActionMessage struct {
+	*RxMessage
+	Card   *sw.Card
+	Action string
+
+	content  string
+	history  []sw.Message
+	smartIDs []string
+}
+
+func (m *CardActionMessage) Type() sc.MessageType {
+	return sc.MessageTypeText
+}
+
+func (m *CardActionMessage) Content() string {
+	return m.content
+}
+
+func (m *CardActionMessage) History() []sw.Message {
+	return m.history
+}
+
+func (m *CardActionMessage) SmartIDs() []string {
+	return m.smartIDs
+}
+
+// SetSmartName 设置切换按钮上显示的 smart 名称，默认为 smart 的 Platform
+func (wecomChat *WecomAppChat) SetSmartName(smartID string, name string) {
+	if wecomChat.smartNames == nil {
+		wecomChat.smartNames = make(map[string]string)
+	}
+	wecomChat.smartNames[smartID] = name
+}
+
+func (wecomChat *WecomAppChat) smartName(smartID string) string {
+	if name, ok := wecomChat.smartNames[smartID]; ok {
+		return name
+	}
+	if s, ok := wecomChat.smart[smartID]; ok {
+		return s.Platform()
+	}
+	return smartID
+}
+
+// CardCompletionHandler 在答复下方发送“重新生成”、“继续”与切换 smart 的按钮卡片
+// 需在 ChatGPTCompletionHandler 之后添加，群聊消息与汇总答复不发送卡片
+func (wecomChat *WecomAppChat) CardCompletionHandler(session *sc.Session) error {
+	msg := session.Question.(IncomingMessage)
+	recipient := session.Question.(replyable).Recipient()
+	if recipient.ChatID != "" || session.SmartID == sw.AggregateSmartID { // 汇总答复不对应单个 smart
+		return nil
+	}
+	cardCache, ok := sw.CacheWithContext(context.Background(), wecomChat.cache).(sw.CardCache)
+	if !ok {
+		return nil
+	}
+
+	card := &sw.Card{
+		TaskID:    utils.MD5(fmt.Sprintf("%s:%s:%d", session.ID, session.SmartID, time.Now().UnixNano())),
+		SessionID: session.ID,
+		UserID:    recipient.UserIDs[0],
+		SmartID:   session.SmartID,
+		Question:  msg.Content(),
+		Answer:    fmt.Sprint(session.Answer),
+	}
+	if err := cardCache.CardStore(card, sw.CardTTL); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.CardStore %s", session.ID, err.Error()))
+		return nil
+	}
+
+	buttons := []CardButton{
+		{Text: "重新生成", Style: 1, Key: CardActionRegenerate},
+		{Text: "继续", Style: 2, Key: CardActionContinue},
+		{Text: "有用", Style: 3, Key: CardActionGood},
+		{Text: "没用", Style: 4, Key: CardActionBad},
+	}
+	smartIDs := make([]string, 0, len(wecomChat.smart))
+	for smartID := range wecomChat.smart {
+		if smartID != session.SmartID {
+			smartIDs = append(smartIDs, smartID)
+		}
+	}
+	sort.Strings(smartIDs)
+	for i := 0; i < len(smartIDs) && len(buttons) < cardMaxButtons; i++ {
+		buttons = append(buttons, CardButton{
+			Text: "换 " + wecomChat.smartName(smartIDs[i]),
+			Key:  CardActionSwitch(smartIDs[i]),
+		})
+	}
+
+	return wecomChat.app.SendTemplateCard(&recipient,
+		NewButtonCard(card.TaskID, cardTitle(card.Question), wecomChat.smartName(session.SmartID)+" 的回答", buttons...))
+}
+
+// cardTitle 卡片标题最多显示 26 个字
+func cardTitle(question string) string {
+	if utf8.RuneCountInString(question) <= 26 {
+		return question
+	}
+	return string([]rune(question)[:25]) + "…"
+}
+
+// onCardEvent 处理答复卡片的按钮点击，按原提问重新向 smart 提问
+// https://developer.work.weixin.qq.com/document/path/90240#模板卡片事件推送
+func (wecomChat *WecomAppChat) onCardEvent(ctx context.Context, sessionID sc.SessionID, rxMsg *RxMessage) {
+	cache := sw.CacheWithContext(ctx, wecomChat.cache)
+	cardCache, ok := cache.(sw.CardCache)
+	if !ok {
+		return
+	}
+	card, err := cardCache.Card(rxMsg.TaskID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.Card %s", sessionID, err.Error()))
+		return
+	}
+	if card == nil || card.UserID != rxMsg.FromUserID {
+		log.Debug().Msg(fmt.Sprintf("[%s] card [%s] not found", sessionID, rxMsg.TaskID))
+		return
+	}
+
+	if rating, ok := cardRating(rxMsg.EventKey); ok {
+		wecomChat.onCardRating(ctx, sessionID, rxMsg, card, rating)
+		return
+	}
+
+	msg := &CardActionMessage{
+		RxMessage: rxMsg,
+		Card:      card,
+		Action:    rxMsg.EventKey,
+		content:   card.Question,
+		smartIDs:  []string{card.SmartID},
+	}
+	replaceName := "已重新生成"
+	switch {
+	case rxMsg.EventKey == CardActionRegenerate:
+	case rxMsg.EventKey == CardActionContinue:
+		msg.content = "继续"
+		msg.history = []sw.Message{
+			{Role: sw.MessageRoleUser, Content: card.Question},
+			{Role: sw.MessageRoleAssistant, Content: card.Answer},
+		}
+		replaceName = "已继续"
+	case strings.HasPrefix(rxMsg.EventKey, cardActionSwitch):
+		smartID := strings.TrimPrefix(rxMsg.EventKey, cardActionSwitch)
+		if !wecomChat.userSmartAllowed(cache, rxMsg.FromUserID, smartID) {
+			log.Warn().Msg(fmt.Sprintf("[%s] user [%s] access denied [%s]", sessionID, rxMsg.FromUserID, smartID))
+			return
+		}
+		msg.smartIDs = []string{smartID}
+		replaceName = "已切换到 " + wecomChat.smartName(smartID)
+	default:
+		log.Debug().Msg(fmt.Sprintf("[%s] card action [%s] unsupported", sessionID, rxMsg.EventKey))
+		return
+	}
+
+	// 按钮替换为已处理，避免重复点击
+	go func() {
+		if err := wecomChat.app.UpdateTemplateCardButton([]string{rxMsg.FromUserID},
+			rxMsg.ResponseCode, replaceName); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] update template card %s", sessionID, err.Error()))
+		}
+	}()
+
+	wecomChat.handle(ctx, sessionID, rxMsg.FromUserID, msg, nil)
+}
+
+// cardRating 按钮是否为评价按钮
+func cardRating(key string) (sw.Rating, bool) {
+	switch key {
+	case CardActionGood:
+		return sw.RatingGood, true
+	case CardActionBad:
+		return sw.RatingBad, true
+	default:
+		return 0, false
+	}
+}
+
+// onCardRating 保存卡片按钮的评价，评价后按钮替换为已评价
+func (wecomChat *WecomAppChat) onCardRating(ctx context.Context, sessionID sc.SessionID,
+	rxMsg *RxMessage, card *sw.Card, rating sw.Rating) {
+	user, _, err := wecomChat.lookupUser(ctx, sessionID, rxMsg.FromUserID)
+	if err != nil || user == nil {
+		return
+	}
+
+	if err = wecomChat.feedbackStore(ctx, &sw.Feedback{
+		SessionID: card.SessionID,
+		SmartID:   card.SmartID,
+		UserUID:   user.UID,
+		Question:  card.Question,
+		Answer:    card.Answer,
+	}, rxMsg.FromUserID, rating); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.FeedbackStore %s", sessionID, err.Error()))
+		return
+	}
+
+	go func() {
+		if err := wecomChat.app.UpdateTemplateCardButton([]string{rxMsg.FromUserID},
+			rxMsg.ResponseCode, "已评价"); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] update template card %s", sessionID, err.Error()))
+		}
+	}()
+}
+
+// userSmartAllowed 用户是否有权使用 smartID，包括部门与标签策略授予的 smart
+func (wecomChat *WecomAppChat) userSmartAllowed(cache sc.Cache, userID string, smartID string) bool {
+	if _, ok := wecomChat.smart[smartID]; !ok {
+		return false
+	}
+	userUID, err := cache.UserID2UID(fmt.Sprintf("%s:%s", wecomChat.userPlatform, userID))
+	if err != nil {
+		return false
+	}
+	allowed, err := sw.SmartAllowed(cache, userUID, smartID)
+	return err == nil && allowed
+}
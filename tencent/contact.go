@@ -0,0 +1,82 @@
+package tencent
+
+import (
+	"github.com/xen0n/go-workwx"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// DeptParents 应用可见部门的上级部门
+func (app *WecomApp) DeptParents() (map[int64]int64, error) {
+	depts, err := app.client.ListAllDepts()
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int64]int64, len(depts))
+	for i := range depts {
+		parents[depts[i].ID] = depts[i].ParentID
+	}
+	return parents, nil
+}
+
+// tagListResult 标签列表
+// https://developer.work.weixin.qq.com/document/path/90216
+type tagListResult struct {
+	qyapiResult
+	TagList []struct {
+		TagID   int64  `json:"tagid"`
+		TagName string `json:"tagname"`
+	} `json:"taglist"`
+}
+
+// tagMembersResult 标签成员
+// https://developer.work.weixin.qq.com/document/path/90213
+type tagMembersResult struct {
+	qyapiResult
+	UserList []struct {
+		UserID string `json:"userid"`
+	} `json:"userlist"`
+	PartyList []int64 `json:"partylist"`
+}
+
+// UserTags 成员所属的标签，包括通过所在部门加入的标签
+func (app *WecomApp) UserTags(users []*workwx.UserInfo) (map[string][]int64, error) {
+	var tags tagListResult
+	if err := app.get("/cgi-bin/tag/list", nil, &tags); err != nil {
+		return nil, err
+	}
+
+	userTags := make(map[string][]int64)
+	for _, tag := range tags.TagList {
+		var members tagMembersResult
+		if err := app.get("/cgi-bin/tag/get",
+			url.Values{"tagid": {strconv.FormatInt(tag.TagID, 10)}}, &members); err != nil {
+			return nil, err
+		}
+
+		tagged := make(map[string]bool)
+		for _, user := range members.UserList {
+			tagged[user.UserID] = true
+		}
+		parties := make(map[int64]bool)
+		for _, partyID := range members.PartyList {
+			parties[partyID] = true
+		}
+		for _, user := range users {
+			for _, dept := range user.Departments {
+				if parties[dept.DeptID] {
+					tagged[user.UserID] = true
+				}
+			}
+		}
+		for userID := range tagged {
+			userTags[userID] = append(userTags[userID], tag.TagID)
+		}
+	}
+	for userID := range userTags {
+		tagIDs := userTags[userID]
+		sort.Slice(tagIDs, func(i, j int) bool { return tagIDs[i] < tagIDs[j] })
+	}
+	return userTags, nil
+}
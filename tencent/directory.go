@@ -0,0 +1,212 @@
+package tencent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"github.com/xen0n/go-workwx"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirectoryToolName 通讯录查询工具的名称
+const DirectoryToolName = "wecom_directory"
+
+// DefaultDirectoryTTL 通讯录缓存的刷新间隔
+const DefaultDirectoryTTL = time.Hour
+
+// directoryMaxResults 单次查询最多返回的成员数
+const directoryMaxResults = 20
+
+// directoryParameters 通讯录查询工具的参数
+const directoryParameters = `{
+  "type": "object",
+  "properties": {
+    "query": {"type": "string", "description": "成员姓名、别名、UserID 或职务中的关键字，多个关键字以空格分隔，需要全部命中"},
+    "department": {"type": "string", "description": "部门名称中的关键字，如 上海、财务"},
+    "limit": {"type": "integer", "description": "最多返回的成员数，默认 10，最多 20"}
+  }
+}`
+
+// Directory 应用可见范围内的通讯录，供 smart 查询同事的部门、职务与联系方式
+// 只包含应用可见的部门及其成员，缓存 ttl 后重新读取
+type Directory struct {
+	app        *WecomApp
+	ttl        time.Duration
+	showMobile bool
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	paths    map[int64]string
+	users    []*workwx.UserInfo
+}
+
+// NewDirectory 创建通讯录，showMobile 为 false 时查询结果不包含手机号
+func NewDirectory(app *WecomApp, ttl time.Duration, showMobile bool) *Directory {
+	if ttl <= 0 {
+		ttl = DefaultDirectoryTTL
+	}
+	return &Directory{app: app, ttl: ttl, showMobile: showMobile}
+}
+
+// DirectoryEntry 查询结果中的成员
+type DirectoryEntry struct {
+	UserID   string `json:"userID"`
+	Name     string `json:"name"`
+	Alias    string `json:"alias,omitempty"`
+	Position string `json:"position,omitempty"`
+	// Departments 所属部门的完整路径，如 总部/上海分公司/财务部
+	Departments []string `json:"departments"`
+	// LeaderOf 担任上级的部门
+	LeaderOf  []string `json:"leaderOf,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	Telephone string   `json:"telephone,omitempty"`
+	Mobile    string   `json:"mobile,omitempty"`
+}
+
+// load 缓存过期时重新读取部门与成员，读取企微接口时不持有锁，读取完成后替换缓存
+func (directory *Directory) load() error {
+	directory.mu.Lock()
+	fresh := directory.users != nil && time.Since(directory.loadedAt) < directory.ttl
+	directory.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	depts, err := directory.app.Depts()
+	if err != nil {
+		return err
+	}
+	users, err := directory.app.ExportDepts()
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int64]*workwx.DeptInfo, len(depts))
+	for i := range depts {
+		byID[depts[i].ID] = depts[i]
+	}
+	paths := make(map[int64]string, len(depts))
+	for id := range byID {
+		var names []string
+		for dept, seen := byID[id], 0; dept != nil && seen < len(byID); dept, seen = byID[dept.ParentID], seen+1 {
+			names = append([]string{dept.Name}, names...)
+		}
+		paths[id] = strings.Join(names, "/")
+	}
+
+	directory.mu.Lock()
+	directory.paths, directory.users, directory.loadedAt = paths, users, time.Now()
+	directory.mu.Unlock()
+	return nil
+}
+
+// Search 查询 query 全部命中姓名、别名、UserID 或职务，且部门路径包含 department 的成员
+func (directory *Directory) Search(query string, department string, limit int) ([]DirectoryEntry, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	department = strings.ToLower(strings.TrimSpace(department))
+	if len(terms) == 0 && department == "" {
+		return nil, errors.New("query or department required")
+	}
+	if limit <= 0 {
+		limit = directoryMaxResults / 2
+	}
+	if limit > directoryMaxResults {
+		limit = directoryMaxResults
+	}
+	if err := directory.load(); err != nil {
+		return nil, err
+	}
+
+	directory.mu.Lock()
+	defer directory.mu.Unlock()
+	var entries []DirectoryEntry
+	for _, user := range directory.users {
+		entry := directory.entry(user)
+		if department != "" && !strings.Contains(strings.ToLower(strings.Join(entry.Departments, " ")), department) {
+			continue
+		}
+		text := strings.ToLower(strings.Join([]string{user.Name, user.Alias, user.UserID, user.Position}, " "))
+		matched := true
+		for i := range terms {
+			if !strings.Contains(text, terms[i]) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) >= limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (directory *Directory) entry(user *workwx.UserInfo) DirectoryEntry {
+	entry := DirectoryEntry{
+		UserID:    user.UserID,
+		Name:      user.Name,
+		Alias:     user.Alias,
+		Position:  user.Position,
+		Email:     user.Email,
+		Telephone: user.Telephone,
+	}
+	if directory.showMobile {
+		entry.Mobile = user.Mobile
+	}
+	for i := range user.Departments {
+		path, ok := directory.paths[user.Departments[i].DeptID]
+		if !ok {
+			continue
+		}
+		entry.Departments = append(entry.Departments, path)
+		if user.Departments[i].IsLeader {
+			entry.LeaderOf = append(entry.LeaderOf, path)
+		}
+	}
+	return entry
+}
+
+// Tool 通讯录查询工具，结果为 JSON，未找到时提示 smart 不要编造
+func (directory *Directory) Tool() *sw.Tool {
+	return &sw.Tool{
+		Name: DirectoryToolName,
+		Description: "查询公司企业微信通讯录中的同事，返回姓名、部门、职务、是否为部门负责人与联系方式。" +
+			"回答“谁负责某事”“某人在哪个部门”“怎么联系某人”等问题时必须使用此工具，不要编造人员信息。",
+		Parameters: json.RawMessage(directoryParameters),
+		// 通讯录只对企业内部成员开放
+		Internal: true,
+		// 首次查询需要读取整个通讯录
+		Timeout: 30 * time.Second,
+		Handler: func(ctx context.Context, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Query      string `json:"query"`
+				Department string `json:"department"`
+				Limit      int    `json:"limit"`
+			}
+			if len(arguments) > 0 {
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return "", err
+				}
+			}
+			entries, err := directory.Search(args.Query, args.Department, args.Limit)
+			if err != nil {
+				return "", err
+			}
+			if err = ctx.Err(); err != nil {
+				return "", err
+			}
+			if len(entries) == 0 {
+				return fmt.Sprintf("通讯录中没有找到 query=%q department=%q 的成员，请告知用户未找到，不要编造", args.Query, args.Department), nil
+			}
+			result, err := json.Marshal(entries)
+			return string(result), err
+		},
+	}
+}
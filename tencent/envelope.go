@@ -0,0 +1,177 @@
+package tencent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/xen0n/go-workwx"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// envelopeCrypto 企微回调消息加解密
+// https://developer.work.weixin.qq.com/document/path/90968
+type envelopeCrypto struct {
+	token string
+	key   []byte
+}
+
+func newEnvelopeCrypto(token string, encodingAESKey string) (*envelopeCrypto, error) {
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("encodingAESKey invalid")
+	}
+	return &envelopeCrypto{token: token, key: key}, nil
+}
+
+// verify 校验 msg_signature
+func (c *envelopeCrypto) verify(timestamp string, nonce string, encrypt string, signature string) bool {
+	params := []string{c.token, timestamp, nonce, encrypt}
+	sort.Strings(params)
+	expected := fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(params, ""))))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) == 1
+}
+
+// decryptText 解密 Encrypt 字段或 echostr，返回消息明文
+func (c *envelopeCrypto) decryptText(encrypt string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypt)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext invalid")
+	}
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, c.key[:aes.BlockSize]).CryptBlocks(plaintext, ciphertext)
+
+	// PKCS#7，块大小为 32
+	pad := int(plaintext[len(plaintext)-1])
+	if pad < 1 || pad > 32 || pad > len(plaintext) {
+		return nil, errors.New("padding invalid")
+	}
+	plaintext = plaintext[:len(plaintext)-pad]
+
+	// random(16) + msg_len(4) + msg + receiveid
+	if len(plaintext) < 20 {
+		return nil, errors.New("plaintext invalid")
+	}
+	msgLen := int(binary.BigEndian.Uint32(plaintext[16:20]))
+	if 20+msgLen > len(plaintext) {
+		return nil, errors.New("message length invalid")
+	}
+	return plaintext[20 : 20+msgLen], nil
+}
+
+// envelopeEncrypt 回调请求体中的密文
+func envelopeEncrypt(body []byte) (string, error) {
+	var envelope struct {
+		Encrypt string `xml:"Encrypt"`
+	}
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		return "", err
+	}
+	return envelope.Encrypt, nil
+}
+
+// rxKey 回调消息的标识，用于将请求的 ctx 与 RxExtras 对应到 go-workwx 解析后的消息
+type rxKey struct {
+	FromUserName string `xml:"FromUserName"`
+	CreateTime   int64  `xml:"CreateTime"`
+	MsgType      string `xml:"MsgType"`
+	MsgID        int64  `xml:"MsgId"`
+	Event        string `xml:"Event"`
+}
+
+// messageKey go-workwx 解析后的消息对应的 rxKey
+func messageKey(rxMsg *workwx.RxMessage) rxKey {
+	return rxKey{
+		FromUserName: rxMsg.FromUserID,
+		CreateTime:   rxMsg.SendTime.Unix(),
+		MsgType:      string(rxMsg.MsgType),
+		MsgID:        rxMsg.MsgID,
+		Event:        string(rxMsg.Event),
+	}
+}
+
+// extras 从回调请求体中读取 RxExtras 与消息标识，解析失败时返回空值
+// 仅用于读取 go-workwx 未解析的字段，签名校验与消息解析仍由 go-workwx 完成
+func (c *envelopeCrypto) extras(body []byte) (extras RxExtras, key rxKey) {
+	encrypt, err := envelopeEncrypt(body)
+	if err != nil {
+		return extras, key
+	}
+	msg, err := c.decryptText(encrypt)
+	if err != nil {
+		return extras, key
+	}
+	_ = xml.Unmarshal(msg, &extras)
+	_ = xml.Unmarshal(msg, &key)
+	return extras, key
+}
+
+// open 校验回调请求体的签名并解密，返回消息明文
+func (c *envelopeCrypto) open(query url.Values, body []byte) ([]byte, error) {
+	encrypt, err := envelopeEncrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	if !c.verify(query.Get("timestamp"), query.Get("nonce"), encrypt, query.Get("msg_signature")) {
+		return nil, errors.New("signature invalid")
+	}
+	return c.decryptText(encrypt)
+}
+
+// serve 处理回调请求：GET 校验回调地址，POST 校验签名并解密后交给 handle
+// handle 返回错误时响应 400，企微会重试推送
+func (c *envelopeCrypto) serve(w http.ResponseWriter, r *http.Request, handle func(plaintext []byte) error) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet: // 回调地址校验
+		echo := query.Get("echostr")
+		if !c.verify(query.Get("timestamp"), query.Get("nonce"), echo, query.Get("msg_signature")) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		plaintext, err := c.decryptText(echo)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(plaintext)
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		plaintext, err := c.open(query, body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err = handle(plaintext); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,250 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/tracing"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/rs/zerolog/log"
+	"github.com/xen0n/go-workwx"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 应用接收的事件类型
+// https://developer.work.weixin.qq.com/document/path/90240
+const (
+	eventSubscribe         = "subscribe"
+	eventEnterAgent        = "enter_agent"
+	eventTemplateCardEvent = "template_card_event"
+	eventChangeContact     = "change_contact"
+)
+
+// 通讯录成员变更类型
+// https://developer.work.weixin.qq.com/document/path/90970
+const (
+	changeTypeCreateUser = "create_user"
+	changeTypeUpdateUser = "update_user"
+	changeTypeDeleteUser = "delete_user"
+)
+
+// 通讯录成员状态
+const (
+	contactStatusActive   = 1
+	contactStatusDisabled = 2
+)
+
+// enterAgentWelcomeInterval 进入应用时欢迎语的最小发送间隔
+const enterAgentWelcomeInterval = 24 * time.Hour
+
+// DefaultWelcome 默认欢迎语与使用说明
+const DefaultWelcome = `**你好，我是智能助手**
+直接发送文字即可向我提问，例如：
+> 帮我写一封请假邮件
+
+回答后可以发送 <font color="info">/good</font> 或 <font color="warning">/bad</font> 评价最近一次回答。`
+
+// SetWelcome 设置关注应用与进入应用时发送的 markdown 欢迎语，为空时不发送
+func (wecomChat *WecomAppChat) SetWelcome(welcome string) {
+	wecomChat.welcome = welcome
+}
+
+// onEvent 处理应用事件，未支持的事件忽略
+func (wecomChat *WecomAppChat) onEvent(ctx context.Context, rxMsg *RxMessage) {
+	event := string(rxMsg.Event)
+	sessionID := sc.SessionID(fmt.Sprintf("%s:event:%s:%s:%d",
+		wecomChat.Platform(), event, rxMsg.FromUserID, rxMsg.SendTime.Unix()))
+	if event == eventTemplateCardEvent {
+		sessionID = sc.SessionID(fmt.Sprintf("%s:card:%s:%s", wecomChat.Platform(), rxMsg.TaskID, rxMsg.EventKey))
+	}
+
+	ctx, span := tracing.Start(ctx, "wecom.event",
+		attribute.String("session.id", string(sessionID)),
+		attribute.String("wecom.event", event))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	switch event {
+	case eventTemplateCardEvent:
+		wecomChat.onCardEvent(ctx, sessionID, rxMsg)
+	case eventSubscribe:
+		wecomChat.sendWelcome(sessionID, rxMsg.FromUserID)
+	case eventEnterAgent:
+		// 每次进入应用都会推送，间隔内只发送一次
+		if last, ok := wecomChat.welcomed.Load(rxMsg.FromUserID); ok &&
+			time.Since(last.(time.Time)) < enterAgentWelcomeInterval {
+			return
+		}
+		wecomChat.sendWelcome(sessionID, rxMsg.FromUserID)
+	default:
+		log.Debug().Msg(fmt.Sprintf("[%s] event [%s] ignored", sessionID, event))
+	}
+}
+
+func (wecomChat *WecomAppChat) sendWelcome(sessionID sc.SessionID, userID string) {
+	if wecomChat.welcome == "" {
+		return
+	}
+	wecomChat.welcomed.Store(userID, time.Now())
+	if err := wecomChat.app.client.SendMarkdownMessage(&workwx.Recipient{UserIDs: []string{userID}},
+		wecomChat.welcome, false); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] send welcome %s", sessionID, err.Error()))
+	}
+}
+
+// onContactChange 通讯录成员变更时同步 sc.User 与 user:uid 绑定
+// 新增成员使用 SetDefaultSmarts 设置的 smart，删除或禁用成员时停用用户
+func (wecomChat *WecomAppChat) onContactChange(ctx context.Context, extras *RxExtras) {
+	ctx, span := tracing.Start(ctx, "wecom.contact_change",
+		attribute.String("wecom.change_type", extras.ChangeType),
+		attribute.String("wecom.user_id", extras.UserID))
+	defer span.End()
+
+	cache := sw.CacheWithContext(ctx, wecomChat.cache)
+	userID := fmt.Sprintf("%s:%s", wecomChat.userPlatform, extras.UserID)
+
+	var err error
+	switch extras.ChangeType {
+	case changeTypeCreateUser:
+		err = sw.ProvisionUser(cache, userID, &sc.User{
+			UID:    sc.UserUID(utils.MD5(extras.UserID)), // 与 ConfigureWecomUsers 相同
+			Name:   extras.Name,
+			Status: sc.UserStatusActive,
+		}, wecomChat.defaultSmarts...)
+	case changeTypeUpdateUser:
+		err = wecomChat.updateContact(cache, userID, extras)
+	case changeTypeDeleteUser:
+		err = wecomChat.deactivateContact(cache, userID, sc.UserStatusBlock, true)
+	default:
+		return
+	}
+	if err == nil && extras.ChangeType != changeTypeDeleteUser {
+		err = wecomChat.storeContactProfile(cache, extras)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] change contact [%s] %s", extras.UserID, extras.ChangeType, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[%s] change contact [%s] synced", extras.UserID, extras.ChangeType))
+}
+
+// updateContact 同步成员的名称、状态与 UserID 变更，未导入的成员按新增处理
+func (wecomChat *WecomAppChat) updateContact(cache sc.Cache, userID string, extras *RxExtras) error {
+	userUID, err := cache.UserID2UID(userID)
+	if err != nil {
+		if extras.Status == contactStatusDisabled {
+			return nil
+		}
+		return sw.ProvisionUser(cache, userID, &sc.User{
+			UID:    sc.UserUID(utils.MD5(extras.UserID)),
+			Name:   extras.Name,
+			Status: sc.UserStatusActive,
+		}, wecomChat.defaultSmarts...)
+	}
+
+	user, err := cache.User(userUID)
+	if err != nil || user == nil {
+		return err
+	}
+	if extras.Name != "" {
+		user.Name = extras.Name
+	}
+	switch extras.Status {
+	case contactStatusActive:
+		if user.Status, err = sw.SuspendedStatus(cache, userUID, sc.UserStatusActive); err != nil {
+			return err
+		}
+	case contactStatusDisabled:
+		user.Status = sc.UserStatusDown
+	}
+	if err = cache.UserStore(user); err != nil {
+		return err
+	}
+
+	// UserID 变更时绑定新的 UserID，UserUID 保持不变
+	if extras.NewUserID != "" && extras.NewUserID != extras.UserID {
+		if err = cache.UserUIDBind(fmt.Sprintf("%s:%s", wecomChat.userPlatform, extras.NewUserID), userUID); err != nil {
+			return err
+		}
+		return unbindUser(cache, userID)
+	}
+	return nil
+}
+
+// deactivateContact 停用用户，unbind 为 true 时同时解除 UserID 绑定
+func (wecomChat *WecomAppChat) deactivateContact(cache sc.Cache, userID string,
+	status sc.UserStatus, unbind bool) error {
+	userUID, err := cache.UserID2UID(userID)
+	if err != nil {
+		return nil // 未导入的成员无需处理
+	}
+	user, err := cache.User(userUID)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		user.Status = status
+		if err = cache.UserStore(user); err != nil {
+			return err
+		}
+	}
+	if unbind {
+		// 删除的成员不再执行其创建的定时任务
+		if _, err = sw.RemoveCreatorSchedules(cache, userID); err != nil {
+			return err
+		}
+		return unbindUser(cache, userID)
+	}
+	return nil
+}
+
+func unbindUser(cache sc.Cache, userID string) error {
+	bindCache, ok := cache.(sw.UserBindCache)
+	if !ok {
+		return nil
+	}
+	return bindCache.UserUIDUnbind(userID)
+}
+
+// storeContactProfile 保存事件中变更的部门与职务，未变更的字段保持不变
+func (wecomChat *WecomAppChat) storeContactProfile(cache sc.Cache, extras *RxExtras) error {
+	profileCache, ok := cache.(sw.UserProfileCache)
+	if !ok || (extras.Department == "" && extras.Position == "") {
+		return nil
+	}
+	contactID := extras.UserID
+	if extras.NewUserID != "" {
+		contactID = extras.NewUserID
+	}
+	userUID, err := cache.UserID2UID(fmt.Sprintf("%s:%s", wecomChat.userPlatform, contactID))
+	if err != nil {
+		return nil
+	}
+	profile, err := profileCache.UserProfile(userUID)
+	if err != nil {
+		return err
+	}
+	if profile == nil {
+		profile = &sw.UserProfile{}
+	}
+	profile.UserID = contactID
+	if extras.Department != "" {
+		profile.DeptIDs = profile.DeptIDs[:0]
+		for _, id := range strings.Split(extras.Department, ",") {
+			if deptID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64); err == nil {
+				profile.DeptIDs = append(profile.DeptIDs, deptID)
+			}
+		}
+	}
+	if extras.Position != "" {
+		profile.Title = extras.Position
+	}
+	return profileCache.UserProfileStore(userUID, profile)
+}
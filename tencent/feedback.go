@@ -0,0 +1,123 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// 评价最近一次答复的指令
+const (
+	feedbackGood = "/good"
+	feedbackBad  = "/bad"
+)
+
+// feedbackRating 消息是否为评价指令
+func feedbackRating(content string) (sw.Rating, bool) {
+	switch strings.ToLower(strings.TrimSpace(content)) {
+	case feedbackGood:
+		return sw.RatingGood, true
+	case feedbackBad:
+		return sw.RatingBad, true
+	default:
+		return 0, false
+	}
+}
+
+// UserDeptIDs 企微用户所属部门，查询失败时返回空
+func (app *WecomApp) UserDeptIDs(userID string) []int64 {
+	user, err := app.client.GetUser(userID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("get user [%s] %s", userID, err.Error()))
+		return nil
+	}
+	deptIDs := make([]int64, 0, len(user.Departments))
+	for i := range user.Departments {
+		deptIDs = append(deptIDs, user.Departments[i].DeptID)
+	}
+	return deptIDs
+}
+
+// SetDeptResolver 设置评价时查询用户所属部门的方法，用于按部门统计满意度
+func (p *pipeline) SetDeptResolver(resolver func(userID string) []int64) {
+	p.userDepts = resolver
+}
+
+func (p *pipeline) feedbackCache(ctx context.Context) (sw.FeedbackCache, bool) {
+	feedbackCache, ok := sw.CacheWithContext(ctx, p.cache).(sw.FeedbackCache)
+	return feedbackCache, ok
+}
+
+// feedbackRemember 保存用户最近一次答复，用于 /good /bad 评价
+func (p *pipeline) feedbackRemember(ctx context.Context, session *sc.Session, question string, templateRef string) {
+	feedbackCache, ok := p.feedbackCache(ctx)
+	if !ok {
+		return
+	}
+	if err := feedbackCache.FeedbackPendingStore(&sw.Feedback{
+		SessionID:  session.ID,
+		SmartID:    session.SmartID,
+		UserUID:    session.User.UID,
+		Template:   templateRef,
+		Question:   question,
+		Answer:     fmt.Sprint(session.Answer),
+		AnsweredAt: time.Now(),
+	}); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.FeedbackPendingStore %s", session.ID, err.Error()))
+	}
+}
+
+// feedbackStore 补充评价人信息后保存评价
+func (p *pipeline) feedbackStore(ctx context.Context, feedback *sw.Feedback,
+	userID string, rating sw.Rating) error {
+	feedbackCache, ok := p.feedbackCache(ctx)
+	if !ok {
+		return errors.New("cache does not support feedback")
+	}
+	feedback.UserID = userID
+	feedback.Rating = rating
+	feedback.RatedAt = time.Now()
+	if p.userDepts != nil {
+		feedback.DeptIDs = p.userDepts(userID)
+	}
+	return feedbackCache.FeedbackStore(feedback)
+}
+
+// rate 评价用户最近一次答复并答复评价结果
+func (p *pipeline) rate(ctx context.Context, session sc.Session, userID string, rating sw.Rating) {
+	feedbackCache, ok := p.feedbackCache(ctx)
+	if !ok {
+		return
+	}
+	feedback, err := feedbackCache.FeedbackPending(session.User.UID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.FeedbackPending %s", session.ID, err.Error()))
+		return
+	}
+	if feedback == nil {
+		p.reply(session, "没有可以评价的回答")
+		return
+	}
+
+	if err = p.feedbackStore(ctx, feedback, userID, rating); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.FeedbackStore %s", session.ID, err.Error()))
+		return
+	}
+	p.reply(session, "感谢你的反馈")
+}
+
+// reply 不经过 smart 直接答复用户，只使用渠道的发送方法，不执行其它答复处理器
+func (p *pipeline) reply(session sc.Session, answer string) {
+	if p.replier == nil {
+		return
+	}
+	session.Answer = answer
+	if err := p.replier(&session); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] reply %s", session.ID, err.Error()))
+	}
+}
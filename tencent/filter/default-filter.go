@@ -1,11 +1,12 @@
 package filter
 
 import (
+	"context"
 	"fmt"
 	sc "github.com/openai-smart/smart-chat"
 	"github.com/openai-smart/smart-chat/chat"
-	"github.com/pkg/errors"
-	"github.com/xen0n/go-workwx"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/tencent"
 	"time"
 )
 
@@ -35,50 +36,56 @@ func (filter *DefaultFilter) DoFilter(session *sc.Session) (err error) {
 	return nil
 }
 
+// DoFilterContext 使用绑定 ctx 的 cache 执行拦截
+func (filter *DefaultFilter) DoFilterContext(ctx context.Context, session *sc.Session) error {
+	f := *filter
+	f.cache = sw.CacheWithContext(ctx, filter.cache)
+	return f.DoFilter(session)
+}
+
 func (filter *DefaultFilter) IncomingMessageFilter(session *sc.Session) error {
 
-	rxMsg := session.Question.(*workwx.RxMessage)
-	msgType := coverWecomMsgType(rxMsg.MsgType)
+	msg := session.Question.(tencent.IncomingMessage)
+	msgType := msg.Type()
 
 	// 拦截超时消息
-	t := time.Now().Sub(rxMsg.SendTime)
+	t := time.Now().Sub(msg.Time())
 	if t > 10*time.Second {
-		return errors.New(fmt.Sprintf("[%d] overtime %s", t, session.ID))
+		return reject("overtime", fmt.Sprintf("[%d] overtime %s", t, session.ID))
 	}
 
 	// 拦截重复消息
 	status, err := filter.cache.SessionStatus(session.ID)
 	if err != nil {
-		return errors.New(err.Error())
+		return reject("cache", err.Error())
 	}
 
 	if status == sc.SessionStatusProcessing || status == sc.SessionStatusCompletion {
-		return errors.New(fmt.Sprintf("[%s] message status [%d] multiple sending ", session.ID, status))
+		return reject("duplicate", fmt.Sprintf("[%s] message status [%d] multiple sending ", session.ID, status))
 	}
 
 	// 拦截非MessageTypeText类型消息
 	if msgType != sc.MessageTypeText {
-		return errors.New(fmt.Sprintf("[%s] message type [%s] unsupported", session.ID, msgType))
+		return reject("unsupported", fmt.Sprintf("[%s] message type [%s] unsupported", session.ID, msgType))
 	}
 
 	return nil
 }
 
-// coverWecomMsgType TODO 实现其它消息类型转换
-func coverWecomMsgType(msgType any) sc.MessageType {
-	switch msgType.(workwx.MessageType) {
-	case workwx.MessageTypeText:
-		return sc.MessageTypeText
-	default:
-		return sc.MessageTypeUnknown
-	}
-}
-
 func (filter *DefaultFilter) AccessFilter(session *sc.Session) error {
 
 	// 权限检查
 	if session.User == nil {
-		return errors.New(fmt.Sprintf("[%s] Unauthorized", session.ID))
+		return reject("unauthorized", fmt.Sprintf("[%s] Unauthorized", session.ID))
+	}
+
+	// 状态、smart 授权与每日提问次数，群聊配置的 smart 不指定 SmartID 拦截，同样需要检查次数
+	reason, message, err := sw.UserAccess(filter.cache, session.User, session.SmartID)
+	if err != nil {
+		return reject("cache", err.Error())
+	}
+	if reason != "" {
+		return reject(reason, fmt.Sprintf("[%s] %s", session.ID, message))
 	}
 
 	// 余额检查
@@ -86,6 +93,5 @@ func (filter *DefaultFilter) AccessFilter(session *sc.Session) error {
 	//if balance <= 0 {
 	//	return errors.New(fmt.Sprintf("[%d] Sorry, your credit is running low", session.ID))
 	//}
-	// TODO 次数拦截器
 	return nil
 }
@@ -0,0 +1,184 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/tencent"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 审核不通过时答复用户的提示
+const (
+	ModerationQuestionNotice = "你的提问包含不适宜的内容，无法回答"
+	ModerationAnswerNotice   = "该回答包含不适宜的内容，已被拦截"
+	ModerationWarnNotice     = "\n\n（以上内容可能包含不适宜的信息，请谨慎使用）"
+)
+
+// moderationMemorySize 提问审核结果的缓存数量，同一提问向多个 smart 提问时只审核一次
+const moderationMemorySize = 1024
+
+// ModerationFilter 内容审核，作为拦截器审核提问，CompletionHandler 审核答复
+// 审核接口出错时放行并记录日志
+type ModerationFilter struct {
+	chat.Filter
+	cache      sc.Cache
+	moderators []sw.Moderator
+
+	questionAction sw.ModerationAction
+	answerAction   sw.ModerationAction
+	// redactor 不为空时外部审核接口只收到脱敏后的内容
+	redactor *sw.Redactor
+
+	mu      sync.Mutex
+	checked map[sc.SessionID]*sw.ModerationResult
+}
+
+// NewModerationFilter 创建内容审核，questionAction 与 answerAction 为空时不审核对应内容
+func NewModerationFilter(cache sc.Cache, questionAction sw.ModerationAction,
+	answerAction sw.ModerationAction, moderators ...sw.Moderator) *ModerationFilter {
+	return &ModerationFilter{
+		cache:          cache,
+		moderators:     moderators,
+		questionAction: questionAction,
+		answerAction:   answerAction,
+		checked:        make(map[sc.SessionID]*sw.ModerationResult),
+	}
+}
+
+// SetRedactor 外部审核前脱敏，本地黑名单仍审核原文
+func (filter *ModerationFilter) SetRedactor(redactor *sw.Redactor) {
+	filter.redactor = redactor
+}
+
+func (filter *ModerationFilter) DoFilter(session *sc.Session) error {
+	return filter.DoFilterContext(context.Background(), session)
+}
+
+// DoFilterContext 审核提问，block 与 replace 拒绝会话并答复提示，warn 只记录
+func (filter *ModerationFilter) DoFilterContext(ctx context.Context, session *sc.Session) error {
+	if filter.questionAction == "" || session.User == nil {
+		return nil
+	}
+	msg, ok := session.Question.(tencent.IncomingMessage)
+	if !ok || msg.Content() == "" {
+		return nil
+	}
+
+	result, cached := filter.remembered(session.ID)
+	if !cached {
+		result = filter.moderate(ctx, msg.Content())
+		filter.remember(session.ID, result)
+		if result.Flagged {
+			filter.store(ctx, session, sw.ModerationStageQuestion, filter.questionAction, result, msg.Content())
+		}
+	}
+	if !result.Flagged || filter.questionAction == sw.ModerationWarn {
+		return nil
+	}
+	return rejectWithNotice("moderation", fmt.Sprintf("[%s] question flagged by %s %v",
+		session.ID, result.Source, result.Categories), ModerationQuestionNotice)
+}
+
+// CompletionHandler 审核答复，需在发送答复的处理器之前添加
+func (filter *ModerationFilter) CompletionHandler(session *sc.Session) error {
+	answer, ok := session.Answer.(string)
+	if filter.answerAction == "" || !ok || answer == "" {
+		return nil
+	}
+	ctx := context.Background()
+	result := filter.moderate(ctx, answer)
+	if !result.Flagged {
+		return nil
+	}
+	filter.store(ctx, session, sw.ModerationStageAnswer, filter.answerAction, result, answer)
+
+	switch filter.answerAction {
+	case sw.ModerationWarn:
+		session.Answer = answer + ModerationWarnNotice
+	case sw.ModerationReplace:
+		if len(result.Matches) > 0 {
+			session.Answer = sw.MaskMatches(answer, result.Matches)
+		} else {
+			session.Answer = ModerationAnswerNotice
+		}
+	default:
+		session.Answer = ModerationAnswerNotice
+	}
+	return nil
+}
+
+// moderate 依次执行审核，任一审核不通过即返回
+// 开启脱敏时发送到外部审核接口的是脱敏后的内容，答复同样先脱敏再审核
+func (filter *ModerationFilter) moderate(ctx context.Context, text string) *sw.ModerationResult {
+	redacted := text
+	if filter.redactor != nil {
+		question, _ := filter.redactor.Redact(text)
+		redacted = sw.QuestionText(question)
+	}
+	for i := range filter.moderators {
+		content := redacted
+		if local, ok := filter.moderators[i].(sw.LocalModerator); ok && local.Local() {
+			content = text
+		}
+		result, err := filter.moderators[i].Moderate(ctx, content)
+		if err != nil {
+			log.Warn().Msg(fmt.Sprintf("moderate %T %s", filter.moderators[i], err.Error()))
+			continue
+		}
+		if result.Flagged {
+			return result
+		}
+	}
+	return &sw.ModerationResult{}
+}
+
+func (filter *ModerationFilter) remembered(sessionID sc.SessionID) (*sw.ModerationResult, bool) {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	result, ok := filter.checked[sessionID]
+	return result, ok
+}
+
+func (filter *ModerationFilter) remember(sessionID sc.SessionID, result *sw.ModerationResult) {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	if len(filter.checked) >= moderationMemorySize {
+		filter.checked = make(map[sc.SessionID]*sw.ModerationResult)
+	}
+	filter.checked[sessionID] = result
+}
+
+// store 保存审核记录，保存失败只记录日志
+func (filter *ModerationFilter) store(ctx context.Context, session *sc.Session, stage sw.ModerationStage,
+	action sw.ModerationAction, result *sw.ModerationResult, content string) {
+	log.Warn().Msg(fmt.Sprintf("[%s] %s flagged by %s [%s], %s", session.ID, stage, result.Source,
+		strings.Join(result.Categories, ","), action))
+
+	moderationCache, ok := sw.CacheWithContext(ctx, filter.cache).(sw.ModerationCache)
+	if !ok {
+		return
+	}
+	incident := &sw.ModerationIncident{
+		Time:       time.Now(),
+		SessionID:  session.ID,
+		SmartID:    session.SmartID,
+		Stage:      stage,
+		Source:     result.Source,
+		Categories: result.Categories,
+		Matches:    result.Matches,
+		Action:     action,
+		Content:    content,
+	}
+	if session.User != nil {
+		incident.UserUID = session.User.UID
+	}
+	if err := moderationCache.ModerationIncidentStore(incident); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.ModerationIncidentStore %s", session.ID, err.Error()))
+	}
+}
@@ -0,0 +1,32 @@
+package filter
+
+// Rejection 拦截器拒绝会话的错误，Reason 用于按原因统计
+type Rejection struct {
+	reason  string
+	message string
+	// notice 答复给用户的提示，为空时不答复
+	notice string
+}
+
+func reject(reason string, message string) error {
+	return &Rejection{reason: reason, message: message}
+}
+
+// rejectWithNotice 拒绝会话并答复用户 notice
+func rejectWithNotice(reason string, message string, notice string) error {
+	return &Rejection{reason: reason, message: message, notice: notice}
+}
+
+func (r *Rejection) Error() string {
+	return r.message
+}
+
+// Reason 拦截原因
+func (r *Rejection) Reason() string {
+	return r.reason
+}
+
+// Notice 答复给用户的提示
+func (r *Rejection) Notice() string {
+	return r.notice
+}
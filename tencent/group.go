@@ -0,0 +1,54 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/rs/zerolog/log"
+)
+
+// groupCache cache 支持群聊存储时返回绑定 ctx 的 GroupCache
+func (p *pipeline) groupCache(ctx context.Context) (sw.GroupCache, bool) {
+	groupCache, ok := sw.CacheWithContext(ctx, p.cache).(sw.GroupCache)
+	return groupCache, ok
+}
+
+// groupQuestion 带上群聊上下文的提问，群成员共享同一份上下文
+func (p *pipeline) groupQuestion(ctx context.Context, group *sw.Group,
+	smartID string, question string) sc.Question {
+	conversation := sw.Conversation{Question: question}
+	if group.MemorySize <= 0 {
+		return conversation
+	}
+
+	groupCache, ok := p.groupCache(ctx)
+	if !ok {
+		return conversation
+	}
+	history, err := groupCache.GroupMemory(group.ChatID, smartID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.GroupMemory %s", group.ChatID, err.Error()))
+		return conversation
+	}
+	conversation.History = history
+	return conversation
+}
+
+// groupRemember 保存群聊上下文
+func (p *pipeline) groupRemember(ctx context.Context, group *sw.Group,
+	smartID string, question string, answer sc.Answer) {
+	if group.MemorySize <= 0 {
+		return
+	}
+	groupCache, ok := p.groupCache(ctx)
+	if !ok {
+		return
+	}
+	if err := groupCache.GroupMemoryAppend(group.ChatID, smartID, group.MemorySize,
+		sw.Message{Role: sw.MessageRoleUser, Content: question},
+		sw.Message{Role: sw.MessageRoleAssistant, Content: fmt.Sprint(answer)},
+	); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.GroupMemoryAppend %s", group.ChatID, err.Error()))
+	}
+}
@@ -0,0 +1,291 @@
+package tencent
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/tracing"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// kfSyncTimeout 一次拉取并处理客服消息的超时时间
+const kfSyncTimeout = 30 * time.Second
+
+// kfOriginCustomer 消息来源为微信客户
+const kfOriginCustomer = 3
+
+// WecomKfEventConfigure 微信客服接收事件服务器配置
+type WecomKfEventConfigure struct {
+	Uri            string
+	Token          string
+	EncodingAESKey string
+}
+
+// KfMessage 微信客服消息
+// https://developer.work.weixin.qq.com/document/path/94670
+type KfMessage struct {
+	MsgID          string `json:"msgid"`
+	OpenKfID       string `json:"open_kfid"`
+	ExternalUserID string `json:"external_userid"`
+	SendTime       int64  `json:"send_time"`
+	// Origin 消息来源，3 客户 4 系统推送 5 接待人员
+	Origin         int    `json:"origin"`
+	ServicerUserID string `json:"servicer_userid"`
+	MsgType        string `json:"msgtype"`
+	Text           struct {
+		Content string `json:"content"`
+		MenuID  string `json:"menu_id"`
+	} `json:"text"`
+}
+
+func (m *KfMessage) Type() sc.MessageType {
+	switch m.MsgType {
+	case "text":
+		return sc.MessageTypeText
+	default:
+		return sc.MessageTypeUnknown
+	}
+}
+
+func (m *KfMessage) Time() time.Time {
+	return time.Unix(m.SendTime, 0)
+}
+
+func (m *KfMessage) Content() string {
+	return m.Text.Content
+}
+
+// kfSyncResult sync_msg 返回结果
+type kfSyncResult struct {
+	qyapiResult
+	NextCursor string      `json:"next_cursor"`
+	HasMore    int         `json:"has_more"`
+	MsgList    []KfMessage `json:"msg_list"`
+}
+
+// KfSyncMsg 拉取微信客服消息，token 为回调事件中的 Token
+// https://developer.work.weixin.qq.com/document/path/94670
+func (app *WecomApp) KfSyncMsg(openKfID string, cursor string, token string) (*kfSyncResult, error) {
+	var result kfSyncResult
+	err := app.post("/cgi-bin/kf/sync_msg", map[string]any{
+		"cursor":    cursor,
+		"token":     token,
+		"limit":     1000,
+		"open_kfid": openKfID,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// KfSendText 以客服账号发送文本消息，微信客服不支持 markdown
+// https://developer.work.weixin.qq.com/document/path/94677
+func (app *WecomApp) KfSendText(openKfID string, externalUserID string, content string) error {
+	err := app.post("/cgi-bin/kf/send_msg", map[string]any{
+		"touser":    externalUserID,
+		"open_kfid": openKfID,
+		"msgtype":   "text",
+		"text": map[string]string{
+			"content": content,
+		},
+	}, nil)
+	if err != nil {
+		monitor.WecomSendFailures.Inc()
+	}
+	return err
+}
+
+// WecomKfChat 微信客服聊天，外部微信用户通过客服账号提问
+// 需要应用已获得微信客服权限，与 WecomAppChat 共用 smart、拦截器与 cache
+type WecomKfChat struct {
+	chat.Chat
+	*pipeline
+
+	app *WecomApp
+	mux *http.ServeMux
+
+	// mu 同一时间只拉取一次消息，避免游标被并发覆盖
+	mu sync.Mutex
+}
+
+// NewWecomKfChat 创建微信客服聊天，外部用户ID使用 wecom-kf 平台前缀绑定 UserUID
+func NewWecomKfChat(app *WecomApp, smart map[string]smart.Smart,
+	filter []chat.Filter, cache sc.Cache) chat.Chat {
+	kf := &WecomKfChat{
+		pipeline: newPipeline("wecom-kf", smart, filter, cache),
+		app:      app,
+		mux:      http.NewServeMux(),
+	}
+	kf.replier = kf.KfCompletionHandler
+	return kf
+}
+
+func (kf *WecomKfChat) Platform() string {
+	return "wecom-kf"
+}
+
+// KfCompletionHandler 通过客服账号答复外部用户
+func (kf *WecomKfChat) KfCompletionHandler(session *sc.Session) error {
+	msg := session.Question.(*KfMessage)
+	// TODO 内容大小判断，超出则分批发送
+	return kf.app.KfSendText(msg.OpenKfID, msg.ExternalUserID, session.Answer.(string))
+}
+
+// kfEvent 微信客服回调事件，只通知有新消息，消息内容需要通过 sync_msg 拉取
+type kfEvent struct {
+	MsgType  string `xml:"MsgType"`
+	Event    string `xml:"Event"`
+	Token    string `xml:"Token"`
+	OpenKfID string `xml:"OpenKfId"`
+}
+
+// sync 按游标拉取客服账号的新消息并处理
+func (kf *WecomKfChat) sync(ctx context.Context, event *kfEvent) {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	ctx, span := tracing.Start(ctx, "wecom.kf.sync", attribute.String("wecom.open_kfid", event.OpenKfID))
+	defer span.End()
+
+	kfCache, ok := sw.CacheWithContext(ctx, kf.cache).(sw.KfCache)
+	if !ok {
+		log.Error().Msg("cache does not support kf cursor")
+		return
+	}
+	cursor, err := kfCache.KfCursor(event.OpenKfID)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("[%s] cache.KfCursor %s", event.OpenKfID, err.Error()))
+		return
+	}
+
+	for {
+		result, err := kf.app.KfSyncMsg(event.OpenKfID, cursor, event.Token)
+		if err != nil {
+			tracing.End(span, err)
+			log.Error().Msg(fmt.Sprintf("[%s] kf sync_msg %s", event.OpenKfID, err.Error()))
+			return
+		}
+
+		for i := range result.MsgList {
+			if result.MsgList[i].Origin != kfOriginCustomer {
+				continue
+			}
+			kf.onIncomingMessage(ctx, &result.MsgList[i])
+		}
+
+		// 处理后再保存游标，保存失败时下次会重新拉取，重复消息由拦截器过滤
+		cursor = result.NextCursor
+		if err = kfCache.KfCursorStore(event.OpenKfID, cursor); err != nil {
+			log.Error().Msg(fmt.Sprintf("[%s] cache.KfCursorStore %s", event.OpenKfID, err.Error()))
+		}
+		if result.HasMore == 0 {
+			return
+		}
+	}
+}
+
+func (kf *WecomKfChat) onIncomingMessage(ctx context.Context, msg *KfMessage) {
+	log.Debug().Msg(fmt.Sprintf("incoming kf message: %s %s", msg.OpenKfID, msg.MsgID))
+	monitor.IncomingMessages.WithLabelValues(msg.MsgType).Inc()
+
+	sessionID := sc.SessionID(fmt.Sprintf("%s:%s", kf.Platform(), msg.MsgID))
+
+	ctx, span := tracing.Start(ctx, "wecom.kf.message",
+		attribute.String("session.id", string(sessionID)),
+		attribute.String("wecom.msg_type", msg.MsgType))
+	defer span.End()
+
+	kf.register(ctx, sessionID, msg.ExternalUserID)
+	kf.handle(ctx, sessionID, msg.ExternalUserID, msg, nil)
+}
+
+// register 外部用户未绑定时使用 defaultSmarts 自动注册
+func (kf *WecomKfChat) register(ctx context.Context, sessionID sc.SessionID, externalUserID string) {
+	if len(kf.defaultSmarts) == 0 {
+		return
+	}
+
+	cache := sw.CacheWithContext(ctx, kf.cache)
+	userID := fmt.Sprintf("%s:%s", kf.userPlatform, externalUserID)
+	if _, err := cache.UserID2UID(userID); err == nil {
+		return
+	}
+
+	user := &sc.User{
+		UID:    sc.UserUID(utils.MD5(userID)),
+		Name:   externalUserID,
+		Status: sc.UserStatusActive,
+	}
+	if err := sw.ProvisionUser(cache, userID, user, kf.defaultSmarts...); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] register kf user [%s] %s", sessionID, externalUserID, err.Error()))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[%s] register kf user [%s] as [%s]", sessionID, externalUserID, user.UID))
+}
+
+// AddEventHandler 创建微信客服接收事件API处理器
+// https://developer.work.weixin.qq.com/document/path/94670
+func (kf *WecomKfChat) AddEventHandler(ec chat.EventConfigure) error {
+	configure := ec.(*WecomKfEventConfigure)
+	crypto, err := newEnvelopeCrypto(configure.Token, configure.EncodingAESKey)
+	if err != nil {
+		return err
+	}
+
+	kf.mux.HandleFunc(configure.Uri, func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "wecom.kf.callback", attribute.String("http.route", configure.Uri))
+		defer span.End()
+
+		crypto.serve(w, r, func(plaintext []byte) error {
+			var event kfEvent
+			if err := xml.Unmarshal(plaintext, &event); err != nil {
+				return err
+			}
+			if event.Event != "kf_msg_or_event" {
+				return nil
+			}
+			// 拉取消息可能较慢，先响应回调避免企微重试
+			go func() {
+				ctx, cancel := context.WithTimeout(tracing.Detach(ctx), kfSyncTimeout)
+				defer cancel()
+				kf.sync(ctx, &event)
+			}()
+			return nil
+		})
+	})
+	return nil
+}
+
+func (kf *WecomKfChat) AddCompletionHandler(ch chat.CompletionHandler) {
+	// TODO 同步锁
+	kf.chs = append(kf.chs, ch)
+}
+
+func (kf *WecomKfChat) Accept(addr string) error {
+	if err := http.ListenAndServe(addr, kf.mux); err != nil {
+		log.Fatal().Msg(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (kf *WecomKfChat) Filters() []chat.Filter {
+	return kf.filters[:]
+}
+
+func (kf *WecomKfChat) AddFilter(filter chat.Filter) {
+	// TODO 同步锁
+	kf.filters = append(kf.filters, filter)
+}
@@ -0,0 +1,73 @@
+package tencent
+
+import (
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/xen0n/go-workwx"
+	"time"
+)
+
+// RxMessage 企微消息，补充 go-workwx 未解析的字段
+type RxMessage struct {
+	*workwx.RxMessage
+	RxExtras
+}
+
+func (m *RxMessage) Type() sc.MessageType {
+	return coverWecomMsgType(m.MsgType)
+}
+
+func (m *RxMessage) Time() time.Time {
+	return m.SendTime
+}
+
+func (m *RxMessage) Content() string {
+	text, ok := m.Text()
+	if !ok {
+		return ""
+	}
+	return text.GetContent()
+}
+
+// Recipient 答复的接收者，应用只接收单聊消息
+func (m *RxMessage) Recipient() workwx.Recipient {
+	return workwx.Recipient{UserIDs: []string{m.FromUserID}}
+}
+
+// coverWecomMsgType TODO 实现其它消息类型转换
+func coverWecomMsgType(msgType workwx.MessageType) sc.MessageType {
+	switch msgType {
+	case workwx.MessageTypeText:
+		return sc.MessageTypeText
+	default:
+		return sc.MessageTypeUnknown
+	}
+}
+
+// RxExtras go-workwx 未解析的消息字段
+type RxExtras struct {
+	// Event 事件类型，go-workwx 无法解析部分事件时用于自行处理
+	EventName string `xml:"Event"`
+
+	// 以下为 change_contact 通讯录变更事件字段
+	ChangeType string `xml:"ChangeType"`
+	UserID     string `xml:"UserID"`
+	NewUserID  string `xml:"NewUserID"`
+	Name       string `xml:"Name"`
+	Department string `xml:"Department"`
+	Position   string `xml:"Position"`
+	// Status 成员状态，1 已激活 2 已禁用 4 未激活 5 退出企业
+	Status int `xml:"Status"`
+
+	// 以下为 template_card_event 模板卡片事件字段
+	EventKey      string             `xml:"EventKey"`
+	TaskID        string             `xml:"TaskId"`
+	CardType      string             `xml:"CardType"`
+	ResponseCode  string             `xml:"ResponseCode"`
+	SelectedItems []CardSelectedItem `xml:"SelectedItems>SelectedItem"`
+}
+
+// CardSelectedItem 投票选择型卡片用户的选择
+type CardSelectedItem struct {
+	QuestionKey string   `xml:"QuestionKey"`
+	OptionIDs   []string `xml:"OptionIds>OptionId"`
+}
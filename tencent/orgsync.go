@@ -0,0 +1,293 @@
+package tencent
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/xen0n/go-workwx"
+	"sort"
+	"strings"
+)
+
+// SyncAction 通讯录同步的变更类型
+type SyncAction string
+
+const (
+	SyncActionCreate     SyncAction = "create"
+	SyncActionUpdate     SyncAction = "update"
+	SyncActionDeactivate SyncAction = "deactivate"
+)
+
+// SyncChange 一个用户的同步变更
+type SyncChange struct {
+	Action SyncAction
+	// UserID 企微用户ID
+	UserID string
+	// User 同步后的用户
+	User *sc.User
+	// Profile 同步后的通讯录信息，停用时为空
+	Profile *sw.UserProfile
+	// Diff 变更的字段说明
+	Diff []string
+}
+
+func (change SyncChange) String() string {
+	sign := map[SyncAction]string{
+		SyncActionCreate:     "+",
+		SyncActionUpdate:     "~",
+		SyncActionDeactivate: "-",
+	}[change.Action]
+	return fmt.Sprintf("%s %s [%s] %s %s", sign, change.Action, change.UserID, change.User.Name,
+		strings.Join(change.Diff, ", "))
+}
+
+// DefaultMaxDeactivateRatio 一次同步最多停用已绑定用户的比例
+const DefaultMaxDeactivateRatio = 0.2
+
+// OrgSync 企微通讯录同步，以通讯录为准新增、更新与停用用户，可重复执行
+// 默认只导入与更新，EnableDeactivate 后才停用已离开的用户
+type OrgSync struct {
+	app    *WecomApp
+	cache  sc.Cache
+	smarts []string
+	// maxDeactivateRatio 大于 0 时停用已离开的用户，停用人数超过已绑定用户的该比例时拒绝执行
+	maxDeactivateRatio float64
+
+	// parents Plan 时读取的部门层级，Apply 时保存用于部门策略
+	parents map[int64]int64
+	// bound Plan 时已绑定的企微用户数
+	bound int
+}
+
+// NewOrgSync 创建通讯录同步，smarts 为新增用户使用的 smart
+func NewOrgSync(app *WecomApp, cache sc.Cache, smarts ...string) *OrgSync {
+	return &OrgSync{app: app, cache: cache, smarts: smarts}
+}
+
+// EnableDeactivate 停用已离开企业或不在应用可见范围内的用户
+// 停用人数超过已绑定用户的 maxRatio 时 Apply 拒绝执行，maxRatio 不大于 0 时使用 DefaultMaxDeactivateRatio
+func (s *OrgSync) EnableDeactivate(maxRatio float64) {
+	if maxRatio <= 0 {
+		maxRatio = DefaultMaxDeactivateRatio
+	}
+	s.maxDeactivateRatio = maxRatio
+}
+
+// wecomUserID 企微用户绑定 UserUID 时的用户ID
+func wecomUserID(userID string) string {
+	return fmt.Sprintf("wecom:%s", userID)
+}
+
+// contactStatus 通讯录成员状态对应的用户状态，已禁用的成员暂停使用
+func contactStatus(user *workwx.UserInfo) sc.UserStatus {
+	if user.Status == workwx.UserStatusDeactivated {
+		return sc.UserStatusDown
+	}
+	return sc.UserStatusActive
+}
+
+func contactProfile(user *workwx.UserInfo, tagIDs []int64) *sw.UserProfile {
+	deptIDs := make([]int64, 0, len(user.Departments))
+	for i := range user.Departments {
+		deptIDs = append(deptIDs, user.Departments[i].DeptID)
+	}
+	sort.Slice(deptIDs, func(i, j int) bool { return deptIDs[i] < deptIDs[j] })
+	return &sw.UserProfile{UserID: user.UserID, DeptIDs: deptIDs, Title: user.Position, TagIDs: tagIDs}
+}
+
+// checkExport 通讯录读取异常或应用可见范围被清空时不能据此停用所有用户
+func checkExport(exported int, bound int) error {
+	if exported == 0 && bound > 0 {
+		return errors.New("contact export is empty, refuse to sync")
+	}
+	return nil
+}
+
+// checkDeactivate 停用人数超过已绑定用户的 maxRatio 时拒绝执行
+func checkDeactivate(changes []SyncChange, bound int, maxRatio float64) error {
+	deactivated := 0
+	for i := range changes {
+		if changes[i].Action == SyncActionDeactivate {
+			deactivated++
+		}
+	}
+	if deactivated > 0 && float64(deactivated) > maxRatio*float64(bound) {
+		return errors.New(fmt.Sprintf("refuse to deactivate %d of %d users, exceeds ratio %.2f",
+			deactivated, bound, maxRatio))
+	}
+	return nil
+}
+
+// Plan 对比通讯录与 cache，返回需要执行的变更，不修改 cache
+func (s *OrgSync) Plan() ([]SyncChange, error) {
+	profileCache, ok := s.cache.(sw.UserProfileCache)
+	if !ok {
+		return nil, errors.New("cache does not support user profile")
+	}
+
+	users, err := s.app.ExportDepts()
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := profileCache.UserBindings(wecomUserID(""))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkExport(len(users), len(bindings)); err != nil {
+		return nil, err
+	}
+	if s.parents, err = s.app.DeptParents(); err != nil {
+		return nil, err
+	}
+	s.bound = len(bindings)
+	userTags, err := s.app.UserTags(users)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []SyncChange
+	seen := make(map[string]bool, len(users))
+	for i := range users {
+		userID := wecomUserID(users[i].UserID)
+		seen[userID] = true
+		profile := contactProfile(users[i], userTags[users[i].UserID])
+
+		userUID, bound := bindings[userID]
+		var user *sc.User
+		if bound {
+			if user, err = s.cache.User(userUID); err != nil {
+				return nil, err
+			}
+		}
+		if user == nil {
+			if !bound {
+				userUID = sc.UserUID(utils.MD5(users[i].UserID)) // UserUID 使用企微 UserID 的 MD5 值
+			}
+			changes = append(changes, SyncChange{
+				Action:  SyncActionCreate,
+				UserID:  users[i].UserID,
+				User:    &sc.User{UID: userUID, Name: users[i].Name, Status: contactStatus(users[i])},
+				Profile: profile,
+				Diff: []string{fmt.Sprintf("depts %v", profile.DeptIDs), fmt.Sprintf("title %q", profile.Title),
+					fmt.Sprintf("tags %v", profile.TagIDs)},
+			})
+			continue
+		}
+
+		old, err := profileCache.UserProfile(userUID)
+		if err != nil {
+			return nil, err
+		}
+		if old == nil {
+			old = &sw.UserProfile{}
+		}
+
+		updated := *user
+		updated.Name = users[i].Name
+		if updated.Status, err = sw.SuspendedStatus(s.cache, userUID, contactStatus(users[i])); err != nil {
+			return nil, err
+		}
+		var diff []string
+		if user.Name != updated.Name {
+			diff = append(diff, fmt.Sprintf("name %q -> %q", user.Name, updated.Name))
+		}
+		if user.Status != updated.Status {
+			diff = append(diff, fmt.Sprintf("status %d -> %d", user.Status, updated.Status))
+		}
+		if fmt.Sprint(old.DeptIDs) != fmt.Sprint(profile.DeptIDs) {
+			diff = append(diff, fmt.Sprintf("depts %v -> %v", old.DeptIDs, profile.DeptIDs))
+		}
+		if old.Title != profile.Title {
+			diff = append(diff, fmt.Sprintf("title %q -> %q", old.Title, profile.Title))
+		}
+		if fmt.Sprint(old.TagIDs) != fmt.Sprint(profile.TagIDs) {
+			diff = append(diff, fmt.Sprintf("tags %v -> %v", old.TagIDs, profile.TagIDs))
+		}
+		if len(diff) > 0 {
+			changes = append(changes, SyncChange{
+				Action:  SyncActionUpdate,
+				UserID:  users[i].UserID,
+				User:    &updated,
+				Profile: profile,
+				Diff:    diff,
+			})
+		}
+	}
+
+	if s.maxDeactivateRatio <= 0 {
+		return changes, nil
+	}
+
+	// 已离开企业或不在应用可见范围内的用户
+	leftIDs := make([]string, 0)
+	for userID := range bindings {
+		if !seen[userID] {
+			leftIDs = append(leftIDs, userID)
+		}
+	}
+	sort.Strings(leftIDs)
+	for _, userID := range leftIDs {
+		user, err := s.cache.User(bindings[userID])
+		if err != nil {
+			return nil, err
+		}
+		if user == nil || user.Status == sc.UserStatusBlock {
+			continue
+		}
+		deactivated := *user
+		deactivated.Status = sc.UserStatusBlock
+		changes = append(changes, SyncChange{
+			Action: SyncActionDeactivate,
+			UserID: strings.TrimPrefix(userID, wecomUserID("")),
+			User:   &deactivated,
+			Diff:   []string{fmt.Sprintf("status %d -> %d", user.Status, deactivated.Status)},
+		})
+	}
+	return changes, nil
+}
+
+// Apply 执行 Plan 返回的变更并保存部门层级，单个用户失败时继续执行其它变更
+// 停用人数超过已绑定用户的 maxDeactivateRatio 时不执行任何变更
+func (s *OrgSync) Apply(changes []SyncChange) error {
+	profileCache, ok := s.cache.(sw.UserProfileCache)
+	if !ok {
+		return errors.New("cache does not support user profile")
+	}
+	if err := checkDeactivate(changes, s.bound, s.maxDeactivateRatio); err != nil {
+		return err
+	}
+	if policyCache, ok := s.cache.(sw.PolicyCache); ok && s.parents != nil {
+		if err := policyCache.DeptParentsStore(s.parents); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for i := range changes {
+		change := changes[i]
+		var err error
+		switch change.Action {
+		case SyncActionCreate:
+			if err = sw.ProvisionUser(s.cache, wecomUserID(change.UserID), change.User, s.smarts...); err == nil {
+				err = profileCache.UserProfileStore(change.User.UID, change.Profile)
+			}
+		case SyncActionUpdate:
+			if err = s.cache.UserStore(change.User); err == nil {
+				err = profileCache.UserProfileStore(change.User.UID, change.Profile)
+			}
+		case SyncActionDeactivate:
+			err = s.cache.UserStore(change.User)
+		}
+		if err != nil {
+			failed++
+			log.Error().Msg(fmt.Sprintf("[x] sync user[%s] %s failed, %s", change.UserID, change.Action, err.Error()))
+		}
+	}
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("%d of %d changes failed", failed, len(changes)))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package tencent
+
+import (
+	"testing"
+)
+
+func TestCheckExport(t *testing.T) {
+	tests := []struct {
+		name     string
+		exported int
+		bound    int
+		wantErr  bool
+	}{
+		{"empty export with bound users", 0, 10, true},
+		{"empty export without bound users", 0, 0, false},
+		{"non-empty export", 5, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkExport(tt.exported, tt.bound); (err != nil) != tt.wantErr {
+				t.Errorf("checkExport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckDeactivate(t *testing.T) {
+	changes := func(deactivate int) []SyncChange {
+		result := []SyncChange{{Action: SyncActionCreate}, {Action: SyncActionUpdate}}
+		for i := 0; i < deactivate; i++ {
+			result = append(result, SyncChange{Action: SyncActionDeactivate})
+		}
+		return result
+	}
+	tests := []struct {
+		name       string
+		deactivate int
+		bound      int
+		maxRatio   float64
+		wantErr    bool
+	}{
+		{"no deactivation", 0, 0, DefaultMaxDeactivateRatio, false},
+		{"at ratio", 2, 10, DefaultMaxDeactivateRatio, false},
+		{"exceeds ratio", 3, 10, DefaultMaxDeactivateRatio, true},
+		{"no bound users", 1, 0, DefaultMaxDeactivateRatio, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkDeactivate(changes(tt.deactivate), tt.bound, tt.maxRatio); (err != nil) != tt.wantErr {
+				t.Errorf("checkDeactivate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+)
+
+// personaCommand 设置自定义说明的指令
+// /persona 查看，/persona <说明或预置名称> 设置，/persona clear 清除
+const (
+	personaCommand = "/persona"
+	personaClear   = "clear"
+)
+
+// parsePersonaCommand 消息是否为自定义说明指令，返回指令后的内容，保留原始换行
+func parsePersonaCommand(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if strings.ToLower(fields0(content)) != personaCommand {
+		return "", false
+	}
+	return strings.TrimSpace(content[len(personaCommand):]), true
+}
+
+// userInstructions 用户的自定义说明，读取失败时不使用
+func (p *pipeline) userInstructions(ctx context.Context, session sc.Session) string {
+	personaCache, ok := sw.CacheWithContext(ctx, p.cache).(sw.PersonaCache)
+	if !ok {
+		return ""
+	}
+	instructions, err := personaCache.UserInstructions(session.User.UID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.UserInstructions %s", session.ID, err.Error()))
+		return ""
+	}
+	return instructions
+}
+
+// persona 查看或设置用户自己的自定义说明，修改由 cache 记录，操作人为 [userPlatform]:[userID]
+func (p *pipeline) persona(ctx context.Context, session sc.Session, userID string, instructions string) {
+	ctx = sw.WithActor(ctx, fmt.Sprintf("%s:%s", p.userPlatform, userID))
+	personaCache, ok := sw.CacheWithContext(ctx, p.cache).(sw.PersonaCache)
+	if !ok {
+		p.reply(session, "不支持自定义说明")
+		return
+	}
+
+	if instructions == "" {
+		current, err := personaCache.UserInstructions(session.User.UID)
+		if err != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] cache.UserInstructions %s", session.ID, err.Error()))
+			return
+		}
+		if current == "" {
+			current = "未设置"
+		}
+		p.reply(session, fmt.Sprintf("当前自定义说明：%s\n\n用法：%s <说明>，预置：%s，%s %s 清除",
+			current, personaCommand, strings.Join(personaPresetNames(), "、"), personaCommand, personaClear))
+		return
+	}
+
+	answer := "已清除自定义说明"
+	if strings.ToLower(instructions) == personaClear {
+		instructions = ""
+	} else {
+		resolved, err := sw.ResolveInstructions(instructions)
+		if err != nil {
+			p.reply(session, fmt.Sprintf("设置失败：%s", err.Error()))
+			return
+		}
+		instructions, answer = resolved, fmt.Sprintf("已设置自定义说明：%s", resolved)
+	}
+	if err := personaCache.UserInstructionsStore(session.User.UID, instructions); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.UserInstructionsStore %s", session.ID, err.Error()))
+		p.reply(session, "设置失败，请稍后再试")
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("[%s] user [%s] set instructions", session.ID, session.User.UID))
+	p.reply(session, answer)
+}
+
+func personaPresetNames() []string {
+	names := make([]string, 0, len(sw.PersonaPresets))
+	for name := range sw.PersonaPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,436 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/tracing"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"sort"
+	"strings"
+	"time"
+)
+
+// callbackTimeout 企微回调同步处理部分的超时时间
+const callbackTimeout = 4 * time.Second
+
+// DefaultSessionTimeout 默认会话超时时间，超时后中止提问与答复
+const DefaultSessionTimeout = 2 * time.Minute
+
+// IncomingMessage 各企微渠道接收到的消息，作为 sc.Session 的 Question
+type IncomingMessage interface {
+	// Type 消息类型
+	Type() sc.MessageType
+	// Time 消息发送时间
+	Time() time.Time
+	// Content 文本消息内容，非文本消息为空
+	Content() string
+}
+
+// historyMessage 带有对话上下文的消息，如模板卡片的“继续”操作
+type historyMessage interface {
+	History() []sw.Message
+}
+
+// smartsMessage 指定答复 smart 的消息，如模板卡片的“重新生成”与“切换”操作
+type smartsMessage interface {
+	SmartIDs() []string
+}
+
+// pipeline 各企微渠道共用的消息处理流程：查询用户、拦截、向 smart 提问并执行答复处理器
+type pipeline struct {
+	filters []chat.Filter
+	chs     []chat.CompletionHandler
+
+	smart map[string]smart.Smart
+
+	cache sc.Cache
+
+	sessionTimeout time.Duration
+
+	// userPlatform 企微用户ID绑定 UserUID 时使用的平台前缀
+	userPlatform string
+
+	// replier 渠道的发送方法，用于不经过 smart 的答复
+	replier chat.CompletionHandler
+	// userDepts 查询用户所属部门
+	userDepts func(userID string) []int64
+	// defaultSmarts 自动注册用户时使用的 smart，为空时不自动注册
+	defaultSmarts []string
+	// broadcast 管理员发送公告的方法，返回群发ID
+	broadcast func(ctx context.Context, markdown string) (string, error)
+	// redactor 提问前脱敏，为空时不脱敏
+	redactor *sw.Redactor
+	// aggregation 多个 smart 的答复合并为一条，为空时分别答复
+	aggregation *aggregation
+	// router 按意图分配 smart，为空时使用用户配置的 smart
+	router *sw.Router
+}
+
+func newPipeline(userPlatform string, smart map[string]smart.Smart,
+	filter []chat.Filter, cache sc.Cache) *pipeline {
+	return &pipeline{
+		smart:   smart,
+		filters: filter,
+		cache:   cache,
+
+		sessionTimeout: DefaultSessionTimeout,
+		userPlatform:   userPlatform,
+	}
+}
+
+// SetSessionTimeout 设置会话超时时间
+func (p *pipeline) SetSessionTimeout(timeout time.Duration) {
+	p.sessionTimeout = timeout
+}
+
+// SetDefaultSmarts 设置自动注册用户时使用的 smart
+func (p *pipeline) SetDefaultSmarts(smarts ...string) {
+	p.defaultSmarts = smarts
+}
+
+// SetRedactor 设置向 smart 提问前使用的脱敏器，答复在执行答复处理器前还原
+func (p *pipeline) SetRedactor(redactor *sw.Redactor) {
+	p.redactor = redactor
+}
+
+// contextFilter 支持 context 的拦截器
+type contextFilter interface {
+	DoFilterContext(context.Context, *sc.Session) error
+}
+
+func (p *pipeline) doFilter(ctx context.Context, filter chat.Filter, session *sc.Session) (err error) {
+	ctx, span := tracing.Start(ctx, "filter", attribute.String("filter.type", fmt.Sprintf("%T", filter)))
+	defer func() { tracing.End(span, err) }()
+
+	if f, ok := filter.(contextFilter); ok {
+		return f.DoFilterContext(ctx, session)
+	}
+	return filter.DoFilter(session)
+}
+
+func (p *pipeline) smartChatProcess(ctx context.Context, session sc.Session, group *sw.Group) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("[%s] %s", session.ID, err))
+		}
+
+	}()
+
+	// 每个会话的提问、答复与保存都需要在超时时间内完成
+	ctx, cancel := context.WithTimeout(ctx, p.sessionTimeout)
+	defer cancel()
+
+	answered, err := p.ask(ctx, session, group)
+	if err != nil {
+		return
+	}
+	session = answered.session
+
+	if group != nil {
+		p.groupRemember(ctx, group, session.SmartID, answered.content, session.Answer)
+	}
+
+	if !p.complete(ctx, &session) {
+		return
+	}
+
+	if err := sw.CacheWithContext(ctx, p.cache).SessionStore(&session); err != nil {
+		log.Error().Msg(fmt.Sprintf("[%s] store session error %s", session.ID, err.Error()))
+		return
+	}
+
+	p.feedbackRemember(ctx, &session, answered.content, answered.templateRef)
+
+}
+
+// answered 一次向 smart 提问的结果
+type answered struct {
+	// session Answer 为已还原脱敏数据的答复
+	session sc.Session
+	// content 用户输入，用于上下文与评价
+	content     string
+	templateRef string
+}
+
+// ask 按 session.SmartID 使用模板、上下文与自定义说明生成提问并向 smart 提问
+func (p *pipeline) ask(ctx context.Context, session sc.Session, group *sw.Group) (*answered, error) {
+	// /t 指令指定模板，否则使用用户或 smart 的默认模板，上下文与会话记录保存的是用户输入
+	content := session.Question.(IncomingMessage).Content()
+	ref, input, ok := parseTemplateCommand(content)
+	if ok {
+		content = input
+	}
+	prompt, templateRef := content, ""
+	if tmpl := p.promptTemplate(ctx, session, ref); tmpl != nil {
+		if rendered, ok := p.renderTemplate(session, tmpl, content); ok {
+			prompt, templateRef = rendered, tmpl.Ref()
+		}
+	}
+
+	var question sc.Question = prompt
+	if group != nil {
+		question = p.groupQuestion(ctx, group, session.SmartID, prompt)
+	} else if m, ok := session.Question.(historyMessage); ok && len(m.History()) > 0 {
+		question = sw.Conversation{History: m.History(), Question: prompt}
+	}
+	if instructions := p.userInstructions(ctx, session); instructions != "" {
+		question = sw.WithInstructions(question, instructions)
+	}
+
+	answer, err := p.askSmart(ctx, session, session.SmartID, question)
+	if err != nil {
+		return nil, err
+	}
+	session.Answer = answer
+	return &answered{session: session, content: content, templateRef: templateRef}, nil
+}
+
+// askSmart 脱敏后向 smartID 提问，答复中的占位符还原为原始数据
+func (p *pipeline) askSmart(ctx context.Context, session sc.Session,
+	smartID string, question sc.Question) (sc.Answer, error) {
+	target, ok := p.smart[smartID]
+	if !ok || target == nil {
+		log.Error().Msg(fmt.Sprintf("[%s] smart[%s] not loaded", session.ID, smartID))
+		return nil, errors.New(fmt.Sprintf("smart [%s] not found", smartID))
+	}
+	// 上下文与提问一起脱敏，群聊上下文与会话记录保存的是原始数据
+	asked, redaction := question, (*sw.Redaction)(nil)
+	if p.redactor != nil {
+		asked, redaction = p.redactor.Redact(question)
+		p.logRedaction(session, redaction)
+		// 工具结果使用同一组占位符脱敏
+		ctx = sw.WithRedaction(ctx, redaction)
+	}
+
+	askCtx, span := tracing.Start(ctx, "smart.ask",
+		attribute.String("session.id", string(session.ID)),
+		attribute.String("smart.id", smartID))
+	start := time.Now()
+	answer, err := sw.AskWithContext(askCtx, target, asked)
+	monitor.SmartLatency.WithLabelValues(smartID).Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+	if err != nil {
+		monitor.SmartErrors.WithLabelValues(smartID).Inc()
+		log.Error().Msg(fmt.Sprintf("[%s] smart[%s] ask error %s", session.ID, smartID, err.Error()))
+		return nil, err
+	}
+
+	if redaction != nil {
+		if text, ok := answer.(string); ok {
+			answer = redaction.Restore(text)
+		}
+	}
+	return answer, nil
+}
+
+// complete 依次执行答复处理器，出现错误时返回 false
+func (p *pipeline) complete(ctx context.Context, session *sc.Session) bool {
+	for i := range p.chs {
+		_, span := tracing.Start(ctx, "completion_handler",
+			attribute.String("session.id", string(session.ID)),
+			attribute.Int("completion_handler.index", i))
+		err := p.chs[i](session)
+		tracing.End(span, err)
+		if err != nil {
+			return false // TODO CompletionHandler出现错误后面的不会继续执行，需要一个合理解决方法
+		}
+	}
+	return true
+}
+
+// logRedaction 记录会话中各类型脱敏的数据个数
+func (p *pipeline) logRedaction(session sc.Session, redaction *sw.Redaction) {
+	if redaction.Total() == 0 {
+		return
+	}
+	kinds := make([]string, 0, len(redaction.Counts))
+	for kind, count := range redaction.Counts {
+		monitor.Redactions.WithLabelValues(kind).Add(float64(count))
+		kinds = append(kinds, fmt.Sprintf("%s=%d", kind, count))
+	}
+	sort.Strings(kinds)
+	log.Info().Msg(fmt.Sprintf("[%s] smart[%s] redacted %s", session.ID, session.SmartID, strings.Join(kinds, " ")))
+}
+
+// lookupUser 企微用户ID转换为 UserUID 并取得用户信息与需要使用的 smart
+func (p *pipeline) lookupUser(ctx context.Context, sessionID sc.SessionID,
+	userID string) (user *sc.User, smartIDs []string, err error) {
+	ctx, span := tracing.Start(ctx, "user.lookup", attribute.String("session.id", string(sessionID)))
+	defer func() { tracing.End(span, err) }()
+
+	cache := sw.CacheWithContext(ctx, p.cache)
+
+	// 企微用户ID转换为 UserUID 用户ID
+	userUID, err := cache.UserID2UID(fmt.Sprintf("%s:%s", p.userPlatform, userID))
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.UserID2UID %s", sessionID, err.Error()))
+		return nil, nil, err
+	}
+
+	// 找到发送用户的信息
+	user, err = cache.User(userUID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.User %s", sessionID, err.Error()))
+		return nil, nil, err
+	}
+	if user == nil { // 用户未找到
+		log.Warn().Msg(fmt.Sprintf("[%s] user [%s] not found", sessionID, userUID))
+		return nil, nil, nil
+	}
+
+	smartIDs, err = cache.UserAnswer(userUID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.UserAnswer %s", sessionID, err.Error()))
+		return nil, nil, err
+	}
+	// 部门与标签策略授予的 smart 与用户提问使用的 smart 合并
+	policySmarts, err := sw.PolicySmarts(cache, userUID)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] PolicySmarts %s", sessionID, err.Error()))
+		return nil, nil, err
+	}
+	seen := make(map[string]bool, len(smartIDs))
+	for i := range smartIDs {
+		seen[smartIDs[i]] = true
+	}
+	for i := range policySmarts {
+		if !seen[policySmarts[i]] {
+			seen[policySmarts[i]] = true
+			smartIDs = append(smartIDs, policySmarts[i])
+		}
+	}
+
+	return user, smartIDs, nil
+}
+
+// handle 查询用户并拦截，通过后异步向 smart 提问
+func (p *pipeline) handle(ctx context.Context, sessionID sc.SessionID, userID string,
+	msg IncomingMessage, group *sw.Group) {
+	user, smartIDs, err := p.lookupUser(ctx, sessionID, userID)
+	if err != nil || user == nil {
+		return // TODO 出现错误是否需要企微补发消息？
+	}
+	// 群聊配置与消息指定 smart 时不使用意图路由
+	routed := p.router != nil
+	if group != nil && len(group.SmartIDs) > 0 { // 群聊配置的 smart 优先
+		smartIDs, routed = group.SmartIDs, false
+	}
+	if m, ok := msg.(smartsMessage); ok && len(m.SmartIDs()) > 0 { // 消息指定的 smart 优先
+		smartIDs, routed = m.SmartIDs(), false
+	}
+
+	session := sc.Session{
+		ID:       sessionID,
+		User:     user,
+		Question: msg,
+	}
+
+	// 单聊中的 /good /bad 评价最近一次答复、/persona 自定义说明与管理指令
+	if group == nil {
+		if rating, ok := feedbackRating(msg.Content()); ok {
+			if p.filter(ctx, &session) == nil {
+				p.rate(ctx, session, userID, rating)
+			}
+			return
+		}
+		if instructions, ok := parsePersonaCommand(msg.Content()); ok {
+			if p.filter(ctx, &session) == nil {
+				p.persona(ctx, session, userID, instructions)
+			}
+			return
+		}
+	}
+	// 已配置的群聊中只支持 /group 修改群聊配置
+	if name, args, ok := parseAdminCommand(msg.Content()); ok && (group == nil || name == groupCommand) {
+		if p.filter(ctx, &session) == nil {
+			p.admin(ctx, session, userID, name, args, msg)
+		}
+		return
+	}
+
+	// /t 不带模板时列出模板，指定的模板不存在时答复提示，不再向 smart 提问
+	if ref, _, ok := parseTemplateCommand(msg.Content()); ok {
+		if ref == "" {
+			if p.filter(ctx, &session) == nil {
+				p.templateList(ctx, session)
+			}
+			return
+		}
+		if _, err := sw.LoadTemplate(sw.CacheWithContext(ctx, p.cache), ref); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] load template %s", sessionID, err.Error()))
+			p.reply(session, fmt.Sprintf("模板 %s 不存在，发送 %s 查看可用模板", ref, templateCommand))
+			return
+		}
+	}
+
+	// 开始向smart提问，回调请求结束后提问仍需继续，这里只保留追踪信息，超时由 smartChatProcess 控制
+	// 每个 smart 单独拦截，拦截器可以按 session.SmartID 检查权限
+	// 群聊配置的 smart 对群成员开放，只拦截一次且不按 smart 检查权限
+	groupSmarts := group != nil && len(group.SmartIDs) > 0
+	if groupSmarts && p.filter(ctx, &session) != nil {
+		return
+	}
+	// 提问用户作为工具调用等操作的操作人
+	askCtx := sw.WithActor(tracing.Detach(ctx), fmt.Sprintf("%s:%s", p.userPlatform, userID))
+	if routed { // 分类模型可能耗时较长，识别意图与拦截都异步执行
+		go p.routeProcess(askCtx, session, group, smartIDs)
+		return
+	}
+	allowed := make([]string, 0, len(smartIDs))
+	for i := range smartIDs {
+		session.SmartID = smartIDs[i]
+		if !groupSmarts {
+			if err := p.filter(ctx, &session); err != nil {
+				if noticed(err) { // 已答复提示的拦截针对提问本身，不再向其它 smart 提问
+					return
+				}
+				continue
+			}
+		}
+		allowed = append(allowed, smartIDs[i])
+	}
+
+	if p.aggregation != nil && len(allowed) > 1 { // 汇总模式下等待所有答复后合并为一条
+		session.SmartID = ""
+		go p.aggregateProcess(askCtx, session, group, allowed)
+		return
+	}
+	for i := range allowed {
+		session.SmartID = allowed[i]
+		go p.smartChatProcess(askCtx, session, group)
+		time.Sleep(500)
+	}
+}
+
+// noticer 带有答复提示的拦截错误，如内容审核不通过
+type noticer interface {
+	Notice() string
+}
+
+func noticed(err error) bool {
+	n, ok := err.(noticer)
+	return ok && n.Notice() != ""
+}
+
+// filter 依次执行拦截器，被拦截时返回拦截错误，错误带有提示时答复用户
+func (p *pipeline) filter(ctx context.Context, session *sc.Session) error {
+	for i := range p.filters {
+		if err := p.doFilter(ctx, p.filters[i], session); err != nil {
+			monitor.FilterRejections.WithLabelValues(monitor.RejectReason(err)).Inc()
+			log.Warn().Msg(err.Error())
+			if noticed(err) {
+				p.reply(*session, err.(noticer).Notice())
+			}
+			return err
+		}
+	}
+	return nil
+}
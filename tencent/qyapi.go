@@ -0,0 +1,117 @@
+package tencent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// qyapiHost 企微API地址
+const qyapiHost = "https://qyapi.weixin.qq.com"
+
+// httpClient 调用企微API使用的客户端
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// qyapiResult 企微API返回的错误码
+type qyapiResult struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// tokenExpired access_token 无效或已过期，需要重新获取
+func (r qyapiResult) tokenExpired() bool {
+	return r.ErrCode == 40014 || r.ErrCode == 42001
+}
+
+func (r qyapiResult) err() error {
+	if r.ErrCode != 0 {
+		return errors.New(fmt.Sprintf("qyapi error [%d] %s", r.ErrCode, r.ErrMsg))
+	}
+	return nil
+}
+
+// postJSON 以 JSON 格式调用企微API，resp 需要嵌入 qyapiResult，为空时只检查错误码
+func postJSON(url string, req any, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	var result qyapiResult
+	if resp == nil {
+		resp = &result
+	}
+	if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return err
+	}
+	if r, ok := resp.(interface{ err() error }); ok {
+		return r.err()
+	}
+	return nil
+}
+
+// qyapiResponse 嵌入 qyapiResult 的响应
+type qyapiResponse interface {
+	err() error
+	tokenExpired() bool
+}
+
+// withToken 使用应用 access_token 调用 call，token 无效或已过期时重新获取后重试一次
+func (app *WecomApp) withToken(resp qyapiResponse, call func(token string) error) error {
+	for retried := false; ; retried = true {
+		token, err := app.token.get()
+		if err != nil {
+			return err
+		}
+		err = call(token)
+		if retried || !resp.tokenExpired() {
+			return err
+		}
+		app.token.invalidate(token)
+	}
+}
+
+// post 使用应用 access_token 调用企微API，path 如 /cgi-bin/kf/send_msg
+// resp 需要嵌入 qyapiResult，为空时只检查错误码
+func (app *WecomApp) post(path string, req any, resp any) error {
+	if resp == nil {
+		resp = &qyapiResult{}
+	}
+	result, ok := resp.(qyapiResponse)
+	if !ok {
+		return errors.New(fmt.Sprintf("response %T does not embed qyapiResult", resp))
+	}
+	return app.withToken(result, func(token string) error {
+		return postJSON(fmt.Sprintf("%s%s?access_token=%s", qyapiHost, path, url.QueryEscape(token)), req, resp)
+	})
+}
+
+// get 使用应用 access_token 以 GET 方式调用企微API，resp 需要嵌入 qyapiResult
+func (app *WecomApp) get(path string, query url.Values, resp qyapiResponse) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	return app.withToken(resp, func(token string) error {
+		query.Set("access_token", token)
+		httpResp, err := httpClient.Get(fmt.Sprintf("%s%s?%s", qyapiHost, path, query.Encode()))
+		if err != nil {
+			return err
+		}
+		defer httpResp.Body.Close()
+
+		if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+			return err
+		}
+		return resp.err()
+	})
+}
@@ -0,0 +1,257 @@
+package tencent
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/tracing"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// WecomRobotEventConfigure 群机器人接收消息服务器配置
+type WecomRobotEventConfigure struct {
+	Uri            string
+	Token          string
+	EncodingAESKey string
+	// WebhookKey 回调消息中没有 WebhookUrl 时用于答复的机器人 key
+	WebhookKey string
+}
+
+// RobotMessage 群机器人接收到的消息
+type RobotMessage struct {
+	// WebhookURL 用于答复此消息的机器人地址
+	WebhookURL string `xml:"WebhookUrl"`
+	ChatID     string `xml:"ChatId"`
+	// ChatType single 或 group
+	ChatType string `xml:"ChatType"`
+	From     struct {
+		UserID string `xml:"UserId"`
+		Name   string `xml:"Name"`
+		Alias  string `xml:"Alias"`
+	} `xml:"From"`
+	MsgType string `xml:"MsgType"`
+	Text    struct {
+		Content string `xml:"Content"`
+	} `xml:"Text"`
+	MsgID string `xml:"MsgId"`
+
+	// ReceivedAt 接收时间，回调消息中没有发送时间
+	ReceivedAt time.Time `xml:"-"`
+	// webhookKey 回调配置中的机器人 key
+	webhookKey string
+}
+
+// robotMention 消息开头 @机器人 的部分
+var robotMention = regexp.MustCompile(`^\s*@\S+\s*`)
+
+func (m *RobotMessage) Type() sc.MessageType {
+	switch m.MsgType {
+	case "text":
+		return sc.MessageTypeText
+	default:
+		return sc.MessageTypeUnknown
+	}
+}
+
+func (m *RobotMessage) Time() time.Time {
+	return m.ReceivedAt
+}
+
+// Content 去掉开头 @机器人 后的文本内容
+func (m *RobotMessage) Content() string {
+	return robotMention.ReplaceAllString(m.Text.Content, "")
+}
+
+// GroupChatID 群聊消息的 ChatId，单聊时为空
+func (m *RobotMessage) GroupChatID() string {
+	if m.ChatType != "group" {
+		return ""
+	}
+	return m.ChatID
+}
+
+// Webhook 答复此消息使用的群机器人
+func (m *RobotMessage) Webhook() *RobotWebhook {
+	if m.WebhookURL != "" {
+		return &RobotWebhook{url: m.WebhookURL}
+	}
+	return NewRobotWebhook(m.webhookKey)
+}
+
+// RobotArticle 群机器人图文消息
+type RobotArticle struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+	PicURL      string `json:"picurl,omitempty"`
+}
+
+// RobotWebhook 群机器人消息推送
+// https://developer.work.weixin.qq.com/document/path/91770
+type RobotWebhook struct {
+	url string
+}
+
+// NewRobotWebhook 通过机器人 key 创建
+func NewRobotWebhook(key string) *RobotWebhook {
+	return &RobotWebhook{url: fmt.Sprintf("%s/cgi-bin/webhook/send?key=%s", qyapiHost, url.QueryEscape(key))}
+}
+
+// SendText 发送文本消息，mentions 为需要 @ 的 userid，"@all" 表示所有人
+func (w *RobotWebhook) SendText(content string, mentions ...string) error {
+	return w.send("text", map[string]any{
+		"content":        content,
+		"mentioned_list": mentions,
+	})
+}
+
+// SendMarkdown 发送 markdown 消息，使用 <@userid> 提醒群成员
+func (w *RobotWebhook) SendMarkdown(content string) error {
+	return w.send("markdown", map[string]any{
+		"content": content,
+	})
+}
+
+// SendNews 发送图文消息，最多 8 条
+func (w *RobotWebhook) SendNews(articles ...RobotArticle) error {
+	return w.send("news", map[string]any{
+		"articles": articles,
+	})
+}
+
+func (w *RobotWebhook) send(msgType string, content any) error {
+	if w.url == "" {
+		return errors.New("robot webhook not configured")
+	}
+	err := postJSON(w.url, map[string]any{
+		"msgtype": msgType,
+		msgType:   content,
+	}, nil)
+	if err != nil {
+		monitor.WecomSendFailures.Inc()
+	}
+	return err
+}
+
+// WecomRobotChat 企微群机器人聊天，与 WecomAppChat 共用 smart、拦截器与 cache
+type WecomRobotChat struct {
+	chat.Chat
+	*pipeline
+
+	mux *http.ServeMux
+}
+
+// NewWecomRobotChat 创建群机器人聊天，群成员使用企微 UserID 绑定的 UserUID
+func NewWecomRobotChat(smart map[string]smart.Smart, filter []chat.Filter, cache sc.Cache) chat.Chat {
+	robot := &WecomRobotChat{
+		pipeline: newPipeline("wecom", smart, filter, cache),
+		mux:      http.NewServeMux(),
+	}
+	robot.replier = robot.RobotCompletionHandler
+	return robot
+}
+
+func (robot *WecomRobotChat) Platform() string {
+	return "wecom-robot"
+}
+
+// RobotCompletionHandler 通过群机器人答复，并 @ 提问的成员
+func (robot *WecomRobotChat) RobotCompletionHandler(session *sc.Session) error {
+	msg := session.Question.(*RobotMessage)
+	answer := session.Answer.(string)
+	if msg.ChatType == "group" && msg.From.UserID != "" {
+		answer = fmt.Sprintf("<@%s>\n%s", msg.From.UserID, answer)
+	}
+	return msg.Webhook().SendMarkdown(answer)
+}
+
+func (robot *WecomRobotChat) onIncomingMessage(ctx context.Context, msg *RobotMessage) {
+	log.Debug().Msg(fmt.Sprintf("incoming robot message: %s %s", msg.ChatID, msg.MsgID))
+	monitor.IncomingMessages.WithLabelValues(msg.MsgType).Inc()
+
+	sessionID := sc.SessionID(fmt.Sprintf("%s:%s", robot.Platform(), msg.MsgID))
+
+	ctx, span := tracing.Start(ctx, "wecom.robot.message",
+		attribute.String("session.id", string(sessionID)),
+		attribute.String("wecom.msg_type", msg.MsgType))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	// 机器人只在被 @ 时收到消息，群聊配置用于指定 smart 与上下文，由群内的 /group 指令设置
+	var group *sw.Group
+	if groupCache, ok := robot.groupCache(ctx); ok && msg.GroupChatID() != "" {
+		var err error
+		if group, err = groupCache.Group(msg.GroupChatID()); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] cache.Group %s", sessionID, err.Error()))
+		}
+	}
+
+	robot.handle(ctx, sessionID, msg.From.UserID, msg, group)
+}
+
+// AddEventHandler 创建群机器人接收消息API处理器
+// https://developer.work.weixin.qq.com/document/path/99110
+func (robot *WecomRobotChat) AddEventHandler(ec chat.EventConfigure) error {
+	configure := ec.(*WecomRobotEventConfigure)
+	crypto, err := newEnvelopeCrypto(configure.Token, configure.EncodingAESKey)
+	if err != nil {
+		return err
+	}
+
+	robot.mux.HandleFunc(configure.Uri, func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "wecom.robot.callback", attribute.String("http.route", configure.Uri))
+		defer span.End()
+
+		crypto.serve(w, r, func(plaintext []byte) error {
+			msg := &RobotMessage{ReceivedAt: time.Now(), webhookKey: configure.WebhookKey}
+			if err := xml.Unmarshal(plaintext, msg); err != nil {
+				return err
+			}
+			// 通过 webhook 异步答复，这里不返回被动回复
+			robot.onIncomingMessage(ctx, msg)
+			return nil
+		})
+	})
+	return nil
+}
+
+func (robot *WecomRobotChat) AddCompletionHandler(ch chat.CompletionHandler) {
+	// TODO 同步锁
+	robot.chs = append(robot.chs, ch)
+}
+
+func (robot *WecomRobotChat) Accept(addr string) error {
+	if err := http.ListenAndServe(addr, robot.mux); err != nil {
+		log.Fatal().Msg(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Handler 消息接收处理器，可挂载到其它服务上与 WecomAppChat 共用端口
+func (robot *WecomRobotChat) Handler() http.Handler {
+	return robot.mux
+}
+
+func (robot *WecomRobotChat) Filters() []chat.Filter {
+	return robot.filters[:]
+}
+
+func (robot *WecomRobotChat) AddFilter(filter chat.Filter) {
+	// TODO 同步锁
+	robot.filters = append(robot.filters, filter)
+}
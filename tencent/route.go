@@ -0,0 +1,100 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// classifyTimeout 分类模型的超时时间，超时后使用默认 smart
+const classifyTimeout = 10 * time.Second
+
+// SetRouter 开启意图路由，未指定 smart 的提问由 router 分配一个 smart 答复
+func (p *pipeline) SetRouter(router *sw.Router) {
+	p.router = router
+}
+
+// routeProcess 识别意图后依次尝试分配的 smart、默认 smart 与用户自己的 smart，使用第一个通过拦截的 smart 答复
+// 分配结果保存到 RouteCache，用于分析路由效果
+func (p *pipeline) routeProcess(ctx context.Context, session sc.Session, group *sw.Group, smartIDs []string) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("[%s] %s", session.ID, err))
+		}
+	}()
+
+	content := session.Question.(IncomingMessage).Content()
+	if _, input, ok := parseTemplateCommand(content); ok {
+		content = input
+	}
+	decision := p.route(ctx, session, content)
+	decision.SessionID = session.ID
+	decision.UserUID = session.User.UID
+
+	candidates := append([]string{decision.SmartID, p.router.DefaultSmartID()}, smartIDs...)
+	tried := make(map[string]bool, len(candidates))
+	for _, smartID := range candidates {
+		if smartID == "" || tried[smartID] {
+			continue
+		}
+		tried[smartID] = true
+		session.SmartID = smartID
+		if err := p.filter(ctx, &session); err != nil {
+			if noticed(err) {
+				return
+			}
+			continue
+		}
+		if smartID != decision.SmartID {
+			decision.FallbackSmartID = smartID
+		}
+		p.routeStore(ctx, decision)
+		p.smartChatProcess(ctx, session, group)
+		return
+	}
+	p.routeStore(ctx, decision)
+	log.Warn().Msg(fmt.Sprintf("[%s] route intent [%s] no smart allowed", session.ID, decision.Intent))
+}
+
+// route 依次使用规则与分类模型识别意图，都未识别时使用默认 smart
+func (p *pipeline) route(ctx context.Context, session sc.Session, content string) *sw.RouteDecision {
+	if intent, matched := p.router.MatchRule(content); intent != nil {
+		return p.router.Decide(intent, sw.RouteMethodRule, matched)
+	}
+
+	classifier := p.router.Classifier()
+	if _, ok := p.smart[classifier]; !ok || content == "" {
+		return p.router.Decide(nil, "", "")
+	}
+	classifyCtx, cancel := context.WithTimeout(ctx, classifyTimeout)
+	defer cancel()
+	answer, err := p.askSmart(classifyCtx, session, classifier, p.router.ClassifyPrompt(content))
+	if err != nil {
+		return p.router.Decide(nil, "", "")
+	}
+	text := fmt.Sprint(answer)
+	decision := p.router.Decide(p.router.ParseClassification(text), sw.RouteMethodModel, text)
+	if decision.Method == sw.RouteMethodDefault {
+		decision.Matched = text
+	}
+	return decision
+}
+
+func (p *pipeline) routeStore(ctx context.Context, decision *sw.RouteDecision) {
+	monitor.Routes.WithLabelValues(decision.Intent, decision.Method).Inc()
+	log.Info().Msg(fmt.Sprintf("[%s] route intent [%s] by %s to smart[%s]",
+		decision.SessionID, decision.Intent, decision.Method, decision.SmartID))
+
+	routeCache, ok := sw.CacheWithContext(ctx, p.cache).(sw.RouteCache)
+	if !ok {
+		return
+	}
+	if err := routeCache.RouteStore(decision); err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] cache.RouteStore %s", decision.SessionID, err.Error()))
+	}
+}
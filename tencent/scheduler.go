@@ -0,0 +1,482 @@
+package tencent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/openai-smart/smart-chat/smart"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/utils"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/xen0n/go-workwx"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultScheduleInterval 检查到期任务的间隔
+const DefaultScheduleInterval = 30 * time.Second
+
+// ReminderToolName 提醒工具的名称
+const ReminderToolName = "reminder"
+
+// maxUserSchedules 每个用户最多创建的定时任务数
+const maxUserSchedules = 20
+
+// scheduleAskTimeout 定时提问的超时时间
+const scheduleAskTimeout = 2 * time.Minute
+
+// reminderParameters 提醒工具的参数
+const reminderParameters = `{
+  "type": "object",
+  "properties": {
+    "action": {"type": "string", "enum": ["create", "list", "cancel"], "description": "创建、查看或取消当前用户的提醒"},
+    "content": {"type": "string", "description": "提醒内容；ask 为 true 时为到期后向助手提出的问题，如 整理今天的科技新闻"},
+    "at": {"type": "string", "description": "提醒时间，格式 HH:MM 或 YYYY-MM-DD HH:MM"},
+    "days": {"type": "integer", "description": "at 只有时间时相对今天的天数，明天为 1"},
+    "minutes": {"type": "integer", "description": "多少分钟后提醒，与 at 二选一"},
+    "cron": {"type": "string", "description": "周期提醒的 cron 表达式：分 时 日 月 周，如每个工作日 9 点为 0 9 * * 1-5"},
+    "ask": {"type": "boolean", "description": "到期时是否由助手答复 content 后发送答复，用于每日摘要等"},
+    "id": {"type": "string", "description": "取消时的提醒ID"}
+  },
+  "required": ["action"]
+}`
+
+// Scheduler 定时任务，到期时通过应用发送提醒或定时提问的答复
+// 多个实例可以同时运行，只有持有锁的实例执行到期任务，任务保存在 cache 中，重启后继续执行
+type Scheduler struct {
+	app   *WecomApp
+	cache sc.Cache
+	smart map[string]smart.Smart
+	// smartID 用户创建定时提问时使用的 smart
+	smartID  string
+	redactor *sw.Redactor
+	interval time.Duration
+	// owner 当前实例持有锁时的标识
+	owner string
+}
+
+// NewScheduler 创建定时任务，smartID 为用户通过提醒工具创建定时提问时使用的 smart
+func NewScheduler(app *WecomApp, cache sc.Cache, smarts map[string]smart.Smart, smartID string) *Scheduler {
+	hostname, _ := os.Hostname()
+	return &Scheduler{
+		app:      app,
+		cache:    cache,
+		smart:    smarts,
+		smartID:  smartID,
+		interval: DefaultScheduleInterval,
+		owner:    fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+// SetRedactor 定时提问前脱敏
+func (s *Scheduler) SetRedactor(redactor *sw.Redactor) {
+	s.redactor = redactor
+}
+
+// scheduleCache cache 需要支持 ScheduleCache
+func (s *Scheduler) scheduleCache(ctx context.Context) (sw.ScheduleCache, error) {
+	scheduleCache, ok := sw.CacheWithContext(ctx, s.cache).(sw.ScheduleCache)
+	if !ok {
+		return nil, errors.New("cache does not support schedule")
+	}
+	return scheduleCache, nil
+}
+
+// Add 校验并保存任务，未指定 ID 时生成，周期任务未指定 Next 时按 Cron 计算
+func (s *Scheduler) Add(ctx context.Context, job *sw.ScheduleJob) error {
+	if strings.TrimSpace(job.Content) == "" {
+		return errors.New("content required")
+	}
+	if len(job.UserIDs) == 0 {
+		return errors.New("user required")
+	}
+	if job.Kind == sw.ScheduleKindPrompt {
+		if _, ok := s.smart[job.SmartID]; !ok {
+			return errors.New(fmt.Sprintf("smart [%s] not found", job.SmartID))
+		}
+	}
+	if job.Next.IsZero() {
+		if ok, err := job.Reschedule(time.Now()); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("time or cron required")
+		}
+	} else if job.Recurring() {
+		if _, err := sw.ParseCron(job.Cron); err != nil {
+			return err
+		}
+	}
+	if job.ID == "" {
+		job.ID = utils.MD5(fmt.Sprintf("%s:%s:%d", job.Creator, job.Content, time.Now().UnixNano()))[:8]
+	}
+	if job.Created.IsZero() {
+		job.Created = time.Now()
+	}
+
+	scheduleCache, err := s.scheduleCache(ctx)
+	if err != nil {
+		return err
+	}
+	return scheduleCache.ScheduleStore(job)
+}
+
+// Run 每隔 interval 执行一次到期任务，直到 ctx 结束
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.tick(ctx)
+		select {
+		case <-ctx.Done():
+			if scheduleCache, err := s.scheduleCache(context.Background()); err == nil {
+				_ = scheduleCache.ScheduleUnlock(s.owner)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick 持有锁时执行到期任务，先保存下次执行时间再执行，任务最多执行一次
+func (s *Scheduler) tick(ctx context.Context) {
+	scheduleCache, err := s.scheduleCache(ctx)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("[x] scheduler %s", err.Error()))
+		return
+	}
+	// 锁在多个检查间隔内有效，持有锁的实例退出后由其它实例接替
+	locked, err := scheduleCache.ScheduleLock(s.owner, 3*s.interval)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[x] scheduler cache.ScheduleLock %s", err.Error()))
+		return
+	}
+	if !locked {
+		return
+	}
+
+	now := time.Now()
+	jobs, err := scheduleCache.ScheduleDue(now)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[x] scheduler cache.ScheduleDue %s", err.Error()))
+		return
+	}
+	for i := range jobs {
+		job := jobs[i]
+		due := job.Next
+		ok, err := job.Reschedule(now)
+		claimed := false
+		if err == nil {
+			var next *sw.ScheduleJob
+			if ok {
+				next = &job
+			}
+			claimed, err = scheduleCache.ScheduleClaim(job.ID, next)
+		}
+		if err != nil {
+			log.Warn().Msg(fmt.Sprintf("[x] scheduler job [%s] reschedule %s", job.ID, err.Error()))
+			continue
+		}
+		if !claimed { // 读取到期任务后已被取消
+			continue
+		}
+		go s.execute(ctx, job, due)
+	}
+}
+
+// execute 发送提醒或定时提问的答复
+func (s *Scheduler) execute(ctx context.Context, job sw.ScheduleJob, due time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error().Msg(fmt.Sprintf("[x] scheduler job [%s] %s", job.ID, err))
+		}
+	}()
+
+	recipient := &workwx.Recipient{UserIDs: job.UserIDs}
+	var err error
+	switch job.Kind {
+	case sw.ScheduleKindPrompt:
+		var userUID sc.UserUID
+		if userUID, err = s.access(ctx, &job); err != nil {
+			break
+		}
+		var answer string
+		if answer, err = s.ask(ctx, &job); err == nil {
+			s.countUsage(ctx, userUID)
+			err = s.app.client.SendMarkdownMessage(recipient, answer, false)
+		}
+	default:
+		err = s.app.client.SendTextMessage(recipient, fmt.Sprintf("⏰ 提醒：%s", job.Content), false)
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		monitor.WecomSendFailures.Inc()
+		log.Error().Msg(fmt.Sprintf("[x] scheduler job [%s] due %s failed, %s",
+			job.ID, due.Format("2006-01-02 15:04"), err.Error()))
+	} else {
+		log.Info().Msg(fmt.Sprintf("[*] scheduler job [%s] %s sent to %v", job.ID, job.Kind, job.UserIDs))
+	}
+	monitor.ScheduledJobs.WithLabelValues(string(job.Kind), result).Inc()
+}
+
+// access 定时提问前重新检查创建人能否使用 smart，与会话的权限拦截相同
+// 创建人被删除、停用或收回授权时删除任务，超出当天提问次数时只跳过本次；系统创建的任务不检查
+func (s *Scheduler) access(ctx context.Context, job *sw.ScheduleJob) (sc.UserUID, error) {
+	if job.Creator == sw.ActorSystem {
+		return "", nil
+	}
+	cache := sw.CacheWithContext(ctx, s.cache)
+	userUID, err := cache.UserID2UID(job.Creator)
+	if err != nil {
+		return "", err
+	}
+	user, err := cache.User(userUID)
+	if err != nil {
+		return "", err
+	}
+	reason, message := "deleted", fmt.Sprintf("user [%s] not found", userUID)
+	if user != nil {
+		if user.Status, err = sw.SuspendedStatus(cache, userUID, user.Status); err != nil {
+			return "", err
+		}
+		if reason, message, err = sw.UserAccess(cache, user, job.SmartID); err != nil {
+			return "", err
+		}
+	}
+	switch reason {
+	case "":
+		return userUID, nil
+	case "quota":
+		return "", errors.New(message)
+	}
+	if scheduleCache, ok := cache.(sw.ScheduleCache); ok {
+		if err = scheduleCache.ScheduleRemove(job.ID); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[x] scheduler job [%s] cache.ScheduleRemove %s", job.ID, err.Error()))
+		}
+	}
+	return "", errors.New(fmt.Sprintf("%s, job removed", message))
+}
+
+// countUsage 定时提问计入创建人当天的提问次数
+func (s *Scheduler) countUsage(ctx context.Context, userUID sc.UserUID) {
+	if userUID == "" {
+		return
+	}
+	if adminCache, ok := sw.CacheWithContext(ctx, s.cache).(sw.AdminCache); ok {
+		if _, err := adminCache.UserUsageIncr(userUID); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[x] scheduler cache.UserUsageIncr %s", err.Error()))
+		}
+	}
+}
+
+// ask 以任务内容向 smart 提问
+func (s *Scheduler) ask(ctx context.Context, job *sw.ScheduleJob) (string, error) {
+	askCtx, cancel := context.WithTimeout(sw.WithActor(ctx, job.Creator), scheduleAskTimeout)
+	defer cancel()
+	return askText(askCtx, s.smart[job.SmartID], job.SmartID, s.redactor, job.Content)
+}
+
+// askText 不经过会话主动向 smart 提问，redactor 不为空时提问前脱敏并还原答复
+func askText(ctx context.Context, target smart.Smart, smartID string, redactor *sw.Redactor, content string) (string, error) {
+	if target == nil {
+		return "", errors.New(fmt.Sprintf("smart [%s] not found", smartID))
+	}
+	question, redaction := sc.Question(content), (*sw.Redaction)(nil)
+	if redactor != nil {
+		question, redaction = redactor.Redact(question)
+		ctx = sw.WithRedaction(ctx, redaction)
+	}
+	answer, err := sw.AskWithContext(ctx, target, question)
+	if err != nil {
+		monitor.SmartErrors.WithLabelValues(smartID).Inc()
+		return "", err
+	}
+	text := fmt.Sprint(answer)
+	if redaction != nil {
+		text = redaction.Restore(text)
+	}
+	return text, nil
+}
+
+// userSchedules 用户创建的任务
+func (s *Scheduler) userSchedules(ctx context.Context, creator string) ([]sw.ScheduleJob, error) {
+	scheduleCache, err := s.scheduleCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := scheduleCache.Schedules()
+	if err != nil {
+		return nil, err
+	}
+	var owned []sw.ScheduleJob
+	for i := range jobs {
+		if jobs[i].Creator == creator {
+			owned = append(owned, jobs[i])
+		}
+	}
+	return owned, nil
+}
+
+// reminderArgs 提醒工具的参数
+type reminderArgs struct {
+	Action  string `json:"action"`
+	Content string `json:"content"`
+	At      string `json:"at"`
+	Days    int    `json:"days"`
+	Minutes int    `json:"minutes"`
+	Cron    string `json:"cron"`
+	Ask     bool   `json:"ask"`
+	ID      string `json:"id"`
+}
+
+// next 一次性提醒的时间
+func (args *reminderArgs) next(now time.Time) (time.Time, error) {
+	if args.Minutes > 0 {
+		return now.Add(time.Duration(args.Minutes) * time.Minute), nil
+	}
+	at := strings.TrimSpace(args.At)
+	if t, err := time.ParseInLocation("2006-01-02 15:04", at, time.Local); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", at, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("invalid at [%s], HH:MM or YYYY-MM-DD HH:MM required", args.At))
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+args.Days, clock.Hour(), clock.Minute(), 0, 0, time.Local), nil
+}
+
+// ReminderTool 用户通过 smart 创建、查看与取消自己的提醒，只支持企微应用的用户
+func (s *Scheduler) ReminderTool() *sw.Tool {
+	return &sw.Tool{
+		Name: ReminderToolName,
+		Description: "为当前用户创建、查看或取消定时提醒。用户要求“明天9点提醒我…”“每天早上发我新闻摘要”时使用，" +
+			"创建后告诉用户提醒时间与ID。",
+		Parameters: json.RawMessage(reminderParameters),
+		Internal:   true,
+		Handler: func(ctx context.Context, arguments json.RawMessage) (string, error) {
+			var args reminderArgs
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", err
+			}
+			creator := sw.ActorFromContext(ctx)
+			platform, userID, _ := strings.Cut(creator, ":")
+			if platform != "wecom" || userID == "" {
+				return "", errors.New("reminder only supported in wecom app")
+			}
+
+			switch args.Action {
+			case "create":
+				return s.createReminder(ctx, creator, userID, &args)
+			case "list":
+				return s.listReminders(ctx, creator)
+			case "cancel":
+				return s.cancelReminder(ctx, creator, args.ID)
+			default:
+				return "", errors.New(fmt.Sprintf("unknown action [%s]", args.Action))
+			}
+		},
+	}
+}
+
+func (s *Scheduler) createReminder(ctx context.Context, creator string, userID string, args *reminderArgs) (string, error) {
+	owned, err := s.userSchedules(ctx, creator)
+	if err != nil {
+		return "", err
+	}
+	if len(owned) >= maxUserSchedules {
+		return "", errors.New(fmt.Sprintf("at most %d reminders per user, cancel some first", maxUserSchedules))
+	}
+
+	job := &sw.ScheduleJob{
+		Kind:    sw.ScheduleKindReminder,
+		Creator: creator,
+		UserIDs: []string{userID},
+		Content: strings.TrimSpace(args.Content),
+		Cron:    strings.TrimSpace(args.Cron),
+	}
+	if args.Ask {
+		job.Kind, job.SmartID = sw.ScheduleKindPrompt, s.smartID
+		if err = s.allowed(ctx, creator); err != nil {
+			return "", err
+		}
+	}
+	if !job.Recurring() {
+		now := time.Now()
+		if job.Next, err = args.next(now); err != nil {
+			return "", err
+		}
+		if !job.Next.After(now) {
+			return "", errors.New(fmt.Sprintf("time %s has passed", job.Next.Format("2006-01-02 15:04")))
+		}
+	}
+	if err = s.Add(ctx, job); err != nil {
+		return "", err
+	}
+	result := fmt.Sprintf("已创建提醒 [%s]，下次执行时间 %s", job.ID, job.Next.Format("2006-01-02 15:04"))
+	if job.Recurring() {
+		result += fmt.Sprintf("，周期 %s", job.Cron)
+	}
+	return result, nil
+}
+
+// allowed 创建定时提问时检查创建人能否使用 smartID
+func (s *Scheduler) allowed(ctx context.Context, creator string) error {
+	cache := sw.CacheWithContext(ctx, s.cache)
+	userUID, err := cache.UserID2UID(creator)
+	if err != nil {
+		return err
+	}
+	allowed, err := sw.SmartAllowed(cache, userUID, s.smartID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errors.New(fmt.Sprintf("smart [%s] not granted, scheduled questions unavailable", s.smartID))
+	}
+	return nil
+}
+
+func (s *Scheduler) listReminders(ctx context.Context, creator string) (string, error) {
+	owned, err := s.userSchedules(ctx, creator)
+	if err != nil {
+		return "", err
+	}
+	if len(owned) == 0 {
+		return "当前没有提醒", nil
+	}
+	lines := make([]string, 0, len(owned))
+	for i := range owned {
+		line := fmt.Sprintf("[%s] %s %s", owned[i].ID, owned[i].Next.Format("2006-01-02 15:04"), owned[i].Content)
+		if owned[i].Recurring() {
+			line += fmt.Sprintf("（周期 %s）", owned[i].Cron)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s *Scheduler) cancelReminder(ctx context.Context, creator string, id string) (string, error) {
+	owned, err := s.userSchedules(ctx, creator)
+	if err != nil {
+		return "", err
+	}
+	for i := range owned {
+		if owned[i].ID != id {
+			continue
+		}
+		scheduleCache, err := s.scheduleCache(ctx)
+		if err != nil {
+			return "", err
+		}
+		if err = scheduleCache.ScheduleRemove(id); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("已取消提醒 [%s]", id), nil
+	}
+	return "", errors.New(fmt.Sprintf("reminder [%s] not found", id))
+}
@@ -0,0 +1,108 @@
+package tencent
+
+import (
+	"context"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	sw "github.com/openai-smart/smart-wecom"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// templateCommand 使用模板提问的指令，/t <模板> <内容>，只有 /t 时列出所有模板
+const templateCommand = "/t"
+
+// parseTemplateCommand 消息是否为模板指令，返回模板引用与用户输入，用户输入保留原始换行
+func parseTemplateCommand(content string) (string, string, bool) {
+	content = strings.TrimSpace(content)
+	if fields0(content) != templateCommand {
+		return "", "", false
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(content, templateCommand))
+	ref := fields0(rest)
+	return ref, strings.TrimSpace(strings.TrimPrefix(rest, ref)), true
+}
+
+// templateList 答复所有模板及最新版本
+func (p *pipeline) templateList(ctx context.Context, session sc.Session) {
+	cache := sw.CacheWithContext(ctx, p.cache)
+	names, err := sw.TemplateNames(cache)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] template names %s", session.ID, err.Error()))
+		p.reply(session, "不支持模板")
+		return
+	}
+	if len(names) == 0 {
+		p.reply(session, "暂无模板")
+		return
+	}
+	lines := make([]string, 0, len(names)+1)
+	lines = append(lines, fmt.Sprintf("用法：%s <模板> <内容>，可用模板：", templateCommand))
+	for i := range names {
+		if tmpl, err := sw.LoadTemplate(cache, names[i]); err == nil {
+			lines = append(lines, tmpl.Ref())
+		}
+	}
+	p.reply(session, strings.Join(lines, "\n"))
+}
+
+// promptTemplate 提问使用的模板，未指定时使用用户或 smart 的默认模板，读取失败时不使用模板
+func (p *pipeline) promptTemplate(ctx context.Context, session sc.Session, ref string) *sw.PromptTemplate {
+	cache := sw.CacheWithContext(ctx, p.cache)
+	if ref == "" {
+		var err error
+		if ref, err = sw.DefaultTemplateRef(cache, session.SmartID, session.User.UID); err != nil {
+			log.Warn().Msg(fmt.Sprintf("[%s] default template %s", session.ID, err.Error()))
+			return nil
+		}
+		if ref == "" {
+			return nil
+		}
+	}
+	tmpl, err := sw.LoadTemplate(cache, ref)
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] smart[%s] load template %s", session.ID, session.SmartID, err.Error()))
+		return nil
+	}
+	return tmpl
+}
+
+// renderTemplate 使用模板渲染用户输入，渲染失败时使用原始输入
+func (p *pipeline) renderTemplate(session sc.Session, tmpl *sw.PromptTemplate, input string) (string, bool) {
+	prompt, err := tmpl.Render(sw.NewTemplateData(session.User, session.SmartID, input))
+	if err != nil {
+		log.Warn().Msg(fmt.Sprintf("[%s] render template [%s] %s", session.ID, tmpl.Ref(), err.Error()))
+		return input, false
+	}
+	return prompt, true
+}
+
+func (p *pipeline) adminTemplate(ctx context.Context, cmd *adminContext) (string, error) {
+	if cmd.args[1] == "" {
+		return "", errors.New(fmt.Sprintf("empty template [%s]", cmd.args[0]))
+	}
+	tmpl, err := sw.StoreTemplate(sw.CacheWithContext(ctx, p.cache), cmd.args[0], cmd.args[1])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已保存模板 %s", tmpl.Ref()), nil
+}
+
+func (p *pipeline) adminUseTemplate(ctx context.Context, cmd *adminContext) (string, error) {
+	user, err := p.targetUser(ctx, cmd.target)
+	if err != nil {
+		return "", err
+	}
+	ref := ""
+	if len(cmd.args) > 1 && cmd.args[1] != "-" {
+		ref = cmd.args[1]
+	}
+	if err = sw.StoreDefaultTemplate(sw.CacheWithContext(ctx, p.cache), sw.TemplateScopeUser(user.UID), ref); err != nil {
+		return "", err
+	}
+	if ref == "" {
+		return fmt.Sprintf("已取消 %s 的默认模板", cmd.target), nil
+	}
+	return fmt.Sprintf("%s 的默认模板已设置为 %s", cmd.target, ref), nil
+}
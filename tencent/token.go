@@ -0,0 +1,85 @@
+package tencent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// accessToken 应用 access_token 缓存
+// go-workwx 没有暴露其内部 token，这里单独维护一份用于就绪检查与扩展API调用
+// 企微返回 token 无效或已过期（40014、42001）时由 post 与 get 丢弃并重新获取
+type accessToken struct {
+	mu        sync.Mutex
+	corpID    string
+	secret    string
+	token     string
+	expiresAt time.Time
+}
+
+// get 返回未过期的 token，过期或即将过期时重新获取
+func (t *accessToken) get() (string, error) {
+	return t.getContext(context.Background())
+}
+
+// getContext 同 get，重新获取时受 ctx 的超时与取消控制
+func (t *accessToken) getContext(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiresAt) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/cgi-bin/gettoken?corpid=%s&corpsecret=%s",
+		qyapiHost, url.QueryEscape(t.corpID), url.QueryEscape(t.secret)), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		qyapiResult
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if err = result.err(); err != nil {
+		return "", err
+	}
+
+	t.token = result.AccessToken
+	t.expiresAt = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// invalidate 企微返回 token 无效或已过期时丢弃 token，下次 get 重新获取
+// 只丢弃与 token 相同的缓存，避免覆盖其它请求已经刷新的 token
+func (t *accessToken) invalidate(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == token {
+		t.token = ""
+	}
+}
+
+// AccessToken 应用 access_token
+func (app *WecomApp) AccessToken() (string, error) {
+	return app.token.get()
+}
+
+// CheckAccessToken 检查 access_token 是否可用，用于就绪检查
+func (app *WecomApp) CheckAccessToken(ctx context.Context) error {
+	_, err := app.token.getContext(ctx)
+	return err
+}
@@ -1,14 +1,20 @@
 package tencent
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	sc "github.com/openai-smart/smart-chat"
 	"github.com/openai-smart/smart-chat/chat"
 	"github.com/openai-smart/smart-chat/smart"
+	"github.com/openai-smart/smart-wecom/monitor"
+	"github.com/openai-smart/smart-wecom/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/xen0n/go-workwx"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
 	"net/http"
-	"time"
+	"sync"
 )
 
 // CorpID 企微ID
@@ -30,6 +36,7 @@ type WecomAppEventConfigure struct {
 // WecomApp 企微应用APP
 type WecomApp struct {
 	client *workwx.WorkwxApp
+	token  *accessToken
 }
 
 // NewWecomChatApp 创建一个APP聊天客户端
@@ -39,162 +46,245 @@ func NewWecomChatApp(wx *workwx.Workwx, configure *WecomAppConfigure) *WecomApp
 
 	return &WecomApp{
 		client: client,
+		token: &accessToken{
+			corpID: wx.CorpID,
+			secret: configure.CorpSecret,
+		},
 	}
 }
 
+// replyable 可通过应用答复的消息
+type replyable interface {
+	Recipient() workwx.Recipient
+}
+
 // ChatGPTCompletionHandler 发送消息到企微
 func (app *WecomApp) ChatGPTCompletionHandler(session *sc.Session) error {
-	rxMsg := session.Question.(*workwx.RxMessage)
 	// TODO 内容大小判断，超出则分批发送
-	recipient := workwx.Recipient{
-		UserIDs: []string{rxMsg.FromUserID},
+	recipient := session.Question.(replyable).Recipient()
+
+	err := app.client.SendMarkdownMessage(&recipient, session.Answer.(string), false)
+	if err != nil {
+		monitor.WecomSendFailures.Inc()
 	}
+	return err
+}
 
-	return app.client.SendMarkdownMessage(&recipient, session.Answer.(string), false)
+// Depts 应用可见的所有部门
+func (app *WecomApp) Depts() ([]*workwx.DeptInfo, error) {
+	return app.client.ListAllDepts()
 }
 
-// ExportDepts 导出的所有部门成员信息，取决于app权限，这里默认只返回一个
+// ExportDepts 导出应用可见的所有部门及其子部门的成员，同一成员在多个部门时只返回一次
 func (app *WecomApp) ExportDepts() ([]*workwx.UserInfo, error) {
 	depts, err := app.client.ListAllDepts()
 	if err != nil {
 		return nil, err
 	}
-	if len(depts) == 0 {
-		return nil, nil
-	}
-	return app.client.ListUsersByDeptID(depts[0].ID, true)
 
+	var users []*workwx.UserInfo
+	seen := make(map[string]bool)
+	for i := range depts {
+		deptUsers, err := app.client.ListUsersByDeptID(depts[i].ID, false)
+		if err != nil {
+			return nil, err
+		}
+		for j := range deptUsers {
+			if seen[deptUsers[j].UserID] {
+				continue
+			}
+			seen[deptUsers[j].UserID] = true
+			users = append(users, deptUsers[j])
+		}
+	}
+	return users, nil
 }
 
 type WecomAppChat struct {
 	chat.Chat
+	*pipeline
 
-	app     *WecomApp
-	filters []chat.Filter
-	mux     *http.ServeMux
-	chs     []chat.CompletionHandler
-
-	smart map[string]smart.Smart
+	app *WecomApp
+	mux *http.ServeMux
 
-	cache sc.Cache
+	// smartNames 卡片按钮上显示的 smart 名称
+	smartNames map[string]string
+	// welcome 欢迎语，welcomed 记录进入应用时欢迎语的发送时间
+	welcome  string
+	welcomed sync.Map
 }
 
 func NewSmartWecomChat(app *WecomApp, smart map[string]smart.Smart,
 	filter []chat.Filter, cache sc.Cache) chat.Chat {
-	return &WecomAppChat{
-		app:     app,
-		mux:     http.NewServeMux(),
-		smart:   smart,
-		filters: filter,
-		cache:   cache,
+	wecomChat := &WecomAppChat{
+		pipeline: newPipeline("wecom", smart, filter, cache),
+		app:      app,
+		mux:      http.NewServeMux(),
+		welcome:  DefaultWelcome,
+	}
+	wecomChat.replier = app.ChatGPTCompletionHandler
+	wecomChat.userDepts = app.UserDeptIDs
+	// 未开启 EnableBroadcast 时直接发送给 @all，只调用一次接口，没有群发ID
+	wecomChat.broadcast = func(_ context.Context, markdown string) (string, error) {
+		return "", app.Broadcast(markdown)
 	}
+	return wecomChat
 }
 
 func (wecomChat *WecomAppChat) Platform() string {
 	return "wecom"
 }
 
-func (wecomChat *WecomAppChat) smartChatProcess(session sc.Session) {
-	defer func() {
-		err := recover()
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("[%s] %s", session.ID, err))
-		}
-
-	}()
-	text, _ := session.Question.(*workwx.RxMessage).Text()
-	answer, err := wecomChat.smart[session.SmartID].Ask(text.GetContent())
-	if err != nil {
-		log.Error().Msg(err.Error())
-		return
-	}
-
-	session.Answer = answer
-
-	for i := range wecomChat.chs {
-		if err := wecomChat.chs[i](&session); err != nil {
-			return // TODO CompletionHandler出现错误后面的不会继续执行，需要一个合理解决方法
-		}
-	}
-
-	if err := wecomChat.cache.SessionStore(&session); err != nil {
-		log.Error().Msg(fmt.Sprintf("[%s] store session error %s", session.ID, err.Error()))
-		return
-	}
-
-}
-
 // OnIncomingMessage 接收来自企微发送的消息
 // https://developer.work.weixin.qq.com/document/path/90930
 func (wecomChat *WecomAppChat) OnIncomingMessage(rxMsg *workwx.RxMessage) error {
+	return wecomChat.onIncomingMessage(context.Background(), &RxMessage{RxMessage: rxMsg})
+}
+
+func (wecomChat *WecomAppChat) onIncomingMessage(ctx context.Context, rxMsg *RxMessage) error {
 	log.Debug().Msg("incoming message: " + rxMsg.String())
+	monitor.IncomingMessages.WithLabelValues(string(rxMsg.MsgType)).Inc()
 
-	// 企微用户ID转换为 UserUID 用户ID
-	userUID, err := wecomChat.cache.UserID2UID(fmt.Sprintf("%s:%s", wecomChat.Platform(), rxMsg.FromUserID))
+	if rxMsg.MsgType == workwx.MessageTypeEvent {
+		wecomChat.onEvent(ctx, rxMsg)
+		return nil
+	}
 
 	// 企微消息ID转换为 SessionID 会话ID
 	sessionID := sc.SessionID(fmt.Sprintf("%s:%d", wecomChat.Platform(), rxMsg.MsgID))
 
-	if err != nil {
-		log.Warn().Msg(fmt.Sprintf("[%s] wecomChat.cache.UserID2UID %s", sessionID, err.Error()))
-		return nil // TODO 出现错误是否需要企微补发消息？
-	}
+	ctx, span := tracing.Start(ctx, "wecom.message",
+		attribute.String("session.id", string(sessionID)),
+		attribute.String("wecom.msg_type", string(rxMsg.MsgType)))
+	defer span.End()
 
-	// 找到发送用户的信息
-	user, err := wecomChat.cache.User(userUID)
-	if err != nil {
-		log.Warn().Msg(fmt.Sprintf("[%s] wecomChat.cache.User %s", sessionID, err.Error()))
-		return nil // TODO 出现错误是否需要企微补发消息？
-	}
-	if user == nil { // 用户未找到
-		log.Warn().Msg(fmt.Sprintf("[%s] user [%s] not found %s", sessionID, userUID, err.Error()))
-		return nil
-	}
+	// 企微要求回调在 5 秒内响应，查询用户与拦截都需要在此之前完成
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
 
-	smartIDs, _ := wecomChat.cache.UserAnswer(userUID)
+	// 应用群聊只能由应用推送消息，企微不会回调群聊中的消息，群聊提问由群机器人接收
+	wecomChat.handle(ctx, sessionID, rxMsg.FromUserID, rxMsg, nil)
+	return nil
+}
 
-	if err != nil {
-		log.Warn().Msg(fmt.Sprintf("[%s] wecomChat.cache.User %s", sessionID, err.Error()))
-		return nil // TODO 出现错误是否需要企微补发消息？
-	}
+func (wecomChat *WecomAppChat) AddCompletionHandler(ch chat.CompletionHandler) {
+	// TODO 同步锁
+	wecomChat.chs = append(wecomChat.chs, ch)
+}
 
-	session := sc.Session{
-		ID:       sessionID,
-		User:     user,
-		Question: rxMsg,
+// rxRequest 一次回调请求的 ctx 与 go-workwx 未解析的字段
+type rxRequest struct {
+	ctx    context.Context
+	extras RxExtras
+	// claimed 是否已由 OnIncomingMessage 取用
+	claimed bool
+}
+
+// rxHandler 将回调请求的 ctx 与 go-workwx 未解析的字段传递给 WecomAppChat
+// go-workwx 在 ServeHTTP 中同步回调 OnIncomingMessage，请求按消息标识暂存在 pending 中
+// 企微重试时同一消息的多个请求可能同时处理，每个请求单独暂存，结束时只删除自己
+type rxHandler struct {
+	chat    *WecomAppChat
+	mu      sync.Mutex
+	pending map[rxKey][]*rxRequest
+}
+
+// add 暂存一次回调请求，请求结束时需调用 remove
+func (h *rxHandler) add(key rxKey, req *rxRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending == nil {
+		h.pending = make(map[rxKey][]*rxRequest)
 	}
+	h.pending[key] = append(h.pending[key], req)
+}
 
-	for i := range wecomChat.filters {
-		if err := wecomChat.filters[i].DoFilter(&session); err != nil {
-			log.Warn().Msg(err.Error())
-			// TODO 处理被拦截的消息
-			return nil
+// remove 删除 add 暂存的请求，不影响同一消息的其它请求
+func (h *rxHandler) remove(key rxKey, req *rxRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	reqs := h.pending[key]
+	for i := range reqs {
+		if reqs[i] == req {
+			reqs = append(reqs[:i:i], reqs[i+1:]...)
+			break
 		}
 	}
-
-	// 开始向smart提问
-	for i := range smartIDs {
-		session.SmartID = smartIDs[i]
-		go wecomChat.smartChatProcess(session)
-		time.Sleep(500)
+	if len(reqs) == 0 {
+		delete(h.pending, key)
+		return
 	}
+	h.pending[key] = reqs
+}
 
+// claim 取用 key 对应的最早一个未取用的请求，没有时返回 nil
+func (h *rxHandler) claim(key rxKey) *rxRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, req := range h.pending[key] {
+		if !req.claimed {
+			req.claimed = true
+			return req
+		}
+	}
 	return nil
 }
 
-func (wecomChat *WecomAppChat) AddCompletionHandler(ch chat.CompletionHandler) {
-	// TODO 同步锁
-	wecomChat.chs = append(wecomChat.chs, ch)
+func (h *rxHandler) OnIncomingMessage(rxMsg *workwx.RxMessage) error {
+	req := h.claim(messageKey(rxMsg))
+	if req == nil {
+		req = &rxRequest{ctx: context.Background()}
+	}
+	return h.chat.onIncomingMessage(req.ctx, &RxMessage{RxMessage: rxMsg, RxExtras: req.extras})
 }
 
 // AddEventHandler 创建应用接收消息API处理器
 func (wecomChat *WecomAppChat) AddEventHandler(ec chat.EventConfigure) error {
 	configure := ec.(*WecomAppEventConfigure)
-	handler, err := workwx.NewHTTPHandler(configure.Token, configure.EncodingAESKey, wecomChat)
+	rx := &rxHandler{chat: wecomChat}
+	handler, err := workwx.NewHTTPHandler(configure.Token, configure.EncodingAESKey, rx)
 	if err != nil {
 		return err
 	}
-	wecomChat.mux.Handle(configure.Uri, handler)
+	crypto, err := newEnvelopeCrypto(configure.Token, configure.EncodingAESKey)
+	if err != nil {
+		return err
+	}
+
+	wecomChat.mux.HandleFunc(configure.Uri, func(w http.ResponseWriter, r *http.Request) {
+		// 解密与消息处理都在此 span 内完成
+		ctx, span := tracing.Start(r.Context(), "wecom.callback", attribute.String("http.route", configure.Uri))
+		defer span.End()
+
+		// 先读取 go-workwx 未解析的字段，再将请求体交给 go-workwx 处理
+		var extras RxExtras
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			var key rxKey
+			extras, key = crypto.extras(body)
+			req := &rxRequest{ctx: ctx, extras: extras}
+			rx.add(key, req)
+			defer rx.remove(key, req)
+
+			// go-workwx 不支持 delete_user 等通讯录事件，通讯录变更事件自行校验后处理
+			if extras.EventName == eventChangeContact {
+				if _, err = crypto.open(r.URL.Query(), body); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				wecomChat.onContactChange(ctx, &extras)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
 	return nil
 }
 
@@ -207,6 +297,18 @@ func (wecomChat *WecomAppChat) Accept(addr string) error {
 	return nil
 }
 
+// EnableMonitor 在消息服务上开启 /healthz、/readyz 与 /metrics
+// /readyz 检查企微 access_token 是否可用，cache 支持 Ping 时同时检查其连通性
+func (wecomChat *WecomAppChat) EnableMonitor() {
+	checks := map[string]monitor.Check{
+		"wecom": wecomChat.app.CheckAccessToken,
+	}
+	if pinger, ok := wecomChat.cache.(monitor.Pinger); ok {
+		checks["cache"] = pinger.Ping
+	}
+	monitor.Register(wecomChat.mux, checks)
+}
+
 func (wecomChat *WecomAppChat) Filters() []chat.Filter {
 	return wecomChat.filters[:]
 }
@@ -0,0 +1,281 @@
+package smart_wecom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultToolTimeout 工具未设置超时时间时使用的超时时间
+const DefaultToolTimeout = 10 * time.Second
+
+// maxToolResultLength 工具结果返回给 smart 的最大字数
+const maxToolResultLength = 4000
+
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ToolHandler 执行工具调用，arguments 为 smart 生成的 JSON 参数
+// 提问用户可以通过 ActorFromContext(ctx) 取得，如 wecom:zhangsan
+type ToolHandler func(ctx context.Context, arguments json.RawMessage) (string, error)
+
+// Tool smart 可以调用的工具
+type Tool struct {
+	// Name 工具名称，只能包含字母、数字、_ 与 -
+	Name        string
+	Description string
+	// Parameters 参数的 JSON Schema，为空时没有参数
+	Parameters json.RawMessage
+	// Timeout 单次调用的超时时间，为 0 时使用 DefaultToolTimeout
+	Timeout time.Duration
+	Handler ToolHandler
+	// Internal 只允许企业内部成员与系统调用，微信客服等外部用户提问时不提供，如通讯录
+	Internal bool
+}
+
+// internalActor 操作人是否为企业内部成员或系统
+func internalActor(actor string) bool {
+	return actor == ActorSystem || strings.HasPrefix(actor, "wecom:")
+}
+
+// ToolRegistry 工具注册表，每个 smart 只能调用允许的工具
+type ToolRegistry struct {
+	cache sc.Cache
+
+	mu    sync.RWMutex
+	tools map[string]*Tool
+	// allow smart 允许调用的工具
+	allow map[string]map[string]bool
+}
+
+// NewToolRegistry 创建工具注册表，cache 支持 AuditCache 时每次调用都记录到操作记录
+func NewToolRegistry(cache sc.Cache) *ToolRegistry {
+	return &ToolRegistry{
+		cache: cache,
+		tools: make(map[string]*Tool),
+		allow: make(map[string]map[string]bool),
+	}
+}
+
+// Register 注册工具，同名工具覆盖
+func (registry *ToolRegistry) Register(tool *Tool) error {
+	if !toolNamePattern.MatchString(tool.Name) {
+		return errors.New(fmt.Sprintf("invalid tool name [%s]", tool.Name))
+	}
+	if tool.Handler == nil {
+		return errors.New(fmt.Sprintf("tool [%s] handler required", tool.Name))
+	}
+	if len(tool.Parameters) == 0 {
+		tool.Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	if !json.Valid(tool.Parameters) {
+		return errors.New(fmt.Sprintf("tool [%s] parameters is not valid JSON", tool.Name))
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.tools[tool.Name] = tool
+	return nil
+}
+
+// Allow 允许 smartID 调用 names 中的工具
+func (registry *ToolRegistry) Allow(smartID string, names ...string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.allow[smartID] == nil {
+		registry.allow[smartID] = make(map[string]bool)
+	}
+	for i := range names {
+		if _, ok := registry.tools[names[i]]; !ok {
+			return errors.New(fmt.Sprintf("tool [%s] not registered", names[i]))
+		}
+		registry.allow[smartID][names[i]] = true
+	}
+	return nil
+}
+
+// ToolSet smartID 允许调用的工具，没有允许的工具时返回 nil
+func (registry *ToolRegistry) ToolSet(smartID string) *ToolSet {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	if len(registry.allow[smartID]) == 0 {
+		return nil
+	}
+	return &ToolSet{registry: registry, smartID: smartID}
+}
+
+// ToolSet 某个 smart 允许调用的工具
+type ToolSet struct {
+	registry *ToolRegistry
+	smartID  string
+}
+
+// Tools ctx 中的提问用户允许调用的工具，按名称排序
+func (set *ToolSet) Tools(ctx context.Context) []*Tool {
+	set.registry.mu.RLock()
+	defer set.registry.mu.RUnlock()
+	internal := internalActor(ActorFromContext(ctx))
+	tools := make([]*Tool, 0, len(set.registry.allow[set.smartID]))
+	for name := range set.registry.allow[set.smartID] {
+		if tool := set.registry.tools[name]; internal || !tool.Internal {
+			tools = append(tools, tool)
+		}
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+	return tools
+}
+
+// Call 在超时时间内执行工具并记录到操作记录，返回给 smart 的结果
+// 工具不存在、不允许调用或执行失败时返回错误说明，由 smart 决定如何答复
+// ctx 中有本次提问的脱敏结果时，结果使用同一组占位符脱敏，答复中的占位符随提问一起还原
+func (set *ToolSet) Call(ctx context.Context, name string, arguments string) string {
+	set.registry.mu.RLock()
+	tool, ok := set.registry.tools[name]
+	allowed := set.registry.allow[set.smartID][name]
+	set.registry.mu.RUnlock()
+
+	start := time.Now()
+	var result string
+	var err error
+	switch {
+	case !ok || !allowed || (tool.Internal && !internalActor(ActorFromContext(ctx))):
+		err = errors.New(fmt.Sprintf("tool [%s] not allowed", name))
+	case arguments != "" && !json.Valid([]byte(arguments)):
+		err = errors.New("arguments is not valid JSON")
+	default:
+		timeout := tool.Timeout
+		if timeout <= 0 {
+			timeout = DefaultToolTimeout
+		}
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		result, err = tool.Handler(callCtx, json.RawMessage(arguments))
+		cancel()
+	}
+
+	detail := fmt.Sprintf("smart %s, %s, %s", set.smartID, time.Since(start).Round(time.Millisecond), arguments)
+	if err != nil {
+		detail = fmt.Sprintf("%s failed, %s", detail, err.Error())
+		result = fmt.Sprintf("error: %s", err.Error())
+	}
+	set.audit(ctx, name, detail)
+
+	if redaction := RedactionFromContext(ctx); redaction != nil {
+		result = redaction.Redact(result)
+	}
+	if n := []rune(result); len(n) > maxToolResultLength {
+		result = string(n[:maxToolResultLength]) + "…"
+	}
+	return result
+}
+
+func (set *ToolSet) audit(ctx context.Context, name string, detail string) {
+	log.Info().Msg(fmt.Sprintf("tool [%s] called by %s, %s", name, ActorFromContext(ctx), detail))
+	auditCache, ok := CacheWithContext(ctx, set.registry.cache).(AuditCache)
+	if !ok {
+		return
+	}
+	if err := auditCache.AuditAppend(&AuditEntry{
+		Time:   time.Now(),
+		Actor:  ActorFromContext(ctx),
+		Action: "call",
+		Entity: AuditEntityTool,
+		Target: name,
+		Detail: detail,
+	}); err != nil {
+		log.Warn().Msg(fmt.Sprintf("tool [%s] cache.AuditAppend %s", name, err.Error()))
+	}
+}
+
+// ToolSmart 支持调用工具的 smart
+type ToolSmart interface {
+	// SetTools 设置允许调用的工具，为 nil 时不调用工具
+	SetTools(tools *ToolSet)
+}
+
+// NewHTTPTool 调用内部 HTTP 接口的工具，GET 时参数作为 query，其它方法时参数作为 JSON body，返回响应内容
+// header 为每次请求附加的请求头，如鉴权信息
+func NewHTTPTool(name string, description string, method string, endpoint string,
+	parameters json.RawMessage, header http.Header) *Tool {
+	client := &http.Client{}
+	return &Tool{
+		Name:        name,
+		Description: description,
+		Parameters:  parameters,
+		Handler: func(ctx context.Context, arguments json.RawMessage) (string, error) {
+			target, body := endpoint, io.Reader(nil)
+			if method == http.MethodGet {
+				query, err := toolQuery(arguments)
+				if err != nil {
+					return "", err
+				}
+				if len(query) > 0 {
+					separator := "?"
+					if strings.Contains(target, "?") {
+						separator = "&"
+					}
+					target += separator + query.Encode()
+				}
+			} else if len(arguments) > 0 {
+				body = bytes.NewReader(arguments)
+			}
+
+			req, err := http.NewRequestWithContext(ctx, method, target, body)
+			if err != nil {
+				return "", err
+			}
+			for key := range header {
+				req.Header[key] = header[key]
+			}
+			if body != nil {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			content, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+			if err != nil {
+				return "", err
+			}
+			if resp.StatusCode >= http.StatusBadRequest {
+				return "", errors.New(fmt.Sprintf("status %d, %s", resp.StatusCode, content))
+			}
+			return string(content), nil
+		},
+	}
+}
+
+// toolQuery JSON 参数转换为 query，嵌套的值使用 JSON 字符串
+func toolQuery(arguments json.RawMessage) (url.Values, error) {
+	query := url.Values{}
+	if len(arguments) == 0 {
+		return query, nil
+	}
+	var args map[string]any
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	for key, value := range args {
+		switch v := value.(type) {
+		case string:
+			query.Set(key, v)
+		case map[string]any, []any:
+			encoded, _ := json.Marshal(v)
+			query.Set(key, string(encoded))
+		default:
+			query.Set(key, fmt.Sprint(v))
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"net"
+	"strings"
+)
+
+// RedisHook 为每个 Redis 命令创建 span
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, span := Start(ctx, "redis.dial", attribute.String("net.peer.name", addr))
+		conn, err := next(ctx, network, addr)
+		End(span, err)
+		return conn, err
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := Start(ctx, "redis."+cmd.Name(),
+			semconv.DBSystemRedis,
+			semconv.DBOperation(cmd.Name()))
+		err := next(ctx, cmd)
+		if err == redis.Nil {
+			End(span, nil)
+		} else {
+			End(span, err)
+		}
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		names := make([]string, len(cmds))
+		for i := range cmds {
+			names[i] = cmds[i].Name()
+		}
+		ctx, span := Start(ctx, "redis.pipeline",
+			semconv.DBSystemRedis,
+			semconv.DBOperation(strings.Join(names, " ")))
+		err := next(ctx, cmds)
+		End(span, err)
+		return err
+	}
+}
@@ -0,0 +1,87 @@
+package smart_wecom
+
+import (
+	"fmt"
+	sc "github.com/openai-smart/smart-chat"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"time"
+)
+
+// UserBindCache 解除平台用户ID与 UserUID 的绑定
+type UserBindCache interface {
+	// UserUIDUnbind 解除绑定，userID 格式与 UserUIDBind 相同
+	UserUIDUnbind(userID string) error
+
+	// UserIDs 绑定到 userUID 的所有平台用户ID
+	UserIDs(userUID sc.UserUID) ([]string, error)
+}
+
+func (r Redis) UserUIDUnbind(userID string) error {
+	// key -> user:uid:[userID] => UserUID
+	// key -> uid:bindings:[UserUID] => set(userID)
+	before, _ := r.client.Get(r.ctx, fmt.Sprintf("user:uid:%s", userID)).Result()
+	_, err := r.client.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(r.ctx, fmt.Sprintf("user:uid:%s", userID))
+		if before != "" {
+			pipe.SRem(r.ctx, fmt.Sprintf("uid:bindings:%s", before), userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.audit(AuditEntityBinding, userID, "unbind", before, "")
+}
+
+func (r Redis) UserIDs(userUID sc.UserUID) ([]string, error) {
+	// key -> uid:bindings:[UserUID] => set(userID)
+	// 反向索引在绑定时维护，之前保存的绑定需要重建一次
+	built, err := r.client.Exists(r.ctx, "uid:bindings").Result()
+	if err != nil {
+		return nil, err
+	}
+	if built == 0 {
+		if err = r.rebuildBindings(); err != nil {
+			return nil, err
+		}
+	}
+	userIDs, err := r.client.SMembers(r.ctx, fmt.Sprintf("uid:bindings:%s", userUID)).Result()
+	sort.Strings(userIDs)
+	return userIDs, err
+}
+
+// rebuildBindings 按 user:uid 重建 uid:bindings 反向索引
+func (r Redis) rebuildBindings() error {
+	// key -> uid:bindings => 反向索引已建立的标记
+	bindings, err := r.UserBindings("")
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for userID, userUID := range bindings {
+			pipe.SAdd(r.ctx, fmt.Sprintf("uid:bindings:%s", userUID), userID)
+		}
+		pipe.Set(r.ctx, "uid:bindings", time.Now().Unix(), 0)
+		return nil
+	})
+	return err
+}
+
+// ProvisionUser 保存用户并绑定平台用户ID，smarts 同时作为用户拥有与提问使用的 smart
+// userID 为带平台前缀的用户ID，如 wecom:zhangsan
+func ProvisionUser(cache sc.Cache, userID string, user *sc.User, smarts ...string) error {
+	if err := cache.UserStore(user); err != nil {
+		return err
+	}
+	if err := cache.UserUIDBind(userID, user.UID); err != nil {
+		return err
+	}
+	if len(smarts) == 0 {
+		return nil
+	}
+	if err := cache.UserSmartsStore(user.UID, smarts...); err != nil {
+		return err
+	}
+	return cache.UserAnswerStore(user.UID, smarts...)
+}